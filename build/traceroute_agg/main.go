@@ -1 +1,39 @@
 package main
+
+import (
+	"flag"
+	"github.com/sirupsen/logrus"
+	"mda-traceroute-go/db/dao"
+	ta "mda-traceroute-go/plugins/traceroute_agg"
+	"mda-traceroute-go/plugins/traceroute_agg/api"
+	"mda-traceroute-go/plugins/traceroute_agg/geoip"
+	tau "mda-traceroute-go/plugins/traceroute_agg/utils"
+	"mda-traceroute-go/util"
+)
+
+func main() {
+	config := flag.String("c", "agg.toml", "配置文件")
+	flag.Parse()
+
+	// 加载配置
+	err := tau.ParseConfig(*config)
+	if err != nil {
+		return
+	}
+	conf := tau.ConfigData
+	// 初始化logrus
+	util.InitLogWithConf(ta.PluginName, conf.LogDir, conf.LogLevel)
+
+	// 初始化数据库，未配置或连接失败时仍可提供探测服务，只是结果不入库
+	err = dao.InitDB(conf.DSN)
+	if err != nil {
+		logrus.Errorf("%v", err)
+	}
+
+	geoip.InitGeoipDB(conf.CityDB, conf.ASNDB)
+
+	err = api.Start(conf.Listen, conf.StaticDir)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -49,6 +49,62 @@ function listMap(map, keys) {
 }
 
 
+// 展开各探测节点上报的菱形，并带上节点名
+function listDiamonds(traces) {
+    var arr = new Array()
+    if (traces == null) {
+        return arr
+    }
+    for (let i = 0; i < traces.length; i++) {
+        let diamonds = traces[i].diamonds
+        if (diamonds == null) {
+            continue
+        }
+        for (let j = 0; j < diamonds.length; j++) {
+            diamonds[j].name = traces[i].name
+            arr.push(diamonds[j])
+        }
+    }
+    return arr
+}
+
+// 展开各探测节点上报的 DSCP 路径，每个节点的第一个 DSCP 值为比较的基准
+function listDSCP(traces) {
+    var arr = new Array()
+    if (traces == null) {
+        return arr
+    }
+    for (let i = 0; i < traces.length; i++) {
+        let dscp = traces[i].dscp
+        if (dscp == null) {
+            continue
+        }
+        for (let j = 0; j < dscp.length; j++) {
+            dscp[j].name = traces[i].name
+            dscp[j].base = j == 0
+            dscp[j].latencyText = dscp[j].latency.map(l => l ? l.toFixed(2) : "*").join(" ")
+            arr.push(dscp[j])
+        }
+    }
+    return arr
+}
+
+// 解析逗号分隔的整数，忽略无法解析的项
+function parseInts(s) {
+    var arr = new Array()
+    if (s == null) {
+        return arr
+    }
+    let items = s.split(",")
+    for (let i = 0; i < items.length; i++) {
+        let v = parseInt(items[i])
+        if (!isNaN(v)) {
+            arr.push(v)
+        }
+    }
+    return arr
+}
+
 function sortMapKey(obj, desc = false) {
     let keys = new Array()
     for (let key in obj) {
@@ -4,16 +4,22 @@ import (
 	tp "mda-traceroute-go/plugins/traceroute_probe"
 	tpu "mda-traceroute-go/plugins/traceroute_probe/utils"
 	"mda-traceroute-go/util"
+	"os"
 )
 
 var (
-	DefaultMaxProbeNum = uint16(1)
+	DefaultMaxProbeNum = uint16(8)
 	DefaultMaxTTL      = uint8(64)
 	DefaultProtocol    = "icmp"
 	DefaultPacketRate  = 1.0
 )
 
 func main() {
+	// trace 子命令不连接控制节点，只在本地探测一次
+	if len(os.Args) > 1 && os.Args[1] == "trace" {
+		os.Exit(runTrace(os.Args[2:]))
+	}
+
 	// 加载配置
 	err := tpu.ParseConfig("probe.toml")
 	if err != nil {
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	tp "mda-traceroute-go/plugins/traceroute_probe"
+	"mda-traceroute-go/plugins/traceroute_probe/mda"
+	tpu "mda-traceroute-go/plugins/traceroute_probe/utils"
+	"mda-traceroute-go/util"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runTrace 执行 trace 子命令：不连接控制节点，在本地探测一次并输出结果，返回进程退出码
+func runTrace(args []string) int {
+	fs := flag.NewFlagSet("trace", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s trace [flags] <dst>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	config := fs.String("c", "probe.toml", "配置文件，不存在时使用默认配置")
+	protocol := fs.String("p", DefaultProtocol, "探测协议 icmp / udp / tcp")
+	port := fs.Uint("port", 0, "tcp 探测的目的端口，为 0 时使用配置文件中的端口或 80")
+	maxTTL := fs.Uint("m", 30, "最大 TTL")
+	rate := fs.Float64("r", 0, "每秒发送的探测数，为 0 时使用配置文件中的 packetRate")
+	mode := fs.String("mode", "", "探测模式 simple / mda / mda-lite / pmtu，为空时使用配置文件中的模式")
+	alpha := fs.Float64("alpha", 0, "MDA 每个顶点的失败概率上界，为 0 时使用 0.05")
+	alias := fs.Bool("alias", false, "探测结束后做别名解析")
+	lbDst := fs.Bool("lb-dst", false, "向目的地址同网段的其他地址探测，以识别按目的地址的负载均衡")
+	gapLimit := fs.Int("gap", 0, "连续多少跳全部超时后停止，为 0 时使用 3")
+	dscp := fs.String("dscp", "", "简单模式下依次比较的 DSCP 值（0-63），以逗号分隔，为空时使用配置文件中的值")
+	size := fs.Int("size", 0, "探测的负载长度，为 0 时使用配置文件中的长度或 32")
+	sizes := fs.String("sizes", "", "简单模式下依次比较的负载长度，以逗号分隔，为空时使用配置文件中的值")
+	pcap := fs.String("pcap", "", "把收发的所有报文写入该 pcap 文件")
+	v4 := fs.Bool("4", false, "只使用 IPv4")
+	v6 := fs.Bool("6", false, "只使用 IPv6")
+	output := fs.String("o", "text", "输出格式 text / json / atlas（RIPE Atlas traceroute 结果格式）")
+	verbose := fs.Bool("v", false, "输出探测过程的日志")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if *maxTTL == 0 || *maxTTL > 255 {
+		fmt.Fprintf(os.Stderr, "max ttl %d must be in [1, 255]\n", *maxTTL)
+		return 2
+	}
+	if *mode != "" && !util.ContainsString(mda.Modes, *mode) {
+		fmt.Fprintf(os.Stderr, "mode %s is not supported, use one of %v\n", *mode, mda.Modes)
+		return 2
+	}
+	if *output != "text" && *output != "json" && *output != "atlas" {
+		fmt.Fprintf(os.Stderr, "output %s is not supported, use text, json or atlas\n", *output)
+		return 2
+	}
+	dscps, err := parseInts(*dscp)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dscp: %v\n", err)
+		return 2
+	}
+	for _, d := range dscps {
+		if d < 0 || d > 63 {
+			fmt.Fprintf(os.Stderr, "dscp %d must be in [0, 63]\n", d)
+			return 2
+		}
+	}
+	payloads, err := parseInts(*sizes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sizes: %v\n", err)
+		return 2
+	}
+	for _, n := range append(payloads, *size) {
+		if n < 0 {
+			fmt.Fprintf(os.Stderr, "payload size %d must not be negative\n", n)
+			return 2
+		}
+	}
+	ipVersion := uint8(0)
+	if *v4 {
+		ipVersion = 4
+	} else if *v6 {
+		ipVersion = 6
+	}
+
+	if util.FileOrPathIsExists(*config) {
+		if err := tpu.ParseConfig(*config); err != nil {
+			return 1
+		}
+	} else {
+		tpu.UseDefaultConfig()
+	}
+	if *rate > 0 {
+		tpu.ConfigData.PacketRate = *rate
+	}
+	// 日志输出到标准错误，标准输出只留给探测结果
+	logrus.SetOutput(os.Stderr)
+	logrus.SetLevel(logrus.WarnLevel)
+	if *verbose {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+
+	probe := tp.NewTracerouteProbe(1, uint8(*maxTTL), *protocol, tpu.ConfigData.PacketRate)
+	res, err := probe.Trace(fs.Arg(0), &tp.TraceOptions{
+		Protocol:     *protocol,
+		Port:         uint16(*port),
+		IPVersion:    ipVersion,
+		Mode:         *mode,
+		Alpha:        *alpha,
+		Alias:        *alias,
+		LBDstTest:    *lbDst,
+		GapLimit:     *gapLimit,
+		DSCP:         dscps,
+		PayloadSize:  *size,
+		PayloadSweep: payloads,
+		Pcap:         *pcap,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch *output {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(res)
+	case "atlas":
+		err = json.NewEncoder(os.Stdout).Encode(res.Atlas())
+	default:
+		err = res.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// parseInts 解析以逗号分隔的整数列表，空字符串返回 nil
+func parseInts(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var res []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
@@ -1,5 +1,8 @@
 package dataStruct
 
+// StarAddr 某跳所有探测都超时未应答时逐跳记录中的应答地址
+const StarAddr = "*"
+
 type RouteInfo struct {
 	Domain      string `json:"domain"`
 	TTL         uint8  `json:"ttl"`
@@ -8,6 +11,59 @@ type RouteInfo struct {
 	Name        string `json:"name"`
 	Session     string `json:"session"`
 	LatencyStat LatencyStat
-	RecvCnt     uint64 `json:"recv-cnt"`
-	TimeStamp   int64  `json:"ts"`
+	RecvCnt     uint64  `json:"recv-cnt"`
+	Confidence  float64 `json:"confidence"`         // MDA 模式下该跳达到的置信度
+	Fallback    string  `json:"fallback,omitempty"` // MDA-Lite 模式下该跳回退为 MDA 的原因
+	// 该跳顶点的负载均衡类型及判断依据（探测数、固定流标识或改变目的地址时看到的不同下一跳个数）
+	LoadBalance string `json:"load-balance,omitempty"`
+	LBProbes    int    `json:"lb-probes,omitempty"`
+	LBNextHops  int    `json:"lb-next-hops,omitempty"`
+	// 应答中 ICMP 扩展携带的 MPLS 标签栈和接口信息
+	MPLS       []MPLSLabel     `json:"mpls,omitempty"`
+	Interfaces []InterfaceInfo `json:"interfaces,omitempty"`
+	// 应答报文的 IP TTL 和差错报文引用的原始探测包 TTL，直接应答没有引用的 TTL，为 0
+	ReplyTTL  uint8 `json:"reply-ttl"`
+	QuotedTTL uint8 `json:"quoted-ttl"`
+	// 由应答 TTL 推算的返回路径跳数，以及与前向跳数（探测 TTL）之差，正数表示返回路径更长
+	ReturnLen     int  `json:"return-len"`
+	Asymmetry     int  `json:"asymmetry"`
+	InvisibleMPLS bool `json:"invisible-mpls"` // 引用的 TTL 大于 1，该跳之前可能存在不可见的 MPLS 隧道
+	// 该跳返回的目的不可达标记，如 !N !H !P !X
+	Unreachable string `json:"unreachable,omitempty"`
+	// 该跳（TTL）发送、收到应答和超时未应答的探测数及丢包率，同一跳的各条记录相同；
+	// RecvCnt 为应答地址是本记录的探测数
+	Sent      int     `json:"sent"`
+	Received  int     `json:"received"`
+	Lost      int     `json:"lost"`
+	LossRatio float64 `json:"loss-ratio"`
+	// 该跳路由器对 ICMP 差错报文限速，丢失的探测不代表链路丢包
+	RateLimited bool  `json:"rate-limited,omitempty"`
+	PMTU        int   `json:"pmtu,omitempty"` // PMTU 模式下能到达该跳的最大探测大小
+	TimeStamp   int64 `json:"ts"`
+
+	// 负载长度扫描时按负载长度分别统计的延时，以及平均延时对负载长度的斜率(ms/字节)
+	SizeLatency map[int]LatencyStat `json:"size-latency,omitempty"`
+	SizeSlope   float64             `json:"size-slope,omitempty"`
+}
+
+// initialTTLs 常见操作系统发送报文时使用的初始 TTL
+var initialTTLs = []uint8{64, 128, 255}
+
+// InitialTTL 推测应答报文的初始 TTL，取不小于 ttl 的最小常见初始值
+func InitialTTL(ttl uint8) uint8 {
+	for _, v := range initialTTLs {
+		if ttl <= v {
+			return v
+		}
+	}
+	return 255
+}
+
+// ReturnPathLength 由应答报文的 TTL 推算返回路径的跳数，与探测 TTL 的含义一致：
+// 距离为 n 跳的路由器发出的应答经过 n-1 台路由器递减后到达。replyTTL 为 0 表示未知
+func ReturnPathLength(replyTTL uint8) int {
+	if replyTTL == 0 {
+		return 0
+	}
+	return int(InitialTTL(replyTTL)) - int(replyTTL) + 1
 }
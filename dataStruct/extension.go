@@ -0,0 +1,64 @@
+package dataStruct
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MPLSLabel ICMP 多部分扩展中 MPLS 标签栈对象的一个条目（RFC 4950）
+type MPLSLabel struct {
+	Label uint32 `json:"label"`
+	TC    uint8  `json:"tc"` // Traffic Class，原 EXP 字段
+	S     bool   `json:"s"`  // 栈底标志
+	TTL   uint8  `json:"ttl"`
+}
+
+// 接口信息对象中接口的角色（RFC 5837）
+const (
+	IfRoleIncoming  = 0 // 收到探测包的接口
+	IfRoleSubIP     = 1 // 收到探测包的子 IP 组件
+	IfRoleOutgoing  = 2 // 探测包原本要发出的接口
+	IfRoleIPNextHop = 3 // 探测包原本的下一跳
+)
+
+// InterfaceInfo ICMP 多部分扩展中的接口信息对象（RFC 5837），未携带的字段为零值
+type InterfaceInfo struct {
+	Role    uint8  `json:"role"`
+	IfIndex uint32 `json:"ifindex,omitempty"`
+	Addr    string `json:"addr,omitempty"`
+	Name    string `json:"name,omitempty"`
+	MTU     uint32 `json:"mtu,omitempty"`
+}
+
+// FormatMPLS 把标签栈格式化为便于展示和查询的文本，如 "24001(tc=0,s=1,ttl=1)"，多个标签以 " | " 分隔
+func FormatMPLS(labels []MPLSLabel) string {
+	s := make([]string, 0, len(labels))
+	for _, l := range labels {
+		bos := 0
+		if l.S {
+			bos = 1
+		}
+		s = append(s, fmt.Sprintf("%d(tc=%d,s=%d,ttl=%d)", l.Label, l.TC, bos, l.TTL))
+	}
+	return strings.Join(s, " | ")
+}
+
+// FormatInterfaces 把接口信息格式化为文本，如 "incoming:ge-0/0/1(ifindex=5,addr=10.0.0.1,mtu=1500)"
+func FormatInterfaces(ifs []InterfaceInfo) string {
+	roles := []string{"incoming", "sub-ip", "outgoing", "next-hop"}
+	s := make([]string, 0, len(ifs))
+	for _, i := range ifs {
+		var attrs []string
+		if i.IfIndex != 0 {
+			attrs = append(attrs, fmt.Sprintf("ifindex=%d", i.IfIndex))
+		}
+		if i.Addr != "" {
+			attrs = append(attrs, "addr="+i.Addr)
+		}
+		if i.MTU != 0 {
+			attrs = append(attrs, fmt.Sprintf("mtu=%d", i.MTU))
+		}
+		s = append(s, fmt.Sprintf("%s:%s(%s)", roles[i.Role&0x03], i.Name, strings.Join(attrs, ",")))
+	}
+	return strings.Join(s, " | ")
+}
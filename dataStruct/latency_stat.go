@@ -1,5 +1,11 @@
 package dataStruct
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 type LatencyStat struct {
 	Count float64 `json:"count"`
 	Min   float64 `json:"min"`
@@ -9,3 +15,17 @@ type LatencyStat struct {
 	Skew  float64 `json:"skew"` // skewness 偏度系数
 	Kurt  float64 `json:"kurt"` // kurtosis 峰度系数
 }
+
+// FormatSizeLatency 把按负载长度的延时格式化为文本，按负载长度升序，如 "32:1.20/3 | 1400:1.85/3"（平均延时 ms/应答数）
+func FormatSizeLatency(m map[int]LatencyStat) string {
+	sizes := make([]int, 0, len(m))
+	for size := range m {
+		sizes = append(sizes, size)
+	}
+	sort.Ints(sizes)
+	s := make([]string, 0, len(sizes))
+	for _, size := range sizes {
+		s = append(s, fmt.Sprintf("%d:%.2f/%d", size, m[size].Mean, int(m[size].Count)))
+	}
+	return strings.Join(s, " | ")
+}
@@ -6,6 +6,16 @@ type Message struct {
 	MsgType  string `json:"msg-type"`
 	Msg      string `json:"data"`
 	Datetime string `json:"datetime"`
+
+	Task *TaskParams `json:"task,omitempty"`
+}
+
+// PcapFile 探测节点随 "pcap" 消息上报的一次任务的抓包文件，Data 为 libpcap 格式的文件内容
+type PcapFile struct {
+	Name    string `json:"name"`
+	Session string `json:"session"`
+	File    string `json:"file"`
+	Data    []byte `json:"data,omitempty"`
 }
 
 func NewMessage(msgType string, msg string) *Message {
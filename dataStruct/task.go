@@ -0,0 +1,32 @@
+package dataStruct
+
+// TaskParams 控制节点随 "dst" 命令下发的单个任务参数，零值表示使用探测节点的默认配置
+type TaskParams struct {
+	Protocol string `json:"protocol"` // icmp / udp / tcp
+	Port     uint16 `json:"port"`     // tcp 探测的目的端口
+	// 目的地址族：4 只解析 A 记录，6 只解析 AAAA 记录，0 优先使用 IPv4
+	IPVersion uint8 `json:"ip-version"`
+	// 探测模式 simple / mda / mda-lite，为空时使用探测节点的默认模式
+	Mode string `json:"mode"`
+	// MDA 每个顶点的失败概率上界，为 0 时使用探测节点的默认值
+	Alpha float64 `json:"alpha"`
+	// 探测结束后是否对发现的接口做别名解析
+	Alias bool `json:"alias"`
+	// 用与目的地址同网段的其他地址探测，以识别按目的地址的负载均衡。这些地址不属于任务，默认不探测
+	LBDstTest bool `json:"lb-dst-test"`
+	// 连续多少跳全部超时后停止，为 0 时使用探测节点的默认值
+	GapLimit int `json:"gap-limit"`
+	// 按 Doubletree 从第 StartTTL 跳开始向两端探测，StartTTL 为 0 时使用探测节点的默认值
+	Doubletree bool  `json:"doubletree"`
+	StartTTL   uint8 `json:"start-ttl"`
+	// 全局停止集合：其他探测节点到同一目的地址的路径上已发现的接口，由控制节点填写
+	StopSet []string `json:"stop-set,omitempty"`
+	// 简单模式下依次用这些 DSCP 值（0-63）探测，比较各自的路径和延时并检测 TOS 改写
+	DSCP []int `json:"dscp,omitempty"`
+	// 探测的负载长度，为 0 时使用探测节点的默认值；简单模式下依次用 PayloadSweep 中的负载长度探测，
+	// 按负载长度分别统计各跳的延时
+	PayloadSize  int   `json:"payload-size"`
+	PayloadSweep []int `json:"payload-sweep,omitempty"`
+	// 记录任务收发的所有报文，结束后通过 "pcap" 消息上报给控制节点
+	Pcap bool `json:"pcap"`
+}
@@ -0,0 +1,110 @@
+package dataStruct
+
+// Diamond 负载均衡形成的菱形：从分叉点出发的所有路径在汇合点重新汇合
+type Diamond struct {
+	Divergence     string `json:"divergence"` // 分叉点
+	DivergenceTTL  uint8  `json:"divergence-ttl"`
+	Convergence    string `json:"convergence"` // 汇合点，为空表示直到最后一跳仍未汇合
+	ConvergenceTTL uint8  `json:"convergence-ttl"`
+	MinWidth       int    `json:"min-width"`  // 分叉点与汇合点之间各跳的最少接口数
+	MaxWidth       int    `json:"max-width"`  // 分叉点与汇合点之间各跳的最多接口数
+	MinLength      int    `json:"min-length"` // 分叉点到汇合点的最短路径跳数
+	MaxLength      int    `json:"max-length"` // 分叉点到汇合点的最长路径跳数
+	Asymmetric     bool   `json:"asymmetric"` // 各条路径长度不同
+	Meshed         bool   `json:"meshed"`     // 相邻两跳之间存在网状连接
+	// 分叉点与汇合点之间各跳的接口，按 TTL 升序
+	Hops [][]string `json:"hops"`
+}
+
+// MTUDrop 路径 MTU 变小的位置：TTL 为 MTU 变小的链路之后的一跳
+type MTUDrop struct {
+	TTL    uint8  `json:"ttl"`
+	Router string `json:"router"` // 返回需要分片的路由器，静默丢弃时为该跳的应答地址
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	// 没有收到需要分片的应答，大包被静默丢弃（黑洞），To 为能通过的最大平台值
+	Silent bool `json:"silent"`
+}
+
+// DSCPTrace 简单模式下用某个 DSCP 值探测得到的路径
+type DSCPTrace struct {
+	DSCP    int        `json:"dscp"`
+	Hops    [][]string `json:"hops"`    // 第 i 项为第 i+1 跳的应答地址，"*" 为超时
+	Latency []float64  `json:"latency"` // 各跳的平均延时(ms)，全部超时为 0
+	// 与第一个 DSCP 值的路径第一次不同的跳，路径相同时为 0
+	DivergeTTL uint8        `json:"diverge-ttl"`
+	Remarks    []DSCPRemark `json:"remarks,omitempty"`
+}
+
+// DSCPRemark 差错报文引用的 DSCP 与发送时（或上一次观察到）的值不同，改写发生在该跳或之前的路由器上
+type DSCPRemark struct {
+	TTL    uint8  `json:"ttl"`
+	Router string `json:"router"`
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+}
+
+// 一次探测结束的原因
+const (
+	TermReached     = "reached"     // 收到目的端的应答
+	TermGapLimit    = "gap-limit"   // 连续多跳全部超时
+	TermUnreachable = "unreachable" // 路径上的路由器返回目的不可达，且不属于下面几种
+	TermMaxTTL      = "max-ttl"     // 探测到最大 TTL 仍未到达目的端
+	TermStopSet     = "stop-set"    // 该跳的接口都在全局停止集合中，之后的路径已由其他探测节点探测过
+
+	TermNetUnreachable   = "net-unreachable"   // !N
+	TermHostUnreachable  = "host-unreachable"  // !H
+	TermProtoUnreachable = "proto-unreachable" // !P
+	TermAdminProhibited  = "admin-prohibited"  // !X，通常是防火墙或访问控制列表
+)
+
+// 目的不可达应答在逐跳记录中的标记，沿用 traceroute 的写法，其他 code 记为 "!<code>"
+const (
+	MarkNet         = "!N" // 网络不可达、目的网络未知、对该 TOS 网络不可达，IPv6 无路由
+	MarkHost        = "!H" // 主机不可达、目的主机未知、源主机被隔离、对该 TOS 主机不可达，IPv6 地址不可达
+	MarkProto       = "!P" // 协议不可达
+	MarkFrag        = "!F" // 需要分片但设置了 DF
+	MarkSourceRoute = "!S" // 源路由失败，IPv6 超出源地址范围
+	MarkAdmin       = "!X" // 网络、主机或通信被管理性禁止，IPv6 源地址策略失败、拒绝路由
+	MarkPrecedence  = "!V" // 主机优先级违规
+	MarkCutoff      = "!C" // 优先级截止
+)
+
+// UnreachableReason 目的不可达标记对应的探测结束原因
+func UnreachableReason(mark string) string {
+	switch mark {
+	case MarkNet:
+		return TermNetUnreachable
+	case MarkHost:
+		return TermHostUnreachable
+	case MarkProto:
+		return TermProtoUnreachable
+	case MarkAdmin:
+		return TermAdminProhibited
+	default:
+		return TermUnreachable
+	}
+}
+
+// TraceSummary 探测节点在一次任务结束时上报的整条路径的汇总信息
+type TraceSummary struct {
+	Domain   string    `json:"domain"`
+	DstIP    string    `json:"dst-ip"`
+	Name     string    `json:"name"`
+	Session  string    `json:"session"`
+	Mode     string    `json:"mode"`
+	Diamonds []Diamond `json:"diamonds"`
+	// 别名解析得到的属于同一路由器的接口集合，只包含两个以上接口的集合
+	Aliases [][]string `json:"aliases,omitempty"`
+	// 探测结束的原因及探测到的最后一跳，任务被取消时原因为空
+	Termination string `json:"termination,omitempty"`
+	LastTTL     uint8  `json:"last-ttl"`
+	StartTTL    uint8  `json:"start-ttl,omitempty"` // Doubletree 开始探测的中间跳
+	TimeStamp   int64  `json:"ts"`
+
+	// PMTU 模式发现的路径 MTU 及 MTU 变小的位置
+	PMTU     int       `json:"pmtu,omitempty"`
+	MTUDrops []MTUDrop `json:"mtu-drops,omitempty"`
+	// 简单模式下各 DSCP 值的路径，第一个值为比较的基准
+	DSCP []DSCPTrace `json:"dscp,omitempty"`
+}
@@ -0,0 +1,313 @@
+// Package atlas 在逐跳记录与 RIPE Atlas traceroute 结果的 JSON 格式之间转换，
+// 便于和 Atlas 的数据及处理 Atlas 数据的工具对比
+package atlas
+
+import (
+	"fmt"
+	cds "mda-traceroute-go/dataStruct"
+	"mda-traceroute-go/db/dao"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Atlas 结果格式的固件版本，字段含义以该版本为准
+const firmware = 5020
+
+// Result 一次 traceroute 的 Atlas 结果
+type Result struct {
+	AF        int    `json:"af"`
+	DstAddr   string `json:"dst_addr"`
+	DstName   string `json:"dst_name"`
+	From      string `json:"from"`
+	SrcAddr   string `json:"src_addr"`
+	Proto     string `json:"proto"` // ICMP / UDP / TCP
+	ParisID   int    `json:"paris_id"`
+	Size      int    `json:"size"`
+	Timestamp int64  `json:"timestamp"` // 开始时间，Unix 秒
+	Endtime   int64  `json:"endtime"`
+	Fw        int    `json:"fw"`
+	Lts       int    `json:"lts"`
+	MsmID     int    `json:"msm_id"`
+	MsmName   string `json:"msm_name"`
+	PrbID     int    `json:"prb_id"`
+	Type      string `json:"type"`
+	Hops      []Hop  `json:"result"`
+}
+
+// Hop 一跳的所有应答
+type Hop struct {
+	Hop     int     `json:"hop"`
+	Replies []Reply `json:"result"`
+}
+
+// Reply 一个探测的结果，超时时只有 X 为 "*"
+type Reply struct {
+	X    string   `json:"x,omitempty"`
+	From string   `json:"from,omitempty"`
+	RTT  *float64 `json:"rtt,omitempty"` // 单位 ms
+	TTL  int      `json:"ttl,omitempty"` // 应答报文的 IP TTL
+	// 差错报文引用的探测包 TTL，只在不为 1 时给出
+	ITTL int `json:"ittl,omitempty"`
+	// 目的不可达：N H A P p 或数字 code
+	Err     interface{} `json:"err,omitempty"`
+	ICMPExt *ICMPExt    `json:"icmpext,omitempty"`
+	// 解析 Atlas 数据时才会出现：超时后才到达的应答和重复的应答
+	Late int  `json:"late,omitempty"`
+	Dup  bool `json:"dup,omitempty"`
+}
+
+// ICMPExt ICMP 多部分扩展，只转换 MPLS 标签栈对象
+type ICMPExt struct {
+	Version int          `json:"version"`
+	RFC4884 int          `json:"rfc4884"`
+	Obj     []ICMPExtObj `json:"obj"`
+}
+
+type ICMPExtObj struct {
+	Class int         `json:"class"`
+	Type  int         `json:"type"`
+	MPLS  []MPLSEntry `json:"mpls,omitempty"`
+}
+
+type MPLSEntry struct {
+	Label uint32 `json:"label"`
+	Exp   uint8  `json:"exp"`
+	S     int    `json:"s"`
+	TTL   uint8  `json:"ttl"`
+}
+
+// Meta 逐跳记录中没有的整条路径的信息
+type Meta struct {
+	Protocol string    // icmp / udp / tcp，为空时为 icmp
+	SrcAddr  string    // 探测节点的源地址
+	Size     int       // 探测包的负载长度
+	Endtime  time.Time // 为零值时与开始时间相同
+}
+
+// hopRecord 一跳上一个应答地址的统计值，由 RouteInfo 或 dao.Topo 转换而来
+type hopRecord struct {
+	ttl         uint8
+	addr        string
+	recv        int
+	min         float64
+	max         float64
+	mean        float64
+	lost        int // 该跳超时的探测数，同一跳的各条记录相同
+	replyTTL    uint8
+	quotedTTL   uint8
+	unreachable string
+	mpls        []cds.MPLSLabel
+}
+
+// Encode 把一次探测的逐跳记录转换为 Atlas 结果
+func Encode(meta Meta, hops []cds.RouteInfo) *Result {
+	records := make([]hopRecord, 0, len(hops))
+	domain, dst, ts := "", "", int64(0)
+	for _, h := range hops {
+		domain, dst, ts = h.Domain, h.DstIP, h.TimeStamp
+		records = append(records, hopRecord{
+			ttl:         h.TTL,
+			addr:        h.ResAddr,
+			recv:        int(h.RecvCnt),
+			min:         h.LatencyStat.Min,
+			max:         h.LatencyStat.Max,
+			mean:        h.LatencyStat.Mean,
+			lost:        h.Lost,
+			replyTTL:    h.ReplyTTL,
+			quotedTTL:   h.QuotedTTL,
+			unreachable: h.Unreachable,
+			mpls:        h.MPLS,
+		})
+	}
+	return encode(meta, domain, dst, time.UnixMicro(ts), records)
+}
+
+// EncodeTopos 把入库的逐跳记录按探测节点和探测任务分组，每组转换为一个 Atlas 结果。
+// 库中只保存平均延时，各应答的 rtt 都取平均值；MPLS 标签栈从入库的文本还原为 icmpext
+func EncodeTopos(meta Meta, topos []dao.Topo) []*Result {
+	type key struct {
+		name, session string
+		ts            time.Time
+	}
+	type group struct {
+		domain, dst string
+		records     []hopRecord
+	}
+	groups := make(map[key]*group)
+	var keys []key
+	for _, t := range topos {
+		k := key{t.Name, t.Session, t.TracertTime}
+		g, ok := groups[k]
+		if !ok {
+			g = &group{domain: t.Domain, dst: t.DstIP}
+			groups[k] = g
+			keys = append(keys, k)
+		}
+		g.records = append(g.records, hopRecord{
+			ttl:         t.TTL,
+			addr:        t.ResAddr,
+			recv:        int(t.RecvCnt),
+			min:         t.MeanLatency,
+			max:         t.MeanLatency,
+			mean:        t.MeanLatency,
+			lost:        t.Lost,
+			replyTTL:    t.ReplyTTL,
+			quotedTTL:   t.QuotedTTL,
+			unreachable: t.Unreachable,
+			mpls:        parseMPLS(t.MPLS),
+		})
+	}
+	res := make([]*Result, 0, len(keys))
+	for _, k := range keys {
+		g := groups[k]
+		res = append(res, encode(meta, g.domain, g.dst, k.ts, g.records))
+	}
+	return res
+}
+
+func encode(meta Meta, domain, dst string, start time.Time, records []hopRecord) *Result {
+	proto := strings.ToUpper(meta.Protocol)
+	if proto == "" {
+		proto = "ICMP"
+	}
+	end := meta.Endtime
+	if end.IsZero() {
+		end = start
+	}
+	af := 4
+	if ip := net.ParseIP(dst); ip != nil && ip.To4() == nil {
+		af = 6
+	}
+	r := &Result{
+		AF:        af,
+		DstAddr:   dst,
+		DstName:   domain,
+		From:      meta.SrcAddr,
+		SrcAddr:   meta.SrcAddr,
+		Proto:     proto,
+		Size:      meta.Size,
+		Timestamp: start.Unix(),
+		Endtime:   end.Unix(),
+		Fw:        firmware,
+		Lts:       -1,
+		MsmName:   "Traceroute",
+		Type:      "traceroute",
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].ttl < records[j].ttl })
+	for i := 0; i < len(records); {
+		ttl := records[i].ttl
+		hop := Hop{Hop: int(ttl)}
+		lost := 0
+		for ; i < len(records) && records[i].ttl == ttl; i++ {
+			rec := records[i]
+			lost = rec.lost
+			if rec.addr == cds.StarAddr {
+				continue
+			}
+			hop.Replies = append(hop.Replies, rec.replies()...)
+		}
+		// 没有发送数的旧记录至少给出一个超时
+		if lost == 0 && len(hop.Replies) == 0 {
+			lost = 1
+		}
+		for j := 0; j < lost; j++ {
+			hop.Replies = append(hop.Replies, Reply{X: "*"})
+		}
+		r.Hops = append(r.Hops, hop)
+	}
+	return r
+}
+
+// replies Atlas 需要逐个应答，而引擎只保留统计值：第一个应答取最小值，第二个取最大值，
+// 其余取平均值，使应答数、最小值和最大值与统计值一致
+func (rec hopRecord) replies() []Reply {
+	n := rec.recv
+	if n <= 0 {
+		n = 1
+	}
+	res := make([]Reply, 0, n)
+	for i := 0; i < n; i++ {
+		rtt := rec.mean
+		switch {
+		case i == 0 && n > 1:
+			rtt = rec.min
+		case i == 1:
+			rtt = rec.max
+		}
+		rtt = float64(int64(rtt*1000+0.5)) / 1000
+		r := Reply{From: rec.addr, RTT: &rtt, TTL: int(rec.replyTTL)}
+		if rec.quotedTTL > 1 {
+			r.ITTL = int(rec.quotedTTL)
+		}
+		if rec.unreachable != "" {
+			r.Err = markToErr(rec.unreachable)
+		}
+		if len(rec.mpls) > 0 {
+			r.ICMPExt = mplsExt(rec.mpls)
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// parseMPLS 解析 dataStruct.FormatMPLS 格式化的标签栈，无法解析的标签忽略
+func parseMPLS(s string) []cds.MPLSLabel {
+	if s == "" {
+		return nil
+	}
+	var labels []cds.MPLSLabel
+	for _, f := range strings.Split(s, " | ") {
+		var l cds.MPLSLabel
+		var bos int
+		if _, err := fmt.Sscanf(f, "%d(tc=%d,s=%d,ttl=%d)", &l.Label, &l.TC, &bos, &l.TTL); err != nil {
+			continue
+		}
+		l.S = bos == 1
+		labels = append(labels, l)
+	}
+	return labels
+}
+
+func mplsExt(labels []cds.MPLSLabel) *ICMPExt {
+	obj := ICMPExtObj{Class: 1, Type: 1}
+	for _, l := range labels {
+		s := 0
+		if l.S {
+			s = 1
+		}
+		obj.MPLS = append(obj.MPLS, MPLSEntry{Label: l.Label, Exp: l.TC, S: s, TTL: l.TTL})
+	}
+	return &ICMPExt{Version: 2, RFC4884: 1, Obj: []ICMPExtObj{obj}}
+}
+
+// Atlas 的 err 字段与目的不可达标记的对应关系，其他 code 在 Atlas 中记为数字
+var markErrs = map[string]string{
+	cds.MarkNet:   "N",
+	cds.MarkHost:  "H",
+	cds.MarkAdmin: "A",
+	cds.MarkProto: "P",
+}
+
+var markCodes = map[string]int{
+	cds.MarkFrag:        4,
+	cds.MarkSourceRoute: 5,
+	cds.MarkPrecedence:  14,
+	cds.MarkCutoff:      15,
+}
+
+func markToErr(mark string) interface{} {
+	if e, ok := markErrs[mark]; ok {
+		return e
+	}
+	if c, ok := markCodes[mark]; ok {
+		return c
+	}
+	var c int
+	if _, err := fmt.Sscanf(mark, "!%d", &c); err == nil {
+		return c
+	}
+	return mark
+}
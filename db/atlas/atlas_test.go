@@ -0,0 +1,195 @@
+package atlas
+
+import (
+	"bytes"
+	"encoding/json"
+	cds "mda-traceroute-go/dataStruct"
+	"mda-traceroute-go/db/dao"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// topoView 比较时关心的逐跳记录字段
+type topoView struct {
+	ttl         uint8
+	addr        string
+	recv        uint64
+	mean        float64
+	replyTTL    uint8
+	quotedTTL   uint8
+	unreachable string
+	mpls        string
+	sent, lost  int
+}
+
+func view(topos []*dao.Topo) []topoView {
+	res := make([]topoView, 0, len(topos))
+	for _, t := range topos {
+		res = append(res, topoView{t.TTL, t.ResAddr, t.RecvCnt, t.MeanLatency, t.ReplyTTL, t.QuotedTTL,
+			t.Unreachable, t.MPLS, t.Sent, t.Lost})
+	}
+	return res
+}
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	labels := []cds.MPLSLabel{{Label: 24001, TC: 0, S: false, TTL: 1}, {Label: 16, TC: 5, S: true, TTL: 1}}
+	hop := func(ttl uint8, addr string, recv uint64, min, max, mean float64, lost int) cds.RouteInfo {
+		return cds.RouteInfo{
+			Domain: "example.com", DstIP: "10.0.9.1", TTL: ttl, ResAddr: addr, RecvCnt: recv,
+			LatencyStat: cds.LatencyStat{Min: min, Max: max, Mean: mean},
+			Lost:        lost, ReplyTTL: 255 - ttl, QuotedTTL: 1, TimeStamp: ts.UnixMicro(),
+		}
+	}
+	h1a := hop(1, "10.0.1.1", 3, 1, 3, 2, 1)
+	h1a.MPLS = labels
+	h1b := hop(1, "10.0.1.2", 1, 4, 4, 4, 1)
+	h2 := hop(2, cds.StarAddr, 0, 0, 0, 0, 2)
+	h3 := hop(3, "10.0.3.1", 2, 5, 7, 6, 0)
+	h3.QuotedTTL, h3.Unreachable = 2, cds.MarkAdmin
+	h4 := hop(4, "10.0.9.1", 1, 8, 8, 8, 0)
+	h4.QuotedTTL = 0
+
+	r := Encode(Meta{Protocol: "udp", SrcAddr: "10.0.0.1", Size: 32}, []cds.RouteInfo{h4, h3, h2, h1a, h1b})
+	if r.Proto != "UDP" || r.AF != 4 || r.DstName != "example.com" || r.Timestamp != ts.Unix() || len(r.Hops) != 4 {
+		t.Fatalf("encoded %+v", r)
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := Decode(bytes.NewReader(buf))
+	if err != nil || len(results) != 1 {
+		t.Fatalf("decode: %v, %d results", err, len(results))
+	}
+	topos := results[0].Topos()
+	want := []topoView{
+		{1, "10.0.1.1", 3, 2, 254, 1, "", cds.FormatMPLS(labels), 5, 1},
+		{1, "10.0.1.2", 1, 4, 254, 1, "", "", 5, 1},
+		{2, cds.StarAddr, 0, 0, 0, 0, "", "", 2, 2},
+		{3, "10.0.3.1", 2, 6, 252, 2, cds.MarkAdmin, "", 2, 0},
+		{4, "10.0.9.1", 1, 8, 251, 0, "", "", 1, 0},
+	}
+	if got := view(topos); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded topos\n got %+v\nwant %+v", got, want)
+	}
+	for _, tp := range topos {
+		if !tp.TracertTime.Equal(ts) || tp.Received != tp.Sent-tp.Lost {
+			t.Errorf("ttl %d %s: time %v, sent %d received %d lost %d",
+				tp.TTL, tp.ResAddr, tp.TracertTime, tp.Sent, tp.Received, tp.Lost)
+		}
+	}
+
+	// 入库的记录再导出，应答数和 MPLS 标签栈不变
+	rows := make([]dao.Topo, 0, len(topos))
+	for _, tp := range topos {
+		rows = append(rows, *tp)
+	}
+	again := EncodeTopos(Meta{Protocol: "udp"}, rows)
+	if len(again) != 1 || len(again[0].Hops) != len(r.Hops) {
+		t.Fatalf("re-encoded %+v", again)
+	}
+	for i, h := range again[0].Hops {
+		if len(h.Replies) != len(r.Hops[i].Replies) {
+			t.Errorf("hop %d: %d replies, want %d", h.Hop, len(h.Replies), len(r.Hops[i].Replies))
+		}
+	}
+	if ext := again[0].Hops[0].Replies[0].ICMPExt; ext == nil || !reflect.DeepEqual(ext, r.Hops[0].Replies[0].ICMPExt) {
+		t.Errorf("mpls ext %+v, want %+v", ext, r.Hops[0].Replies[0].ICMPExt)
+	}
+}
+
+func TestDecodeShapes(t *testing.T) {
+	one := `{"dst_addr":"10.0.9.1","prb_id":1,"result":[{"hop":1,"result":[{"from":"10.0.1.1","rtt":1.5,"ttl":254}]}]}`
+	two := strings.Replace(one, `"prb_id":1`, `"prb_id":2`, 1)
+	for _, tc := range []struct {
+		name  string
+		input string
+		prbs  []int
+	}{
+		{"array", "[" + one + "," + two + "]", []int{1, 2}},
+		{"single object", one, []int{1}},
+		{"ndjson", one + "\n" + two + "\n", []int{1, 2}},
+		{"leading whitespace", "\n\t [" + one + "]", []int{1}},
+	} {
+		results, err := Decode(strings.NewReader(tc.input))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var prbs []int
+		for _, r := range results {
+			prbs = append(prbs, r.PrbID)
+			if len(r.Hops) != 1 || r.Hops[0].Replies[0].From != "10.0.1.1" {
+				t.Errorf("%s: hops %+v", tc.name, r.Hops)
+			}
+		}
+		if !reflect.DeepEqual(prbs, tc.prbs) {
+			t.Errorf("%s: probes %v, want %v", tc.name, prbs, tc.prbs)
+		}
+	}
+
+	for _, input := range []string{"", "  \n", "[" + one, one + "\n{"} {
+		if _, err := Decode(strings.NewReader(input)); err == nil {
+			t.Errorf("%q decoded without error", input)
+		}
+	}
+}
+
+func TestErrToMark(t *testing.T) {
+	for _, tc := range []struct {
+		err  interface{}
+		mark string
+	}{
+		{"N", cds.MarkNet},
+		{"H", cds.MarkHost},
+		{"A", cds.MarkAdmin},
+		{"P", cds.MarkProto},
+		{"p", ""},
+		{"", ""},
+		{"Z", "!Z"},
+		{float64(4), cds.MarkFrag},
+		{float64(5), cds.MarkSourceRoute},
+		{float64(14), cds.MarkPrecedence},
+		{float64(15), cds.MarkCutoff},
+		{float64(11), "!11"},
+		{nil, ""},
+		{true, ""},
+	} {
+		if got := errToMark(tc.err); got != tc.mark {
+			t.Errorf("errToMark(%#v) = %q, want %q", tc.err, got, tc.mark)
+		}
+	}
+
+	// 编码后经过 JSON 数字仍能还原
+	for _, mark := range []string{cds.MarkNet, cds.MarkHost, cds.MarkAdmin, cds.MarkProto, cds.MarkFrag,
+		cds.MarkSourceRoute, cds.MarkPrecedence, cds.MarkCutoff, "!11"} {
+		var rep Reply
+		buf, _ := json.Marshal(Reply{Err: markToErr(mark)})
+		if err := json.Unmarshal(buf, &rep); err != nil {
+			t.Fatal(err)
+		}
+		if got := errToMark(rep.Err); got != mark {
+			t.Errorf("%s encoded as %s decodes to %q", mark, buf, got)
+		}
+	}
+}
+
+func TestLateAndDupReplies(t *testing.T) {
+	input := `{"dst_addr":"10.0.9.1","result":[{"hop":1,"result":[
+		{"from":"10.0.1.1","rtt":1.0,"ttl":254},
+		{"from":"10.0.1.1","rtt":90.0,"ttl":254,"late":2},
+		{"from":"10.0.1.1","rtt":50.0,"ttl":254,"dup":true},
+		{"from":"10.0.1.3","rtt":70.0,"ttl":254,"late":1},
+		{"x":"*"}]}]}`
+	results, err := Decode(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []topoView{{1, "10.0.1.1", 1, 1, 254, 1, "", "", 2, 1}}
+	if got := view(results[0].Topos()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
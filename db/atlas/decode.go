@@ -0,0 +1,215 @@
+package atlas
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	cds "mda-traceroute-go/dataStruct"
+	"mda-traceroute-go/db/dao"
+	"strconv"
+	"time"
+)
+
+// Decode 解析 Atlas 结果文件，支持 JSON 数组、单个结果以及每行一个结果的格式
+func Decode(r io.Reader) ([]*Result, error) {
+	br := bufio.NewReader(r)
+	first, err := firstByte(br)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(br)
+	if first == '[' {
+		var res []*Result
+		if err := dec.Decode(&res); err != nil {
+			return nil, fmt.Errorf("decode atlas results error: %v", err)
+		}
+		return res, nil
+	}
+	var res []*Result
+	for {
+		var v Result
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode atlas result %d error: %v", len(res)+1, err)
+		}
+		res = append(res, &v)
+	}
+}
+
+// firstByte 跳过空白后的第一个字节，不从 br 中取出
+func firstByte(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("empty atlas results: %v", err)
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
+
+// Topos 把 Atlas 结果转换为逐跳记录，同一跳同一地址的应答合并为一条，超时和重复的应答不计入延时
+func (r *Result) Topos() []*dao.Topo {
+	domain := r.DstName
+	if domain == "" {
+		domain = r.DstAddr
+	}
+	name := fmt.Sprintf("atlas-%d", r.PrbID)
+	session := fmt.Sprintf("atlas-%d-%d", r.MsmID, r.PrbID)
+	ts := time.Unix(r.Timestamp, 0)
+
+	var topos []*dao.Topo
+	for _, h := range r.Hops {
+		if h.Hop <= 0 || h.Hop > 255 {
+			continue
+		}
+		sent, lost := 0, 0
+		var hop []*dao.Topo
+		byAddr := make(map[string]*dao.Topo)
+		sums := make(map[string]float64)
+		for _, rep := range h.Replies {
+			if rep.Late != 0 || rep.Dup {
+				continue
+			}
+			sent++
+			if rep.X == "*" || rep.From == "" {
+				lost++
+				continue
+			}
+			t, ok := byAddr[rep.From]
+			if !ok {
+				t = &dao.Topo{
+					Domain:      domain,
+					TTL:         uint8(h.Hop),
+					DstIP:       r.DstAddr,
+					ResAddr:     rep.From,
+					Name:        name,
+					Session:     session,
+					Country:     "-",
+					Region:      "-",
+					City:        "-",
+					ISP:         "-",
+					TracertTime: ts,
+				}
+				byAddr[rep.From] = t
+				hop = append(hop, t)
+			}
+			// 与引擎一样取最近一次应答的 TTL 和扩展信息
+			t.ReplyTTL, t.QuotedTTL = uint8(rep.TTL), quotedTTL(rep, r.DstAddr)
+			if mark := errToMark(rep.Err); mark != "" {
+				t.Unreachable = mark
+			}
+			if labels := rep.mpls(); len(labels) > 0 {
+				t.MPLS = cds.FormatMPLS(labels)
+			}
+			if rep.RTT != nil {
+				t.RecvCnt++
+				sums[rep.From] += *rep.RTT
+			}
+		}
+		if len(hop) == 0 {
+			hop = append(hop, &dao.Topo{
+				Domain:      domain,
+				TTL:         uint8(h.Hop),
+				DstIP:       r.DstAddr,
+				ResAddr:     cds.StarAddr,
+				Name:        name,
+				Session:     session,
+				Country:     "-",
+				Region:      "-",
+				City:        "-",
+				ISP:         "-",
+				TracertTime: ts,
+			})
+		}
+		for _, t := range hop {
+			if t.RecvCnt > 0 {
+				mean := sums[t.ResAddr] / float64(t.RecvCnt)
+				t.MeanLatency, _ = strconv.ParseFloat(fmt.Sprintf("%.2f", mean), 64)
+			}
+			t.Sent, t.Lost, t.Received = sent, lost, sent-lost
+			if sent > 0 {
+				t.LossRatio = float64(lost) / float64(sent)
+			}
+		}
+		topos = append(topos, hop...)
+	}
+	return topos
+}
+
+// quotedTTL Atlas 只在引用的 TTL 不为 1 时给出 ittl，目的端的直接应答没有引用
+func quotedTTL(rep Reply, dst string) uint8 {
+	if rep.ITTL > 0 {
+		return uint8(rep.ITTL)
+	}
+	if rep.From == dst {
+		return 0
+	}
+	return 1
+}
+
+func (rep Reply) mpls() []cds.MPLSLabel {
+	if rep.ICMPExt == nil {
+		return nil
+	}
+	var labels []cds.MPLSLabel
+	for _, o := range rep.ICMPExt.Obj {
+		if o.Class != 1 || o.Type != 1 {
+			continue
+		}
+		for _, m := range o.MPLS {
+			labels = append(labels, cds.MPLSLabel{Label: m.Label, TC: m.Exp, S: m.S == 1, TTL: m.TTL})
+		}
+	}
+	return labels
+}
+
+// errToMark Atlas 的 err 字段转换为目的不可达标记，端口不可达说明已到达目的端，不做标记
+func errToMark(e interface{}) string {
+	switch v := e.(type) {
+	case string:
+		if v == "p" || v == "" {
+			return ""
+		}
+		for mark, s := range markErrs {
+			if s == v {
+				return mark
+			}
+		}
+		return "!" + v
+	case float64:
+		for mark, c := range markCodes {
+			if c == int(v) {
+				return mark
+			}
+		}
+		return fmt.Sprintf("!%d", int(v))
+	}
+	return ""
+}
+
+// Import 解析 Atlas 结果文件并在一个事务中把逐跳记录入库，返回入库的记录数，失败时不入库任何记录
+func Import(r io.Reader) (int, error) {
+	if dao.GlobalTopoData.Server == nil {
+		return 0, fmt.Errorf("database is not initialized")
+	}
+	results, err := Decode(r)
+	if err != nil {
+		return 0, err
+	}
+	var topos []*dao.Topo
+	for _, res := range results {
+		topos = append(topos, res.Topos()...)
+	}
+	if err := dao.GlobalTopoData.InsertTopos(topos); err != nil {
+		return 0, err
+	}
+	return len(topos), nil
+}
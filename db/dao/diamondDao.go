@@ -0,0 +1,63 @@
+package dao
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"sync"
+)
+
+type DiamondData struct {
+	Server *gorm.DB
+
+	sync.RWMutex
+}
+
+var (
+	GlobalDiamondData = DiamondData{}
+)
+
+// GetDiamondByDomain 按探测时间升序返回某目的地址的历史菱形，用于追踪 ECMP 的变化
+func (dd *DiamondData) GetDiamondByDomain(domain string) ([]Diamond, error) {
+	var ret []Diamond
+	conn, _ := GetConn()
+	if conn == nil {
+		return ret, fmt.Errorf("can not connect tracert")
+	}
+	dt := conn.Table(DiamondDB.TableName()).
+		Where("diamond.domain in (?)", domain).
+		Order("diamond.tracert_time").
+		Scan(&ret)
+
+	if dt.Error != nil {
+		logrus.Errorf("Error! GetDiamondByDomain failed. [%v]", dt.Error)
+	}
+	return ret, dt.Error
+}
+
+func (dd *DiamondData) InsertDiamond(d *Diamond) (int, error) {
+	conn, _ := GetConn()
+	if conn == nil {
+		return -1, fmt.Errorf("can not connect tracert")
+	}
+
+	// 开启事务
+	tx := conn.Begin()
+	dt := tx.Create(d)
+	if dt.Error != nil {
+		logrus.Errorf("Error! Insert into Diamond failed. [%v]", dt.Error)
+	}
+	// 获取刚插入记录的id
+	var id []int
+	tx.Raw("select LAST_INSERT_ID() as id").Pluck("id", &id)
+
+	if dt.Error != nil {
+		tx.Rollback()
+	} else {
+		tx.Commit()
+	}
+	if len(id) == 0 {
+		return -1, dt.Error
+	}
+	return id[0], dt.Error
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"sync"
 	"time"
 
 	// gorm 要求导入的驱动
@@ -21,6 +23,27 @@ import (
 		`session` varchar(128),
 		`mean_latency` double,
 		`recv_cnt` int(11),
+		`confidence` double,
+		`fallback` varchar(32),
+		`load_balance` varchar(32),
+		`lb_probes` int(11),
+		`lb_next_hops` int(11),
+		`mpls` varchar(512),
+		`interface_info` varchar(512),
+		`reply_ttl` int(11),
+		`quoted_ttl` int(11),
+		`return_len` int(11),
+		`asymmetry` int(11),
+		`invisible_mpls` tinyint(1),
+		`unreachable` varchar(8),
+		`sent` int(11),
+		`received` int(11),
+		`lost` int(11),
+		`loss_ratio` double,
+		`rate_limited` tinyint(1),
+		`pmtu` int(11),
+		`size_latency` varchar(512),
+		`size_slope` double,
         `tracert_time` datetime,
 		`insert_time` datetime DEFAULT CURRENT_TIMESTAMP,
 		PRIMARY KEY (`id`)
@@ -37,6 +60,27 @@ type Topo struct {
 	Session     string    `json:"session" gorm:"column:session"`
 	MeanLatency float64   `json:"mean_latency" gorm:"column:mean_latency"`
 	RecvCnt     uint64    `json:"recv_cnt" gorm:"column:recv_cnt"`
+	Confidence  float64   `json:"confidence" gorm:"column:confidence"`
+	Fallback    string    `json:"fallback" gorm:"column:fallback"`
+	LoadBalance string    `json:"load_balance" gorm:"column:load_balance"`
+	LBProbes    int       `json:"lb_probes" gorm:"column:lb_probes"`
+	LBNextHops  int       `json:"lb_next_hops" gorm:"column:lb_next_hops"`
+	MPLS        string    `json:"mpls" gorm:"column:mpls"`                     // MPLS 标签栈，格式见 dataStruct.FormatMPLS
+	IfInfo      string    `json:"interface_info" gorm:"column:interface_info"` // RFC 5837 接口信息，格式见 dataStruct.FormatInterfaces
+	ReplyTTL    uint8     `json:"reply_ttl" gorm:"column:reply_ttl"`
+	QuotedTTL   uint8     `json:"quoted_ttl" gorm:"column:quoted_ttl"`
+	ReturnLen   int       `json:"return_len" gorm:"column:return_len"` // 推算的返回路径跳数
+	Asymmetry   int       `json:"asymmetry" gorm:"column:asymmetry"`   // 返回路径跳数减去前向跳数
+	InvisMPLS   bool      `json:"invisible_mpls" gorm:"column:invisible_mpls"`
+	Unreachable string    `json:"unreachable" gorm:"column:unreachable"` // 目的不可达标记，如 !N !H !P !X
+	Sent        int       `json:"sent" gorm:"column:sent"`               // 该跳发送、收到应答和丢失的探测数
+	Received    int       `json:"received" gorm:"column:received"`
+	Lost        int       `json:"lost" gorm:"column:lost"`
+	LossRatio   float64   `json:"loss_ratio" gorm:"column:loss_ratio"`
+	RateLimited bool      `json:"rate_limited" gorm:"column:rate_limited"` // 该跳对 ICMP 差错报文限速
+	PMTU        int       `json:"pmtu" gorm:"column:pmtu"`                 // PMTU 模式下能到达该跳的最大探测大小
+	SizeLat     string    `json:"size_latency" gorm:"column:size_latency"` // 按负载长度的平均延时，格式见 dataStruct.FormatSizeLatency
+	SizeSlope   float64   `json:"size_slope" gorm:"column:size_slope"`     // 平均延时对负载长度的斜率(ms/字节)
 	Country     string    `json:"country" gorm:"column:country"`
 	Region      string    `json:"region" gorm:"column:region"`
 	City        string    `json:"city" gorm:"column:city"`
@@ -61,21 +105,111 @@ CREATE TABLE `tracert_record` (
 type TracertRecord struct {
 	Id          int       `json:"id" gorm:"column:id"`
 	Dst         string    `json:"dst" gorm:"column:dst"`
-	Group       string    `json:"group" gorm:"column:group""`
+	Group       string    `json:"group" gorm:"column:group"`
 	NodeNum     int32     `json:"node-num" gorm:"column:node_num"`
 	TracertTime time.Time `json:"tracert-time" gorm:"column:tracert_time;type:datetime"`
 }
 
+/*
+CREATE TABLE `diamond` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `domain` varchar(255) DEFAULT NULL,
+  `dst_ip` varchar(128),
+  `name` varchar(128),
+  `session` varchar(128),
+  `divergence` varchar(128),
+  `divergence_ttl` int,
+  `convergence` varchar(128),
+  `convergence_ttl` int,
+  `min_width` int,
+  `max_width` int,
+  `min_length` int,
+  `max_length` int,
+  `asymmetric` tinyint(1),
+  `meshed` tinyint(1),
+  `hops` text,
+  `tracert_time` datetime,
+  `insert_time` datetime DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_domain` (`domain`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4
+*/
+
+type Diamond struct {
+	Id             int       `json:"id" gorm:"column:id"`
+	Domain         string    `json:"domain" gorm:"column:domain"`
+	DstIP          string    `json:"dst_ip" gorm:"column:dst_ip"`
+	Name           string    `json:"name" gorm:"column:name"`
+	Session        string    `json:"session" gorm:"column:session"`
+	Divergence     string    `json:"divergence" gorm:"column:divergence"`
+	DivergenceTTL  uint8     `json:"divergence_ttl" gorm:"column:divergence_ttl"`
+	Convergence    string    `json:"convergence" gorm:"column:convergence"`
+	ConvergenceTTL uint8     `json:"convergence_ttl" gorm:"column:convergence_ttl"`
+	MinWidth       int       `json:"min_width" gorm:"column:min_width"`
+	MaxWidth       int       `json:"max_width" gorm:"column:max_width"`
+	MinLength      int       `json:"min_length" gorm:"column:min_length"`
+	MaxLength      int       `json:"max_length" gorm:"column:max_length"`
+	Asymmetric     bool      `json:"asymmetric" gorm:"column:asymmetric"`
+	Meshed         bool      `json:"meshed" gorm:"column:meshed"`
+	Hops           string    `json:"hops" gorm:"column:hops"` // 菱形内部各跳接口的 JSON
+	TracertTime    time.Time `json:"tracert_time" gorm:"column:tracert_time;type:datetime"`
+	InsertTime     time.Time `json:"insert_time" gorm:"autoCreateTime;column:insert_time;type:datetime"`
+}
+
 var TopoDB = Topo{}
 
 var TracertRecordDB = TracertRecord{}
 
-// GetConn 获取数据库连接
+var DiamondDB = Diamond{}
+
+var (
+	// DataSourceName 数据库连接串，由 InitDB 根据配置文件设置，为空时不使用数据库
+	DataSourceName = ""
+
+	globalConn *gorm.DB
+	connLock   sync.Mutex
+)
+
+// InitDB 设置数据库连接串并建立全局共享的数据库连接，未配置连接串时不使用数据库
+func InitDB(dsn string) error {
+	DataSourceName = dsn
+	if dsn == "" {
+		logrus.Warnf("DB disabled: no dsn configured, results are not stored.")
+		return nil
+	}
+	portal, err := gorm.Open("mysql", DataSourceName)
+	if err != nil {
+		return fmt.Errorf("connect to tracert db: %s", err.Error())
+	}
+	portal.SingularTable(true)
+
+	connLock.Lock()
+	globalConn = portal
+	GlobalTopoData.Server = portal
+	GlobalTracertRecordData.Server = portal
+	GlobalDiamondData.Server = portal
+	connLock.Unlock()
+	logrus.Infof("tracert db init complete.")
+	return nil
+}
+
+// GetConn 获取数据库连接，InitDB 成功后复用全局连接
 func GetConn() (*gorm.DB, error) {
+	connLock.Lock()
+	conn := globalConn
+	connLock.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	if DataSourceName == "" {
+		return nil, fmt.Errorf("DB disabled")
+	}
 	var p *sql.DB
-	portal, err := gorm.Open("mysql", "root:rootymzh2022@tcp(127.0.0.1:3306)/tracert?charset=utf8&parseTime=True&loc=Local")
+	portal, err := gorm.Open("mysql", DataSourceName)
 	if err != nil {
-		fmt.Errorf("connect to tracert db: %s", err.Error())
+		logrus.Errorf("connect to tracert db: %s", err.Error())
+		return nil, err
 	}
 	portal.Dialect().SetDB(p)
 	portal.SingularTable(true)
@@ -89,3 +223,7 @@ func (t *Topo) TableName() string {
 func (t *TracertRecord) TableName() string {
 	return "tracert_record"
 }
+
+func (d *Diamond) TableName() string {
+	return "diamond"
+}
@@ -41,18 +41,21 @@ func (trd *TracertRecordData) InsertTracertRecord(tr *TracertRecord) (int, error
 
 	// 开启事务
 	tx := conn.Begin()
-	dt := conn.Create(tr)
+	dt := tx.Create(tr)
 	if dt.Error != nil {
 		logrus.Errorf("Error! Insert into TracertRecord failed. [%v]", dt.Error)
 	}
 	// 获取刚插入记录的id
 	var id []int
-	conn.Raw("select LAST_INSERT_ID() as id").Pluck("id", &id)
+	tx.Raw("select LAST_INSERT_ID() as id").Pluck("id", &id)
 
 	if dt.Error != nil {
 		tx.Rollback()
-	} else {
-		tx.Commit()
+		return -1, dt.Error
 	}
-	return id[0], dt.Error
+	tx.Commit()
+	if len(id) == 0 {
+		return -1, fmt.Errorf("can not get id of inserted tracert record")
+	}
+	return id[0], nil
 }
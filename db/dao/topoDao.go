@@ -25,7 +25,9 @@ func (td *TopoData) GetTopoByDomain(domain string) ([]Topo, error) {
 	}
 	dt := conn.Table(TopoDB.TableName()).
 		Select("topo.id, topo.domain, topo.ttl, topo.dst_ip, topo.res_addr, "+
-			"topo.name, topo.session, topo.mean_latency, topo.recv_cnt, "+
+			"topo.name, topo.session, topo.mean_latency, topo.recv_cnt, topo.confidence, topo.mpls, topo.interface_info, "+
+			"topo.reply_ttl, topo.quoted_ttl, topo.unreachable, topo.sent, topo.received, topo.lost, topo.loss_ratio, "+
+			"topo.rate_limited, "+
 			"topo.tracert_time, topo.insert_time").
 		Where("topo.domain in (?)", domain).
 		Scan(&ret)
@@ -60,18 +62,39 @@ func (td *TopoData) InsertTopo(topo *Topo) (int, error) {
 
 	// 开启事务
 	tx := conn.Begin()
-	dt := conn.Create(topo)
+	dt := tx.Create(topo)
 	if dt.Error != nil {
 		logrus.Errorf("Error! Insert into Topo failed. [%v]", dt.Error)
 	}
 	// 获取刚插入记录的id
 	var id []int
-	conn.Raw("select LAST_INSERT_ID() as id").Pluck("id", &id)
+	tx.Raw("select LAST_INSERT_ID() as id").Pluck("id", &id)
 
 	if dt.Error != nil {
 		tx.Rollback()
-	} else {
-		tx.Commit()
+		return -1, dt.Error
 	}
-	return id[0], dt.Error
+	tx.Commit()
+	if len(id) == 0 {
+		return -1, fmt.Errorf("can not get id of inserted topo")
+	}
+	return id[0], nil
+}
+
+// InsertTopos 在一个事务中插入多条逐跳记录，任意一条失败时全部回滚
+func (td *TopoData) InsertTopos(topos []*Topo) error {
+	conn, _ := GetConn()
+	if conn == nil {
+		return fmt.Errorf("can not connect tracert")
+	}
+
+	tx := conn.Begin()
+	for _, t := range topos {
+		if err := tx.Create(t).Error; err != nil {
+			logrus.Errorf("Error! Insert into Topo failed. [%v]", err)
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
 }
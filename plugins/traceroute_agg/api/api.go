@@ -4,26 +4,33 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
+	"mda-traceroute-go/dataStruct"
+	"mda-traceroute-go/db/atlas"
 	"mda-traceroute-go/db/dao"
 	"mda-traceroute-go/plugins/traceroute_agg"
 	v1 "mda-traceroute-go/plugins/traceroute_agg/api/v1"
+	"mda-traceroute-go/plugins/traceroute_agg/utils"
 	"mda-traceroute-go/plugins/traceroute_agg/ws"
 	"mda-traceroute-go/util"
+	"net/http"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
-func Start() {
+// Start 启动 websocket 管理器和 HTTP 路由，listen 为监听地址，staticDir 为前端静态文件目录
+func Start(listen string, staticDir string) error {
 	// 初始化服务端 websocket 连接池
 	initWsManager()
 
 	router := gin.Default()
 
 	apiGroup(router)
-	staticGroup(router)
+	staticGroup(router, staticDir)
 	wsGroup(router)
 
-	router.Run("0.0.0.0:" + "20118")
+	logrus.Infof("traceroute agg listen on %s", listen)
+	return router.Run(listen)
 }
 
 func initWsManager() {
@@ -37,14 +44,18 @@ func apiGroup(router *gin.Engine) {
 	apiGroup := router.Group("/api")
 	apiGroup.POST("/tracert", recvDst)
 	apiGroup.GET("/nodes", getNodes)
+	apiGroup.GET("/diamonds", getDiamonds)
+	apiGroup.GET("/pcap", getPcap)
+	apiGroup.GET("/atlas", exportAtlas)
+	apiGroup.POST("/atlas", importAtlas)
 }
 
-func staticGroup(router *gin.Engine) {
+func staticGroup(router *gin.Engine, staticDir string) {
 	//router.LoadHTMLFiles("./static/view/tracert.html")
-	router.Static("/static", "./static")
-	router.Static("/js", "./static/js")
-	router.StaticFile("/favicon.ico", "./static/favicon.ico")
-	router.StaticFile("/", "./static/view/tracert.html")
+	router.Static("/static", staticDir)
+	router.Static("/js", filepath.Join(staticDir, "js"))
+	router.StaticFile("/favicon.ico", filepath.Join(staticDir, "favicon.ico"))
+	router.StaticFile("/", filepath.Join(staticDir, "view", "tracert.html"))
 
 	//router.GET("/", func(context *gin.Context) {
 	//	//context.HTML(http.StatusOK, "tracert.html", nil)
@@ -89,7 +100,24 @@ func recvDst(c *gin.Context) {
 	}
 
 	// 新建一个TracertAgg，并运行
-	agg, err := traceroute_agg.NewTracerouteAgg(params.Dst, params.Group, params.NodeNum, time.Now(), &ws.WebsocketManager)
+	task := &dataStruct.TaskParams{
+		Protocol:   params.Protocol,
+		Port:       params.Port,
+		IPVersion:  params.IPVersion,
+		Mode:       params.Mode,
+		Alpha:      params.Alpha,
+		Alias:      params.Alias,
+		LBDstTest:  params.LBDstTest,
+		GapLimit:   params.GapLimit,
+		Doubletree: params.Doubletree,
+		StartTTL:   params.StartTTL,
+		DSCP:       params.DSCP,
+
+		PayloadSize:  params.PayloadSize,
+		PayloadSweep: params.PayloadSweep,
+		Pcap:         params.Pcap,
+	}
+	agg, err := traceroute_agg.NewTracerouteAgg(params.Dst, params.Group, params.NodeNum, task, time.Now(), &ws.WebsocketManager)
 	if err != nil {
 		c.JSON(500, res.Fail(err))
 		logrus.Errorf("%v", err)
@@ -102,10 +130,72 @@ func recvDst(c *gin.Context) {
 	//testFillResult(agg, 40)
 
 	// 不需要对Result进行json编码
-	c.JSON(200, res.Success(agg.Result))
+	c.JSON(200, res.Success(&TraceResult{Hops: agg.Result, Traces: agg.Traces, Routers: agg.Routers, Pcaps: agg.Pcaps}))
 	return
 }
 
+// getDiamonds 查询某目的地址的历史菱形
+func getDiamonds(c *gin.Context) {
+	var res v1.HttpResponse
+	dst := c.Query("dst")
+	if dst == "" {
+		c.JSON(500, res.Fail("缺少参数 dst"))
+		return
+	}
+	diamonds, err := dao.GlobalDiamondData.GetDiamondByDomain(dst)
+	if err != nil {
+		c.JSON(500, res.Fail(err.Error()))
+		logrus.Errorf("%v", err)
+		return
+	}
+	c.JSON(200, res.Success(diamonds))
+}
+
+// getPcap 下载探测节点上报的抓包文件
+func getPcap(c *gin.Context) {
+	var res v1.HttpResponse
+	file := c.Query("file")
+	if file == "" || file != filepath.Base(file) || !strings.HasSuffix(file, ".pcap") {
+		c.JSON(500, res.Fail("参数 file 无效"))
+		return
+	}
+	path := filepath.Join(utils.ConfigData.PcapDir, file)
+	if !util.FileOrPathIsExists(path) {
+		c.JSON(404, res.Fail("抓包文件不存在"))
+		return
+	}
+	c.FileAttachment(path, file)
+}
+
+// exportAtlas 把某目的地址的历史逐跳记录按 RIPE Atlas traceroute 结果格式导出，每个探测节点的每次探测一个结果
+func exportAtlas(c *gin.Context) {
+	var res v1.HttpResponse
+	dst := c.Query("dst")
+	if dst == "" {
+		c.JSON(500, res.Fail("缺少参数 dst"))
+		return
+	}
+	topos, err := dao.GlobalTopoData.GetTopoByDomain(dst)
+	if err != nil {
+		c.JSON(500, res.Fail(err.Error()))
+		return
+	}
+	// 库中没有记录探测协议，由调用方给出
+	c.JSON(200, atlas.EncodeTopos(atlas.Meta{Protocol: c.Query("protocol")}, topos))
+}
+
+// importAtlas 导入请求体中的 RIPE Atlas traceroute 结果，逐跳记录入库
+func importAtlas(c *gin.Context) {
+	var res v1.HttpResponse
+	n, err := atlas.Import(http.MaxBytesReader(c.Writer, c.Request.Body, MaxAtlasBodySize))
+	if err != nil {
+		logrus.Errorf("import atlas results error: %v", err)
+		c.JSON(500, res.Fail(fmt.Sprintf("已导入 %d 条记录，%v", n, err)))
+		return
+	}
+	c.JSON(200, res.Success(n))
+}
+
 func getNodes(c *gin.Context) {
 	var res v1.HttpResponse
 	var nodes []string
@@ -120,6 +210,44 @@ func verifyParams(params *TraceParams) error {
 	if strings.Contains(params.Group, "INVALID") {
 		return fmt.Errorf("error! group is invalid")
 	}
+	if params.Protocol != "" && !util.ContainsString(SupportedProtocols, params.Protocol) {
+		return fmt.Errorf("error! protocol [%s] is not supported", params.Protocol)
+	}
+	if params.IPVersion != 0 && params.IPVersion != 4 && params.IPVersion != 6 {
+		return fmt.Errorf("error! ip-version [%d] is invalid", params.IPVersion)
+	}
+	if params.Mode != "" && !util.ContainsString(SupportedModes, params.Mode) {
+		return fmt.Errorf("error! mode [%s] is not supported", params.Mode)
+	}
+	if params.Alpha < 0 || params.Alpha >= 1 {
+		return fmt.Errorf("error! alpha [%v] must be in (0, 1)", params.Alpha)
+	}
+	if params.GapLimit < 0 {
+		return fmt.Errorf("error! gap-limit [%d] must not be negative", params.GapLimit)
+	}
+	seen := make(map[int]bool, len(params.DSCP))
+	for _, d := range params.DSCP {
+		if d < 0 || d > 63 {
+			return fmt.Errorf("error! dscp [%d] must be in [0, 63]", d)
+		}
+		if seen[d] {
+			return fmt.Errorf("error! dscp [%d] is duplicated", d)
+		}
+		seen[d] = true
+	}
+	if params.PayloadSize < 0 || params.PayloadSize > MaxPayloadSize {
+		return fmt.Errorf("error! payload-size [%d] must be in [0, %d]", params.PayloadSize, MaxPayloadSize)
+	}
+	sizes := make(map[int]bool, len(params.PayloadSweep))
+	for _, s := range params.PayloadSweep {
+		if s <= 0 || s > MaxPayloadSize {
+			return fmt.Errorf("error! payload-sweep size [%d] must be in [1, %d]", s, MaxPayloadSize)
+		}
+		if sizes[s] {
+			return fmt.Errorf("error! payload-sweep size [%d] is duplicated", s)
+		}
+		sizes[s] = true
+	}
 	return nil
 }
 
@@ -1,5 +1,11 @@
 package api
 
+import (
+	"mda-traceroute-go/dataStruct"
+	"mda-traceroute-go/db/dao"
+	"mda-traceroute-go/plugins/traceroute_agg"
+)
+
 type TraceParams struct {
 	Dst string `json:"dst" form:"dst"`
 	// group为all，意为全地域
@@ -7,6 +13,54 @@ type TraceParams struct {
 	// group为某地域时，node-num表示选择该地域的多少个节点
 	// group为all时，node-num >= 0 无意义，node-num < 0，意为每个地域选择 |node-num| 个节点
 	NodeNum int32 `json:"node-num" form:"node-num"`
+	// 探测协议 icmp / udp / tcp，为空时使用探测节点的默认协议
+	Protocol string `json:"protocol" form:"protocol"`
+	// tcp 探测的目的端口，为 0 时使用探测节点的默认端口
+	Port uint16 `json:"port" form:"port"`
+	// 目的地址族 4 / 6，为 0 时优先使用 IPv4
+	IPVersion uint8 `json:"ip-version" form:"ip-version"`
+	// 探测模式 simple / mda / mda-lite，为空时使用探测节点的默认模式
+	Mode string `json:"mode" form:"mode"`
+	// MDA 每个顶点的失败概率上界，取值 (0, 1)，为 0 时使用探测节点的默认值
+	Alpha float64 `json:"alpha" form:"alpha"`
+	// 探测结束后是否做别名解析，结果按路由器合并
+	Alias bool `json:"alias" form:"alias"`
+	// 是否向目的地址同网段的其他地址发探测以识别按目的地址的负载均衡，默认不发
+	LBDstTest bool `json:"lb-dst-test" form:"lb-dst-test"`
+	// 连续多少跳全部超时后停止，为 0 时使用探测节点的默认值
+	GapLimit int `json:"gap-limit" form:"gap-limit"`
+	// 按 Doubletree 从第 start-ttl 跳开始向两端探测，start-ttl 为 0 时使用探测节点的默认值
+	Doubletree bool  `json:"doubletree" form:"doubletree"`
+	StartTTL   uint8 `json:"start-ttl" form:"start-ttl"`
+	// 简单模式下依次用这些 DSCP 值（0-63）探测并比较路径，如语音流量的 46 (EF)
+	DSCP []int `json:"dscp" form:"dscp"`
+	// 探测的负载长度，为 0 时使用探测节点的默认值；payload-sweep 为简单模式下依次比较的负载长度
+	PayloadSize  int   `json:"payload-size" form:"payload-size"`
+	PayloadSweep []int `json:"payload-sweep" form:"payload-sweep"`
+	// 记录各探测节点收发的所有报文，结束后可从 /api/pcap 下载
+	Pcap bool `json:"pcap" form:"pcap"`
+}
+
+// MaxPayloadSize 负载长度的上限，IPv4 下 UDP 负载的最大长度
+const MaxPayloadSize = 65507
+
+// MaxAtlasBodySize 导入 Atlas 结果时请求体的上限
+const MaxAtlasBodySize = 64 << 20
+
+// SupportedProtocols 可下发给探测节点的协议/探测方法，需与探测节点注册的 Prober 名称一致
+var SupportedProtocols = []string{"icmp", "udp", "tcp"}
+
+// SupportedModes 可下发给探测节点的探测模式
+var SupportedModes = []string{"simple", "mda", "mda-lite", "pmtu"}
+
+// TraceResult 一次探测的返回结果
+type TraceResult struct {
+	Hops   map[uint8][]*dao.Topo      `json:"hops"`   // 按 TTL 分组的逐跳记录
+	Traces []*dataStruct.TraceSummary `json:"traces"` // 各探测节点的路径汇总，包含菱形
+	// 按别名合并后的路由器级别拓扑，未做别名解析时每个接口即一个路由器
+	Routers map[uint8][]*traceroute_agg.RouterHop `json:"routers"`
+	// 开启抓包时各探测节点上报的抓包文件，用 /api/pcap?file= 下载
+	Pcaps []*dataStruct.PcapFile `json:"pcaps,omitempty"`
 }
 
 type NodeWsParams struct {
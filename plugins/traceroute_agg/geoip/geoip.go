@@ -69,6 +69,9 @@ func (g GeoLocation) String() string {
 //Lookup is used to find IP location in GeoIPDB
 func (g *GeoIPDB) Lookup(ipAddr string) (GeoLocation, error) {
 	var r GeoLocation
+	if g == nil || g.CityDB == nil {
+		return r, fmt.Errorf("geoip db is not initialized")
+	}
 	ip := net.ParseIP(ipAddr)
 	if ip == nil {
 		return r, fmt.Errorf("ip is nil. ipAddr:[%s]", ipAddr)
@@ -0,0 +1,93 @@
+package traceroute_agg
+
+import (
+	"fmt"
+	"mda-traceroute-go/util"
+	"sort"
+	"strconv"
+)
+
+// RouterHop 按别名合并后某跳上的一个路由器
+type RouterHop struct {
+	TTL         uint8    `json:"ttl"`
+	Router      string   `json:"router"`     // 路由器标识，取别名集合中最小的接口地址
+	Interfaces  []string `json:"interfaces"` // 该跳上属于该路由器的接口
+	MeanLatency float64  `json:"mean_latency"`
+}
+
+// aliasSets 合并各探测节点上报的别名集合，有公共接口的集合属于同一路由器
+type aliasSets struct {
+	parent map[string]string
+}
+
+func newAliasSets() *aliasSets {
+	return &aliasSets{parent: make(map[string]string)}
+}
+
+func (as *aliasSets) find(a string) string {
+	p, ok := as.parent[a]
+	if !ok || p == a {
+		return a
+	}
+	root := as.find(p)
+	as.parent[a] = root
+	return root
+}
+
+// union 合并两个接口所在的集合，以较小的地址作为路由器标识
+func (as *aliasSets) union(a, b string) {
+	ra, rb := as.find(a), as.find(b)
+	if ra == rb {
+		return
+	}
+	if rb < ra {
+		ra, rb = rb, ra
+	}
+	as.parent[ra] = ra
+	as.parent[rb] = ra
+}
+
+// mergeRouters 用所有探测节点的别名集合把逐跳记录合并为路由器级别的拓扑
+func (ta *TracerouteAgg) mergeRouters() {
+	ta.Lock.Lock()
+	defer ta.Lock.Unlock()
+
+	as := newAliasSets()
+	for _, t := range ta.Traces {
+		for _, set := range t.Aliases {
+			for i := 1; i < len(set); i++ {
+				as.union(set[0], set[i])
+			}
+		}
+	}
+
+	ta.Routers = make(map[uint8][]*RouterHop, len(ta.Result))
+	for ttl, topos := range ta.Result {
+		routers := make(map[string]*RouterHop)
+		latency := make(map[string][]float64)
+		for _, topo := range topos {
+			id := as.find(topo.ResAddr)
+			r, ok := routers[id]
+			if !ok {
+				r = &RouterHop{TTL: ttl, Router: id}
+				routers[id] = r
+			}
+			if !util.ContainsString(r.Interfaces, topo.ResAddr) {
+				r.Interfaces = append(r.Interfaces, topo.ResAddr)
+			}
+			latency[id] = append(latency[id], topo.MeanLatency)
+		}
+		for id, r := range routers {
+			sort.Strings(r.Interfaces)
+			sum := 0.0
+			for _, l := range latency[id] {
+				sum += l
+			}
+			r.MeanLatency, _ = strconv.ParseFloat(fmt.Sprintf("%.2f", sum/float64(len(latency[id]))), 64)
+			ta.Routers[ttl] = append(ta.Routers[ttl], r)
+		}
+		sort.Slice(ta.Routers[ttl], func(i, j int) bool {
+			return ta.Routers[ttl][i].Router < ta.Routers[ttl][j].Router
+		})
+	}
+}
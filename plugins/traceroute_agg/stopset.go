@@ -0,0 +1,88 @@
+package traceroute_agg
+
+import (
+	"mda-traceroute-go/dataStruct"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 全局停止集合的容量：最多记录的目的地址数、每个目的地址最多记录的接口数，以及目的地址多久未更新后失效
+const (
+	stopSetMaxDsts  = 4096
+	stopSetMaxAddrs = 512
+	stopSetTTL      = 24 * time.Hour
+)
+
+// stopSetEntry 到某个目的地址的路径上已发现的接口
+type stopSetEntry struct {
+	addrs   map[string]bool
+	updated time.Time
+}
+
+// globalStopSet Doubletree 的全局停止集合：各目的地址的路径上已发现的接口，随任务下发给探测节点，
+// 探测节点向目的端探测时遇到这些接口即停止。超过 stopSetTTL 未更新的目的地址失效，
+// 目的地址数达到上限时淘汰最久未更新的一个
+var globalStopSet = struct {
+	sync.RWMutex
+	dsts map[string]*stopSetEntry
+}{dsts: make(map[string]*stopSetEntry)}
+
+// stopSetFor 到目的地址 dst 的路径上已发现的接口
+func stopSetFor(dst string) []string {
+	globalStopSet.RLock()
+	defer globalStopSet.RUnlock()
+	e, ok := globalStopSet.dsts[dst]
+	if !ok || time.Since(e.updated) > stopSetTTL {
+		return []string{}
+	}
+	addrs := make([]string, 0, len(e.addrs))
+	for a := range e.addrs {
+		addrs = append(addrs, a)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// addStopSet 记录到目的地址 dst 的路径上的接口，超时的跳不记录
+func addStopSet(dst string, addr string) {
+	if addr == dataStruct.StarAddr {
+		return
+	}
+	globalStopSet.Lock()
+	defer globalStopSet.Unlock()
+	now := time.Now()
+	e, ok := globalStopSet.dsts[dst]
+	if ok && now.Sub(e.updated) > stopSetTTL {
+		// 过期的路径可能已经变化，重新记录
+		ok = false
+	}
+	if !ok {
+		if _, exist := globalStopSet.dsts[dst]; !exist && len(globalStopSet.dsts) >= stopSetMaxDsts {
+			evictStopSet(now)
+		}
+		e = &stopSetEntry{addrs: make(map[string]bool)}
+		globalStopSet.dsts[dst] = e
+	}
+	e.updated = now
+	if len(e.addrs) < stopSetMaxAddrs {
+		e.addrs[addr] = true
+	}
+}
+
+// evictStopSet 删除全部过期的目的地址，没有过期的则删除最久未更新的一个，调用方持有写锁
+func evictStopSet(now time.Time) {
+	oldest := ""
+	for dst, e := range globalStopSet.dsts {
+		if now.Sub(e.updated) > stopSetTTL {
+			delete(globalStopSet.dsts, dst)
+			continue
+		}
+		if oldest == "" || e.updated.Before(globalStopSet.dsts[oldest].updated) {
+			oldest = dst
+		}
+	}
+	if len(globalStopSet.dsts) >= stopSetMaxDsts && oldest != "" {
+		delete(globalStopSet.dsts, oldest)
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"mda-traceroute-go/dataStruct"
 	"mda-traceroute-go/db/dao"
 	"mda-traceroute-go/plugins/traceroute_agg/geoip"
+	"mda-traceroute-go/plugins/traceroute_agg/utils"
 	"mda-traceroute-go/plugins/traceroute_agg/ws"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"time"
@@ -19,22 +22,27 @@ type TracerouteAgg struct {
 	Dst         string
 	Group       string
 	NodeNum     int32
+	Task        *dataStruct.TaskParams
 	TracertTime time.Time
 
 	WsManager *ws.Manager
 	Result    map[uint8][]*dao.Topo
+	Traces    []*dataStruct.TraceSummary // 各探测节点上报的路径汇总
+	Routers   map[uint8][]*RouterHop     // 按别名合并后的路由器级别拓扑
+	Pcaps     []*dataStruct.PcapFile     // 各探测节点上报的抓包文件，不含文件内容
 	Lock      sync.Mutex
 
 	// 完成的标志
 	Complete chan bool
 }
 
-func NewTracerouteAgg(dst string, group string, nodeNum int32, tracertTime time.Time, wsManager *ws.Manager) (*TracerouteAgg, error) {
+func NewTracerouteAgg(dst string, group string, nodeNum int32, task *dataStruct.TaskParams, tracertTime time.Time, wsManager *ws.Manager) (*TracerouteAgg, error) {
 
 	ta := &TracerouteAgg{
 		Dst:         dst,
 		Group:       group,
 		NodeNum:     nodeNum,
+		Task:        task,
 		WsManager:   wsManager,
 		TracertTime: tracertTime,
 		Result:      make(map[uint8][]*dao.Topo, 1024),
@@ -53,24 +61,29 @@ func NewTracerouteAgg(dst string, group string, nodeNum int32, tracertTime time.
 func (ta *TracerouteAgg) Start() {
 	// 将探测记录插入 TracertRecord 表
 	ta.insertTracertRecord()
+	if ta.Task != nil && ta.Task.Doubletree {
+		ta.Task.StopSet = stopSetFor(ta.Dst)
+	}
+
+	notice := &dataStruct.Message{
+		MsgType:  "dst",
+		Msg:      ta.Dst,
+		Datetime: ta.TracertTime.Format("2006-01-02 15:04:05"),
+		Task:     ta.Task,
+	}
+	msg, err := json.Marshal(notice)
+	if err != nil {
+		logrus.Errorf("%v", err)
+	}
 
 	if ta.Group == "All" {
 		if ta.NodeNum >= 0 {
-			ta.WsManager.SendAll([]byte(ta.Dst))
+			ta.WsManager.SendAll(msg)
 		} else {
 			// 每组挑选 |NodeNum| 个节点发送
 
 		}
 	} else {
-		notice := &dataStruct.Message{
-			MsgType:  "dst",
-			Msg:      ta.Dst,
-			Datetime: ta.TracertTime.Format("2006-01-02 15:04:05"),
-		}
-		msg, err := json.Marshal(notice)
-		if err != nil {
-			logrus.Errorf("%v", err)
-		}
 		ta.WsManager.SendGroup(ta.Group, msg)
 	}
 
@@ -79,110 +92,212 @@ func (ta *TracerouteAgg) Start() {
 }
 
 func (ta *TracerouteAgg) recvData(group string) {
-	if group == "All" {
-		for i := 0; i < int(ta.WsManager.LenGroup()); i++ {
+	var wg sync.WaitGroup
+	for _, v := range ta.clients(group) {
+		wg.Add(1)
+		go func(c *ws.Client) {
+			defer func() {
+				err := recover()
+				if err != nil {
+					logrus.Errorf("%v", err)
+				}
+				wg.Done()
+			}()
 
-		}
-	} else {
-		var wg sync.WaitGroup
-		for _, v := range ta.WsManager.Group[group] {
-			if cnt, ok := ta.WsManager.LenClientInGroup(group); ok {
-				wg.Add(int(cnt))
-				logrus.Infof("waitgroup add %d", cnt)
-			}
-			go func(c *ws.Client) {
-				defer func() {
-					err := recover()
+		loop:
+			for {
+				if msg, ok := <-c.ToBeReadMessage; ok {
+					// 带 msg-type 的是控制消息，否则是逐跳的探测记录
+					var m dataStruct.Message
+					err := json.Unmarshal(msg, &m)
 					if err != nil {
-						logrus.Errorf("%v", err)
+						logrus.Errorf("json unmarshal ToBeReadMessage error: %v", err)
+						continue
 					}
-					wg.Done()
-				}()
-
-			loop:
-				for {
-					if msg, ok := <-c.ToBeReadMessage; ok {
-						var msgIntf interface{}
-						err := json.Unmarshal(msg, &msgIntf)
-						if err != nil {
-							logrus.Errorf("json unmarshal ToBeReadMessage error: %v", err)
-							continue
-						}
-						switch t := msgIntf.(type) {
-						case dataStruct.RouteInfo:
-							ta.Lock.Lock()
-							loc, err := geoip.GlobalGeoIP.Lookup(t.ResAddr)
-							var topo *dao.Topo
-							mean, _ := strconv.ParseFloat(fmt.Sprintf("%.2f", t.LatencyStat.Mean), 64)
-
-							if err != nil {
-								logrus.Errorf("%v", err)
-
-								topo = &dao.Topo{
-									Domain:      t.Domain,
-									TTL:         t.TTL,
-									DstIP:       t.DstIP,
-									ResAddr:     t.ResAddr,
-									Name:        t.Name,
-									Session:     t.Session,
-									MeanLatency: mean,
-									RecvCnt:     t.RecvCnt,
-									Country:     "-",
-									Region:      "-",
-									City:        "-",
-									ISP:         "-",
-									TracertTime: time.UnixMicro(t.TimeStamp),
-								}
-							} else {
-								topo = &dao.Topo{
-									Domain:      t.Domain,
-									TTL:         t.TTL,
-									DstIP:       t.DstIP,
-									ResAddr:     t.ResAddr,
-									Name:        t.Name,
-									Session:     t.Session,
-									MeanLatency: mean,
-									RecvCnt:     t.RecvCnt,
-									Country:     loc.Country,
-									Region:      loc.Region,
-									City:        loc.City,
-									ISP:         loc.SPName,
-									TracertTime: time.UnixMicro(t.TimeStamp),
-								}
-							}
-							ta.Result[topo.TTL] = append(ta.Result[topo.TTL], topo)
-							ta.Lock.Unlock()
-						case dataStruct.Message:
-							if t.MsgType == "end" {
-								logrus.Infof("client [%v] all data is received. ", c.Id)
-								break loop
-							}
+					if m.MsgType != "" {
+						switch m.MsgType {
+						case "end":
+							logrus.Infof("client [%v] all data is received. ", c.Id)
+							break loop
+						case "summary":
+							ta.handleSummary(m.Msg)
+						case "pcap":
+							ta.handlePcap(m.Msg)
 						}
-					} else {
-						logrus.Errorf("client [%v] 's chan ToBeReadMessage isn't ok.", c.Id)
-						break
+						continue
 					}
+
+					var t dataStruct.RouteInfo
+					err = json.Unmarshal(msg, &t)
+					if err != nil {
+						logrus.Errorf("json unmarshal RouteInfo error: %v", err)
+						continue
+					}
+					ta.handleRouteInfo(t)
+				} else {
+					logrus.Errorf("client [%v] 's chan ToBeReadMessage isn't ok.", c.Id)
+					break
 				}
-			}(v)
+			}
+		}(v)
+	}
+	wg.Wait()
+	ta.mergeRouters()
+	ta.Complete <- true
+}
+
+// clients 返回参与本次探测的子节点，group 为 All 时为所有组的子节点
+func (ta *TracerouteAgg) clients(group string) []*ws.Client {
+	var clients []*ws.Client
+	ta.WsManager.Lock.Lock()
+	defer ta.WsManager.Lock.Unlock()
+	for g, m := range ta.WsManager.Group {
+		if group != "All" && g != group {
+			continue
+		}
+		for _, c := range m {
+			clients = append(clients, c)
 		}
-		wg.Wait()
-		ta.Complete <- true
 	}
+	return clients
 }
 
-func (ta *TracerouteAgg) insertTopo(domain string, ttl uint8, dstIp string, resAddr string,
-	name string, session string, meanLatency float64, recvCnt uint64, tracertTime time.Time) {
+// handleRouteInfo 补全地理位置信息后记入结果并入库
+func (ta *TracerouteAgg) handleRouteInfo(t dataStruct.RouteInfo) {
+	ta.Lock.Lock()
+	defer ta.Lock.Unlock()
 
+	mean, _ := strconv.ParseFloat(fmt.Sprintf("%.2f", t.LatencyStat.Mean), 64)
 	topo := &dao.Topo{
-		Domain:      domain,
-		TTL:         ttl,
-		DstIP:       dstIp,
-		ResAddr:     resAddr,
-		Name:        name,
-		Session:     session,
-		MeanLatency: meanLatency,
-		RecvCnt:     recvCnt,
-		TracertTime: tracertTime,
+		Domain:      t.Domain,
+		TTL:         t.TTL,
+		DstIP:       t.DstIP,
+		ResAddr:     t.ResAddr,
+		Name:        t.Name,
+		Session:     t.Session,
+		MeanLatency: mean,
+		RecvCnt:     t.RecvCnt,
+		Confidence:  t.Confidence,
+		Fallback:    t.Fallback,
+		LoadBalance: t.LoadBalance,
+		LBProbes:    t.LBProbes,
+		LBNextHops:  t.LBNextHops,
+		MPLS:        dataStruct.FormatMPLS(t.MPLS),
+		IfInfo:      dataStruct.FormatInterfaces(t.Interfaces),
+		ReplyTTL:    t.ReplyTTL,
+		QuotedTTL:   t.QuotedTTL,
+		ReturnLen:   t.ReturnLen,
+		Asymmetry:   t.Asymmetry,
+		InvisMPLS:   t.InvisibleMPLS,
+		Unreachable: t.Unreachable,
+		Sent:        t.Sent,
+		Received:    t.Received,
+		Lost:        t.Lost,
+		LossRatio:   t.LossRatio,
+		RateLimited: t.RateLimited,
+		PMTU:        t.PMTU,
+		SizeLat:     dataStruct.FormatSizeLatency(t.SizeLatency),
+		SizeSlope:   t.SizeSlope,
+		Country:     "-",
+		Region:      "-",
+		City:        "-",
+		ISP:         "-",
+		TracertTime: time.UnixMicro(t.TimeStamp),
+	}
+
+	addStopSet(t.Domain, t.ResAddr)
+
+	// IPv4 与 IPv6 地址都按原样查询和存储，超时的跳没有地址
+	if t.ResAddr == dataStruct.StarAddr {
+		ta.Result[topo.TTL] = append(ta.Result[topo.TTL], topo)
+		ta.insertTopo(topo)
+		return
+	}
+	loc, err := geoip.GlobalGeoIP.Lookup(t.ResAddr)
+	if err != nil {
+		logrus.Errorf("%v", err)
+	} else {
+		topo.Country = loc.Country
+		topo.Region = loc.Region
+		topo.City = loc.City
+		topo.ISP = loc.SPName
+	}
+	ta.Result[topo.TTL] = append(ta.Result[topo.TTL], topo)
+	ta.insertTopo(topo)
+}
+
+// handleSummary 记录探测节点上报的路径汇总，其中的菱形逐个入库
+func (ta *TracerouteAgg) handleSummary(data string) {
+	var s dataStruct.TraceSummary
+	err := json.Unmarshal([]byte(data), &s)
+	if err != nil {
+		logrus.Errorf("json unmarshal TraceSummary error: %v", err)
+		return
+	}
+	ta.Lock.Lock()
+	ta.Traces = append(ta.Traces, &s)
+	ta.Lock.Unlock()
+
+	if dao.GlobalDiamondData.Server == nil {
+		return
+	}
+	for _, d := range s.Diamonds {
+		hops, err := json.Marshal(d.Hops)
+		if err != nil {
+			logrus.Errorf("%v", err)
+		}
+		_, err = dao.GlobalDiamondData.InsertDiamond(&dao.Diamond{
+			Domain:         s.Domain,
+			DstIP:          s.DstIP,
+			Name:           s.Name,
+			Session:        s.Session,
+			Divergence:     d.Divergence,
+			DivergenceTTL:  d.DivergenceTTL,
+			Convergence:    d.Convergence,
+			ConvergenceTTL: d.ConvergenceTTL,
+			MinWidth:       d.MinWidth,
+			MaxWidth:       d.MaxWidth,
+			MinLength:      d.MinLength,
+			MaxLength:      d.MaxLength,
+			Asymmetric:     d.Asymmetric,
+			Meshed:         d.Meshed,
+			Hops:           string(hops),
+			TracertTime:    time.UnixMicro(s.TimeStamp),
+		})
+		if err != nil {
+			logrus.Errorf("%v", err)
+		}
+	}
+}
+
+// handlePcap 把探测节点上报的抓包文件保存到 PcapDir，文件名前加上节点名以免重名
+func (ta *TracerouteAgg) handlePcap(data string) {
+	var f dataStruct.PcapFile
+	err := json.Unmarshal([]byte(data), &f)
+	if err != nil {
+		logrus.Errorf("json unmarshal PcapFile error: %v", err)
+		return
+	}
+	dir := utils.ConfigData.PcapDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logrus.Errorf("create pcap dir %s error: %v", dir, err)
+		return
+	}
+	f.File = filepath.Base(f.Name + "-" + filepath.Base(f.File))
+	if err := os.WriteFile(filepath.Join(dir, f.File), f.Data, 0644); err != nil {
+		logrus.Errorf("write pcap %s error: %v", f.File, err)
+		return
+	}
+	f.Data = nil
+	ta.Lock.Lock()
+	ta.Pcaps = append(ta.Pcaps, &f)
+	ta.Lock.Unlock()
+}
+
+// insertTopo 数据库未初始化时不入库
+func (ta *TracerouteAgg) insertTopo(topo *dao.Topo) {
+	if dao.GlobalTopoData.Server == nil {
+		return
 	}
 	_, err := dao.GlobalTopoData.InsertTopo(topo)
 	if err != nil {
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"github.com/sirupsen/logrus"
+	"mda-traceroute-go/util"
+	"sync"
+)
+
+type Config struct {
+	RunArgs
+	GeoIPConf
+	DBConf
+	LogConf
+}
+
+type RunArgs struct {
+	Listen    string `toml:"listen"`    // HTTP 及 websocket 监听地址，如 0.0.0.0:20118
+	StaticDir string `toml:"staticDir"` // 前端静态文件目录
+	PcapDir   string `toml:"pcapDir"`   // 保存探测节点上报的抓包文件的目录
+}
+
+type GeoIPConf struct {
+	CityDB string `toml:"cityDB"`
+	ASNDB  string `toml:"asnDB"`
+}
+
+type DBConf struct {
+	DSN string `toml:"dsn"`
+}
+
+type LogConf struct {
+	LogDir   string `toml:"logDir"`
+	LogLevel string `toml:"logLevel"`
+}
+
+var (
+	ConfigFile string
+	ConfigData *Config
+	ConfigLock sync.RWMutex
+)
+
+// 未在配置文件中给出时使用的默认值
+var (
+	DefaultListen    = "0.0.0.0:20118"
+	DefaultStaticDir = "./static"
+	DefaultPcapDir   = "./pcap"
+	DefaultLogDir    = "./logs"
+)
+
+// ParseConfig 解析配置文件
+func ParseConfig(cfg string) error {
+	var c Config
+	err := util.ParseConfigToml(cfg, &c)
+	if err != nil {
+		logrus.Fatal("read config file ", cfg, " error: ", err)
+		return err
+	}
+	if c.Listen == "" {
+		c.Listen = DefaultListen
+	}
+	if c.StaticDir == "" {
+		c.StaticDir = DefaultStaticDir
+	}
+	if c.PcapDir == "" {
+		c.PcapDir = DefaultPcapDir
+	}
+	if c.LogDir == "" {
+		c.LogDir = DefaultLogDir
+	}
+
+	ConfigLock.Lock()
+	ConfigFile = cfg
+	ConfigData = &c
+	ConfigLock.Unlock()
+	logrus.Infof("parse config success.")
+
+	return nil
+}
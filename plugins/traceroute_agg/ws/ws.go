@@ -14,6 +14,9 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
+// maxMessageSize 单条消息的上限，探测节点上报的抓包文件不超过 32MB，经 base64 编码和 JSON 转义后不超过 48MB
+const maxMessageSize = 64 << 20
+
 // Manager 所有 websocket 信息
 type Manager struct {
 	Group                   map[string]map[string]*Client
@@ -249,6 +252,7 @@ func (manager *Manager) WsClient(ctx *gin.Context) {
 		logrus.Infof("websocket connect error: %s", ctx.Param("group"))
 		return
 	}
+	conn.SetReadLimit(maxMessageSize)
 
 	client := &Client{
 		Id:              uuid.NewV4().String(),
@@ -1,23 +1,50 @@
 package dataStruct
 
 import (
+	cds "mda-traceroute-go/dataStruct"
 	"mda-traceroute-go/plugins/traceroute_probe/linkInfo"
+	"net"
 	"sync"
 )
 
 type SendPacket struct {
 	Key       string
 	ID        uint32
+	FlowID    uint16
 	TTL       uint8
 	TimeStamp int64
+
+	Dst   net.IP // 探测包的目的地址，为 nil 时为任务目的地址；发往其他地址的探测不计入逐跳结果
+	Track bool   // 记录该探测的应答地址，供需要逐个探测结果的检测使用
+	// 不计入该跳的发送数和丢失数，如限速检测和重传的探测
+	Uncounted bool
+	Size      int  // 整个 IP 报文的长度，为 0 时使用探测引擎的默认长度
+	DF        bool // IPv4 设置不分片标志，IPv6 路由器本身不分片
+	TOS       int  // IPv4 的 TOS 字节或 IPv6 的流量类别，DSCP 占高 6 位
+	Payload   int  // 传输层头部之后的负载长度，为 0 时使用任务的负载长度；Size 不为 0 时忽略
 }
 
 type RecvPacket struct {
-	Key       string
-	ID        uint32
-	DstIP     string
-	ResAddr   string
-	TimeStamp int64
+	Key     string
+	ID      uint32
+	DstIP   string
+	ResAddr string
+	Reached bool   // 应答来自目的端，如 TCP SYN-ACK/RST
+	IPID    uint16 // 应答报文的 IP ID，IPv6 为 0
+	TTL     uint8  // 应答报文的 IP TTL
+	// 差错报文引用的原始探测包到达该跳时的 TTL 和 TOS，Quoted 为 false 时是直接应答，没有引用
+	QuotedTTL uint8
+	QuotedTOS uint8
+	Quoted    bool
+	// 目的不可达应答的标记，如 !N !H !P !X；目的端返回的端口不可达及其他应答为空
+	Unreachable string
+	// 应答为需要分片（IPv6 为 Packet Too Big），MTU 为其报告的下一跳 MTU
+	FragNeeded bool
+	MTU        int
+
+	MPLS       []cds.MPLSLabel     // ICMP 扩展中的 MPLS 标签栈
+	Interfaces []cds.InterfaceInfo // ICMP 扩展中的接口信息
+	TimeStamp  int64
 }
 
 type ProbeResponse struct {
@@ -30,9 +57,36 @@ type ProbeResponse struct {
 	ResAddr  string `json:"res-addr"`
 	FlowID   uint32
 	FlowDiff bool  // FlowID 是否有变动
-	CreateTs int64 `json:"create-ts""`
+	CreateTs int64 `json:"create-ts"`
 	Latency  *linkInfo.LatencyStat
-	Lock     sync.RWMutex
+	// 负载长度扫描时按负载长度分别统计的延时，单位 ms
+	SizeLatency map[int]*linkInfo.LatencyStat `json:"size-latency,omitempty"`
+	// MDA 模式下本跳下一跳集合完整的置信度，简单模式为 0
+	Confidence float64 `json:"confidence"`
+	// MDA-Lite 模式下本跳回退为 MDA 的原因，未回退为空
+	Fallback string `json:"fallback,omitempty"`
+	// MDA 模式下本跳顶点的负载均衡类型 none / per-flow / per-packet / per-destination，
+	// 以及判断时发送的探测数和看到的不同下一跳个数。简单模式每跳只用一个流标识，没有判断依据，留空；
+	// 目的端和全部超时的顶点也留空
+	LoadBalance string `json:"load-balance,omitempty"`
+	LBProbes    int    `json:"lb-probes,omitempty"`
+	LBNextHops  int    `json:"lb-next-hops,omitempty"`
+	// 该跳应答中 ICMP 扩展携带的 MPLS 标签栈和接口信息，取最近一次应答
+	MPLS       []cds.MPLSLabel     `json:"mpls,omitempty"`
+	Interfaces []cds.InterfaceInfo `json:"interfaces,omitempty"`
+	// 最近一次应答的 IP TTL 和引用的探测包 TTL
+	ReplyTTL  uint8 `json:"reply-ttl"`
+	QuotedTTL uint8 `json:"quoted-ttl"`
+	// 该跳返回的目的不可达标记，如 !N !H !P !X
+	Unreachable string `json:"unreachable,omitempty"`
+	// 该跳发送的探测数和超时未应答的探测数，同一跳的各条记录相同
+	Sent int `json:"sent"`
+	Lost int `json:"lost"`
+	// PMTU 模式下能到达该跳的最大探测大小
+	PMTU int `json:"pmtu,omitempty"`
+	// 该跳路由器对 ICMP 差错报文限速，丢失的探测不代表链路丢包
+	RateLimited bool `json:"rate-limited,omitempty"`
+	Lock        sync.RWMutex
 }
 
 func NewProbeResponse(key string, taskGeneTs int64, ttl uint8, dstIP string, resAddr string, flowId uint32, createTs int64) *ProbeResponse {
@@ -45,5 +99,104 @@ func NewProbeResponse(key string, taskGeneTs int64, ttl uint8, dstIP string, res
 		FlowID:     flowId,
 		FlowDiff:   false,
 		CreateTs:   createTs,
+		Latency:    linkInfo.NewLatencyStat(),
+	}
+}
+
+// RouteInfo 转换为上报给控制节点的逐跳记录，name 为探测节点所在的组
+func (pr *ProbeResponse) RouteInfo(name string) cds.RouteInfo {
+	pr.Lock.RLock()
+	defer pr.Lock.RUnlock()
+	returnLen := cds.ReturnPathLength(pr.ReplyTTL)
+	asymmetry := 0
+	if returnLen > 0 {
+		asymmetry = returnLen - int(pr.TTL)
+	}
+	// 到达目的端的应答引用的 TTL 是探测剩余的 TTL，不能说明存在隧道
+	invisible := pr.QuotedTTL > 1 && pr.ResAddr != pr.DstIP
+	lossRatio := 0.0
+	if pr.Sent > 0 {
+		lossRatio = float64(pr.Lost) / float64(pr.Sent)
+	}
+	return cds.RouteInfo{
+		Domain:  pr.Domain,
+		TTL:     pr.TTL,
+		DstIP:   pr.DstIP,
+		ResAddr: pr.ResAddr,
+		Name:    name,
+		Session: pr.Key,
+		LatencyStat: cds.LatencyStat{
+			Count: pr.Latency.Cnt,
+			Min:   pr.Latency.Min,
+			Max:   pr.Latency.Max,
+			Mean:  pr.Latency.Mean,
+			Std:   pr.Latency.Std(),
+			Skew:  pr.Latency.Skewness(),
+			Kurt:  pr.Latency.Kurtosis(),
+		},
+		RecvCnt:       uint64(pr.Latency.Cnt),
+		Confidence:    pr.Confidence,
+		Fallback:      pr.Fallback,
+		LoadBalance:   pr.LoadBalance,
+		LBProbes:      pr.LBProbes,
+		LBNextHops:    pr.LBNextHops,
+		MPLS:          pr.MPLS,
+		Interfaces:    pr.Interfaces,
+		ReplyTTL:      pr.ReplyTTL,
+		QuotedTTL:     pr.QuotedTTL,
+		ReturnLen:     returnLen,
+		Asymmetry:     asymmetry,
+		InvisibleMPLS: invisible,
+		Unreachable:   pr.Unreachable,
+		Sent:          pr.Sent,
+		Received:      pr.Sent - pr.Lost,
+		Lost:          pr.Lost,
+		LossRatio:     lossRatio,
+		RateLimited:   pr.RateLimited,
+		PMTU:          pr.PMTU,
+		SizeLatency:   sizeLatency(pr.SizeLatency),
+		SizeSlope:     sizeSlope(pr.SizeLatency),
+		TimeStamp:     pr.TaskGeneTs,
+	}
+}
+
+func sizeLatency(m map[int]*linkInfo.LatencyStat) map[int]cds.LatencyStat {
+	if len(m) == 0 {
+		return nil
+	}
+	res := make(map[int]cds.LatencyStat, len(m))
+	for size, ls := range m {
+		res[size] = cds.LatencyStat{
+			Count: ls.Cnt,
+			Min:   ls.Min,
+			Max:   ls.Max,
+			Mean:  ls.Mean,
+			Std:   ls.Std(),
+			Skew:  ls.Skewness(),
+			Kurt:  ls.Kurtosis(),
+		}
+	}
+	return res
+}
+
+// sizeSlope 各负载长度平均延时对负载长度的最小二乘斜率，单位 ms/字节，
+// 近似为往返路径上逐字节的串行化时延；少于两个负载长度时为 0
+func sizeSlope(m map[int]*linkInfo.LatencyStat) float64 {
+	if len(m) < 2 {
+		return 0
+	}
+	var n, sx, sy, sxx, sxy float64
+	for size, ls := range m {
+		x, y := float64(size), ls.Mean
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	d := n*sxx - sx*sx
+	if d == 0 {
+		return 0
 	}
+	return (n*sxy - sx*sy) / d
 }
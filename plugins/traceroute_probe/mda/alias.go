@@ -0,0 +1,170 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"net"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	aliasRounds    = 5     // 每个接口采集的 IP ID 样本数
+	aliasProbeTTL  = 64    // 直接探测接口时使用的 TTL
+	aliasMaxDelta  = 32767 // 相邻样本 IP ID 增量的上限，超过视为回绕或乱序
+	aliasSlack     = 2.0   // 速度上界的放宽倍数
+	aliasMinSlack  = 16    // 相邻样本 IP ID 增量的最小容忍值
+	aliasMaxTarget = 256   // 最多参与别名解析的接口数
+)
+
+// ipidSample 接口应答的一个 IP ID 样本
+type ipidSample struct {
+	addr string
+	id   uint16
+	ts   int64 // 应答到达时间，单位 us
+}
+
+// resolveAliases 向逐跳结果中的各接口直接发送探测，采集应答的 IP ID 时间序列，
+// 用单调边界检测（MBT）把共享同一个 IP ID 计数器的接口归为同一台路由器。
+// IPv6 应答没有 IP ID，不做别名解析。
+func (app *TraceApp) resolveAliases() {
+	if app.isIPv6() {
+		logrus.Infof("alias resolution is not supported for ipv6 task %s", app.Domain)
+		return
+	}
+	targets := app.aliasTargets()
+	if len(targets) < 2 {
+		return
+	}
+
+	// 轮流探测各接口，使不同接口的样本在时间上交错
+	series := make(map[string][]ipidSample)
+	for round := 0; round < aliasRounds; round++ {
+		if atomic.LoadUint32(&app.Exit) == 1 {
+			return
+		}
+		probes := make([]*ds.SendPacket, len(targets))
+		for i, t := range targets {
+			probes[i] = &ds.SendPacket{TTL: aliasProbeTTL, Dst: t}
+		}
+		for i, v := range app.probeReplies(probes) {
+			addr := targets[i].String()
+			if v == nil || v.ResAddr != addr {
+				continue
+			}
+			series[addr] = append(series[addr], ipidSample{addr: addr, id: v.IPID, ts: v.TimeStamp})
+		}
+	}
+
+	var usable []string
+	velocity := make(map[string]float64)
+	for addr, s := range series {
+		if v, ok := ipidVelocity(s); ok {
+			usable = append(usable, addr)
+			velocity[addr] = v
+		}
+	}
+	sort.Strings(usable)
+
+	// 贪心分组：接口与某组中所有接口都通过检测才加入该组
+	var sets [][]string
+	for _, a := range usable {
+		joined := false
+		for i, set := range sets {
+			ok := true
+			for _, b := range set {
+				if !monotonicBounds(series[a], series[b], velocity[a], velocity[b]) {
+					ok = false
+					break
+				}
+			}
+			if ok {
+				sets[i] = append(set, a)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			sets = append(sets, []string{a})
+		}
+	}
+
+	app.flowLock.Lock()
+	for _, set := range sets {
+		if len(set) > 1 {
+			app.aliases = append(app.aliases, set)
+		}
+	}
+	app.flowLock.Unlock()
+	logrus.Infof("alias resolution for %s: %d usable interfaces, alias sets %v", app.Domain, len(usable), app.aliases)
+}
+
+// aliasTargets 逐跳结果中除目的端外的全部接口
+func (app *TraceApp) aliasTargets() []net.IP {
+	dst := app.DstAddr.String()
+	var targets []net.IP
+	for _, pr := range app.Results() {
+		if pr.ResAddr == dst || len(targets) >= aliasMaxTarget {
+			continue
+		}
+		ip := net.ParseIP(pr.ResAddr)
+		if ip == nil || containsIP(targets, ip) {
+			continue
+		}
+		app.flowLock.Lock()
+		app.altDsts[ip.String()] = true
+		app.flowLock.Unlock()
+		targets = append(targets, ip)
+	}
+	return targets
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, v := range ips {
+		if v.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipidVelocity 接口的 IP ID 是否单调递增（允许回绕），返回每秒增量。
+// 样本太少、IP ID 不变或随机的接口无法参与检测。
+func ipidVelocity(s []ipidSample) (float64, bool) {
+	if len(s) < 3 {
+		return 0, false
+	}
+	total := 0
+	for i := 1; i < len(s); i++ {
+		d := int(s[i].id - s[i-1].id)
+		if d == 0 || d > aliasMaxDelta {
+			return 0, false
+		}
+		total += d
+	}
+	dt := float64(s[len(s)-1].ts-s[0].ts) / 1e6
+	if dt <= 0 {
+		return 0, false
+	}
+	return float64(total) / dt, true
+}
+
+// monotonicBounds 单调边界检测：两个接口共享计数器时，按时间合并后的序列仍然单调递增，
+// 且相邻样本的增量不超过按较快接口的速度估计的上界
+func monotonicBounds(a, b []ipidSample, va, vb float64) bool {
+	merged := append(append([]ipidSample{}, a...), b...)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].ts < merged[j].ts })
+	v := va
+	if vb > v {
+		v = vb
+	}
+	for i := 1; i < len(merged); i++ {
+		d := int(merged[i].id - merged[i-1].id)
+		dt := float64(merged[i].ts-merged[i-1].ts) / 1e6
+		bound := v*dt*aliasSlack + aliasMinSlack
+		if d == 0 || d > aliasMaxDelta || float64(d) > bound {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,589 @@
+package mda
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	cds "mda-traceroute-go/dataStruct"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"mda-traceroute-go/plugins/traceroute_probe/netio"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"mda-traceroute-go/util"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 支持的探测协议
+const (
+	ProtocolICMP = "icmp"
+	ProtocolUDP  = "udp"
+	ProtocolTCP  = "tcp"
+)
+
+// ProtocolNumber 返回探测协议对应的 IP 协议号，未知协议按 ICMP 处理
+func ProtocolNumber(protocol string) uint16 {
+	switch protocol {
+	case ProtocolUDP:
+		return 17
+	case ProtocolTCP:
+		return 6
+	default:
+		return 1
+	}
+}
+
+// engine 由具体协议的探测引擎实现，TraceApp 通过它构造探测包并从差错报文中取回探测标识
+type engine interface {
+	// buildTransport 构造发往 dst、流标识为 flowID、探测标识为 id 的传输层头部及负载，IP 头部由 TraceApp 按地址族补齐。
+	// size 为传输层头部及负载的总长度，不大于 0 时使用引擎的默认长度
+	buildTransport(dst net.IP, flowID uint16, id uint16, size int) []byte
+	// protocol 探测包的 IP 协议号（IPv6 下为下一首部）
+	protocol() int
+}
+
+// directHandler 由需要处理目的端直接应答的引擎实现，如 TCP 的 SYN-ACK/RST
+type directHandler interface {
+	acceptDirect(r *netio.Reply) bool
+}
+
+// TraceApp 各协议探测引擎共用的收发、匹配和结果记录逻辑
+type TraceApp struct {
+	key      string
+	srcAddr  net.IP
+	DstAddr  net.IP
+	Domain   string // 任务下发的原始目的地址（域名或 IP）
+	maxTTL   uint8
+	Protocol string
+
+	engine engine
+
+	lease         *netio.Lease // 共享收发服务分配给本任务的探测标识区间
+	matchCache    *MatchCache
+	ResMap        []map[string]*ds.ProbeResponse
+	ResTTL        []uint8           // 排序插入
+	ResFlowIDMap  map[string]uint32 //记录探测到某端口用的流标签
+	ResFlowIDLock sync.RWMutex
+
+	SendChan chan *ds.SendPacket
+	RecvChan chan *ds.RecvPacket
+
+	mode        string // 探测模式 ModeSimple / ModeMDA / ModeMDALite
+	stop        *StoppingPoints
+	hops        []*hopFlows // 下标为 TTL，0 代表源端
+	flowLock    sync.RWMutex
+	nextFlow    uint16
+	hopConf     []float64                     // 每跳枚举下一跳达到的置信度，仅 MDA 模式有效
+	hopFallback []string                      // MDA-Lite 模式下触发回退的跳及原因
+	lb          map[uint8]map[string]*LBClass // 各跳顶点的负载均衡类型
+	tracked     map[uint16]*ds.RecvPacket     // 需要记录应答的探测
+	altDsts     map[string]bool               // 本任务探测过的其他目的地址
+	alias       bool                          // 探测结束后是否做别名解析
+	lbDstTest   bool                          // 是否用同网段的其他目的地址识别按目的地址的负载均衡
+	aliases     [][]string                    // 别名解析得到的属于同一路由器的接口集合
+	unreachable map[string]string             // 返回过目的不可达的路由器及其标记
+	gapLimit    int                           // 连续多少跳全部超时后停止
+	lastTTL     uint8                         // 逐跳探测到的最后一跳
+	dstTTL      uint8                         // Doubletree 向源端探测时目的端应答的最小 TTL，为 0 时不限制结果的跳数
+	termination string                        // 探测结束的原因
+	hopSent     []int                         // 各跳发送的探测数，不含发往其他目的地址的探测
+	hopLost     []int                         // 各跳超时未应答的探测数
+	flowLost    []map[uint16]int              // 各跳每个流超时未应答的探测数，用于区分丢包的分支和丢包的跳
+	rateLimited []bool                        // 各跳是否检测到 ICMP 限速
+	probedTTL   []bool                        // 各跳是否探测过，未探测的跳不记为超时
+	pmtuSize    int                           // PMTU 模式当前的探测大小，即已探测部分的路径 MTU
+	hopMTU      []int                         // PMTU 模式下能到达各跳的最大探测大小
+	mtuDrops    []cds.MTUDrop                 // PMTU 模式下路径 MTU 变小的位置
+	dscp        []int                         // 简单模式下依次比较的 DSCP 值
+	dscpHops    map[int][]*dscpHopResult      // 各 DSCP 值逐跳的结果
+	payload     int                           // 探测的负载长度，为 0 时使用探测引擎的默认长度
+	payloads    []int                         // 简单模式下依次比较的负载长度
+	pcap        *netio.PcapWriter             // 记录本任务收发的所有报文，未开启抓包时为 nil
+	doubletree  bool                          // 是否按 Doubletree 从中间跳开始探测
+	startTTL    uint8                         // Doubletree 开始探测的中间跳
+	localStop   *StopSet                      // 探测节点的本地停止集合
+	globalStop  *StopSet                      // 控制节点下发的全局停止集合
+
+	TaskGeneTs int64
+	TaskEndTs  int64
+
+	Reached   uint32 // 1 表示已收到目的端的应答
+	Exit      uint32 // 0 means not exit
+	ExcepFlag uint32
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newTraceApp(conf *ProberConf, protocol string) (*TraceApp, error) {
+	if conf.IO == nil {
+		return nil, fmt.Errorf("packet io service is not initialized")
+	}
+	for _, d := range conf.DSCP {
+		if d < 0 || d > 63 {
+			return nil, fmt.Errorf("invalid dscp %d, must be in 0-63", d)
+		}
+	}
+	lease, err := conf.IO.Acquire()
+	if err != nil {
+		return nil, err
+	}
+
+	cacheConf := utils.ConfigData.MatchCacheConf
+	matchCache := NewMatchCache(conf.Key, cacheConf.Timeout, cacheConf.CheckFreq)
+
+	mode := conf.Mode
+	if mode == "" {
+		mode = ModeSimple
+	}
+	gapLimit := conf.GapLimit
+	if gapLimit <= 0 {
+		gapLimit = DefaultGapLimit
+	}
+	pmtuSize := utils.ConfigData.PMTUSize
+	if pmtuSize <= 0 {
+		pmtuSize = DefaultPMTUSize
+	}
+	startTTL := conf.StartTTL
+	if startTTL == 0 {
+		startTTL = DefaultStartTTL
+	}
+	var globalStop *StopSet
+	if len(conf.GlobalStop) > 0 {
+		globalStop = NewStopSet(conf.GlobalStop...)
+	}
+	hops := make([]*hopFlows, 256)
+	for i := range hops {
+		hops[i] = newHopFlows()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	app := &TraceApp{
+		key:          conf.Key,
+		srcAddr:      conf.SrcAddr,
+		DstAddr:      conf.DstAddr,
+		Domain:       conf.Domain,
+		maxTTL:       conf.MaxTTL,
+		Protocol:     protocol,
+		lease:        lease,
+		matchCache:   matchCache,
+		ResMap:       make([]map[string]*ds.ProbeResponse, 256),
+		ResTTL:       make([]uint8, 0, 256),
+		ResFlowIDMap: make(map[string]uint32, 256),
+		SendChan:     make(chan *ds.SendPacket, 10),
+		RecvChan:     make(chan *ds.RecvPacket, 10),
+		mode:         mode,
+		stop:         NewStoppingPoints(conf.Alpha),
+		hops:         hops,
+		hopConf:      make([]float64, 256),
+		hopFallback:  make([]string, 256),
+		lb:           make(map[uint8]map[string]*LBClass),
+		tracked:      make(map[uint16]*ds.RecvPacket),
+		altDsts:      make(map[string]bool),
+		alias:        conf.Alias,
+		lbDstTest:    conf.LBDstTest,
+		unreachable:  make(map[string]string),
+		gapLimit:     gapLimit,
+		hopSent:      make([]int, 256),
+		hopLost:      make([]int, 256),
+		flowLost:     make([]map[uint16]int, 256),
+		rateLimited:  make([]bool, 256),
+		probedTTL:    make([]bool, 256),
+		pmtuSize:     pmtuSize,
+		hopMTU:       make([]int, 256),
+		dscp:         conf.DSCP,
+		dscpHops:     make(map[int][]*dscpHopResult, len(conf.DSCP)),
+		payload:      conf.Payload,
+		payloads:     conf.Payloads,
+		doubletree:   conf.Doubletree,
+		startTTL:     startTTL,
+		localStop:    conf.LocalStop,
+		globalStop:   globalStop,
+		TaskGeneTs:   conf.TaskGeneTs,
+		Exit:         0,
+		ExcepFlag:    0,
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan struct{}),
+	}
+	if conf.Pcap != "" {
+		// 抓包失败不影响探测本身
+		app.pcap, err = netio.NewPcapWriter(conf.Pcap)
+		if err != nil {
+			logrus.Errorf("create pcap %s error: %v", conf.Pcap, err)
+		}
+	}
+	matchCache.Cache.OnExpire(app.onProbeExpire)
+	go matchCache.Cache.RunCheck()
+	return app, nil
+}
+
+// capture 开启抓包时记录一个收发的报文
+func (app *TraceApp) capture(ts time.Time, pkt []byte) {
+	if app.pcap == nil {
+		return
+	}
+	if err := app.pcap.WritePacket(ts, pkt); err != nil {
+		logrus.Errorf("write pcap error: %v", err)
+	}
+}
+
+func (app *TraceApp) Start() {
+	go app.ListenFor()
+	go app.match()
+	app.run()
+
+	// 检查是否在运行，任务被取消时立即返回
+	for {
+		after := time.After(10 * time.Second)
+		select {
+		case <-app.ctx.Done():
+			return
+		case <-after:
+			if app.matchCache.Cache.Len() == 0 {
+				app.GracefulClose(1)
+				return
+			}
+		}
+	}
+}
+
+// run 按探测模式执行探测，返回时全部探测已发出并等待过应答
+func (app *TraceApp) run() {
+	app.logDSCP()
+
+	switch app.mode {
+	case ModeMDA:
+		app.mda()
+		app.classify()
+	case ModeMDALite:
+		app.mdaLite()
+		app.classify()
+	case ModePMTU:
+		app.pmtu()
+	default:
+		// 简单地探测，未进行多路径探测
+		app.SendPacket()
+	}
+	if app.alias {
+		app.resolveAliases()
+	}
+}
+
+// SendPacket 构建探测报文并按 TTL 逐跳发送，到达目的端、遇到目的不可达或连续多跳超时后停止
+func (app *TraceApp) SendPacket() {
+	logrus.Infof("Start send %s Datagram. netSrcAddr: %v", app.Protocol, app.srcAddr)
+	if len(app.dscp) > 0 {
+		app.traceHops(app.dscpHop)
+		return
+	}
+	if len(app.payloads) > 0 {
+		app.traceHops(app.payloadHop)
+		return
+	}
+	app.traceHops(app.simpleHop)
+}
+
+// simpleHop 用固定的流标识在第 ttl 跳发送 FirstSendCnt 个探测，等待应答或超时，返回看到的应答地址
+func (app *TraceApp) simpleHop(ttl uint8) (float64, []string) {
+	probes := make([]*ds.SendPacket, app.firstSendCnt())
+	for i := range probes {
+		probes[i] = &ds.SendPacket{TTL: ttl}
+	}
+	set := make(map[string]bool)
+	var addrs []string
+	for _, a := range app.probeBatch(probes) {
+		if !set[a] {
+			set[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	sort.Strings(addrs)
+	return 0, addrs
+}
+
+// firstSendCnt 简单模式每跳发送的探测数，至少为 1
+func (app *TraceApp) firstSendCnt() int {
+	if utils.ConfigData.FirstSendCnt == 0 {
+		return 1
+	}
+	return int(utils.ConfigData.FirstSendCnt)
+}
+
+// ListenFor 接收共享收发服务分发给本任务的应答
+func (app *TraceApp) ListenFor() {
+	logrus.Infof("Start Listen reply for %s probes, probe id [%d, %d).",
+		app.Protocol, app.lease.Start, int(app.lease.Start)+app.lease.Size)
+	for {
+		select {
+		case <-app.ctx.Done():
+			return
+		case r := <-app.lease.Replies():
+			app.capture(r.TimeStamp, r.Packet)
+			m, ok := app.toRecvPacket(r)
+			if !ok {
+				continue
+			}
+			select {
+			case app.RecvChan <- m:
+			case <-app.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// toRecvPacket 过滤出本任务关心的应答：引用了本任务探测包的差错报文，或目的端的直接应答
+func (app *TraceApp) toRecvPacket(r *netio.Reply) (*ds.RecvPacket, bool) {
+	m := &ds.RecvPacket{
+		Key:        app.key,
+		ID:         uint32(r.ProbeID),
+		DstIP:      app.DstAddr.String(),
+		ResAddr:    r.Src.String(),
+		IPID:       r.IPID,
+		TTL:        r.TTL,
+		MPLS:       r.MPLS,
+		Interfaces: r.Interfaces,
+		TimeStamp:  r.TimeStamp.UnixMicro(),
+	}
+
+	if r.IsError() {
+		if !app.acceptError(r) {
+			logrus.Warningf("receive packet icmpType: %d, icmpCode: %d. \n", r.ICMPType, r.ICMPCode)
+			return nil, false
+		}
+		if r.Quoted.Proto != app.engine.protocol() || !app.ownsDst(r.Quoted.Dst) {
+			return nil, false
+		}
+		m.QuotedTTL, m.QuotedTOS, m.Quoted = r.Quoted.TTL, r.Quoted.TOS, true
+		if app.isFragNeeded(r) {
+			// 路径 MTU 的信号，不代表目的不可达
+			m.FragNeeded, m.MTU = true, r.MTU
+			return m, true
+		}
+		if app.isUnreachable(r) {
+			// 目的端自己返回的不可达说明探测已经到达，如 UDP 探测的端口不可达，此时只标记其他 code
+			c, port := ICMPCode(r.ICMPCode), PortUnreachable
+			if app.isIPv6() {
+				port = ICMPv6PortUnreachable
+			}
+			m.Reached = r.Src.Equal(r.Quoted.Dst)
+			if !m.Reached || c != port {
+				m.Unreachable = unreachableMark(app.isIPv6(), c)
+			}
+		}
+		return m, true
+	}
+
+	if d, ok := app.engine.(directHandler); ok && d.acceptDirect(r) {
+		m.Reached = true
+		return m, true
+	}
+	logrus.Warningf("receive packet icmpType: %d, icmpCode: %d. \n", r.ICMPType, r.ICMPCode)
+	return nil, false
+}
+
+// acceptError 处理 Time Exceeded、各种 Destination Unreachable 和 IPv6 的 Packet Too Big
+func (app *TraceApp) acceptError(r *netio.Reply) bool {
+	if app.isIPv6() {
+		return ICMPType(r.ICMPType) == ICMPv6TimeExceeded || app.isUnreachable(r) || app.isFragNeeded(r)
+	}
+	return ICMPType(r.ICMPType) == ICMPTimeExceeded || app.isUnreachable(r)
+}
+
+// isFragNeeded 应答是否为 Fragmentation Needed and DF Set 或 Packet Too Big
+func (app *TraceApp) isFragNeeded(r *netio.Reply) bool {
+	if app.isIPv6() {
+		return ICMPType(r.ICMPType) == ICMPv6PacketTooBig
+	}
+	return ICMPType(r.ICMPType) == ICMPDestUnreachable && ICMPCode(r.ICMPCode) == FragmentationNeededAndDFSet
+}
+
+func (app *TraceApp) isUnreachable(r *netio.Reply) bool {
+	if app.isIPv6() {
+		return ICMPType(r.ICMPType) == ICMPv6DestUnreachable
+	}
+	return ICMPType(r.ICMPType) == ICMPDestUnreachable
+}
+
+// 处理发送和接收的包
+func (app *TraceApp) match() {
+	for {
+		select {
+		case <-app.ctx.Done():
+			logrus.Errorf("exit match goroutine.")
+			return
+		case v := <-app.SendChan:
+			app.storeSent(v)
+
+		case v := <-app.RecvChan:
+			logrus.Infof("Recv traceroute data: %+v", v)
+			// 已应答的探测从缓存中取出，与超时检查竞争时只有取到的一方计数
+			s, ok := app.matchCache.Cache.LoadAndDelete(v.ID)
+			if !ok {
+				// 应答可能先于探测的记录被取出
+				app.drainSent()
+				s, ok = app.matchCache.Cache.LoadAndDelete(v.ID)
+			}
+			if !ok {
+				logrus.Warningf("cache hasn't ID: %d packet.", v.ID)
+				continue
+			}
+			sent := s.(*ds.SendPacket)
+			if sent.Track {
+				app.trackReply(uint16(sent.ID), v)
+			}
+			// 需要分片的应答来自上一跳的路由器，不计入本跳
+			if sent.Dst != nil || v.FragNeeded {
+				continue
+			}
+			if app.ResMap[sent.TTL] == nil {
+				app.ResMap[sent.TTL] = make(map[string]*ds.ProbeResponse)
+				util.SortInsertUint8(&app.ResTTL, sent.TTL)
+			}
+			pr, ok := app.ResMap[sent.TTL][v.ResAddr]
+			if !ok {
+				pr = ds.NewProbeResponse(app.key, app.TaskGeneTs, sent.TTL, v.DstIP, v.ResAddr, v.ID, v.TimeStamp)
+				pr.Domain = app.Domain
+				app.ResMap[sent.TTL][v.ResAddr] = pr
+			}
+			if v.Reached {
+				atomic.StoreUint32(&app.Reached, 1)
+			}
+			if v.Unreachable != "" {
+				app.flowLock.Lock()
+				app.unreachable[v.ResAddr] = v.Unreachable
+				app.flowLock.Unlock()
+			}
+			pr.Lock.Lock()
+			latency := float64(v.TimeStamp-sent.TimeStamp) / 1000 // 单位 ms
+			pr.Latency.Append(latency, 4)
+			if len(app.payloads) > 0 && sent.Payload > 0 {
+				app.appendSizeLatency(pr, sent.Payload, v.TimeStamp-sent.TimeStamp)
+			}
+			if len(v.MPLS) > 0 {
+				pr.MPLS = v.MPLS
+			}
+			if len(v.Interfaces) > 0 {
+				pr.Interfaces = v.Interfaces
+			}
+			pr.ReplyTTL = v.TTL
+			pr.QuotedTTL = v.QuotedTTL
+			if v.Unreachable != "" {
+				pr.Unreachable = v.Unreachable
+			}
+			pr.Lock.Unlock()
+
+			app.ResFlowIDLock.Lock()
+			app.ResFlowIDMap[v.ResAddr] = uint32(sent.FlowID)
+			app.ResFlowIDLock.Unlock()
+
+			app.recordFlow(sent.TTL, sent.FlowID, v.ResAddr)
+		}
+
+	}
+}
+
+func (app *TraceApp) GracefulClose(d time.Duration) {
+	app.closeOnce.Do(func() {
+		atomic.StoreUint32(&app.Exit, 1)
+		app.matchCache.Close()
+		app.cancel()
+		app.lease.Release()
+		if app.pcap != nil {
+			if err := app.pcap.Close(); err != nil {
+				logrus.Errorf("close pcap of %s error: %v", app.Domain, err)
+			}
+		}
+		close(app.done)
+	})
+}
+
+// Cancel 提前结束任务
+func (app *TraceApp) Cancel() {
+	app.GracefulClose(0)
+}
+
+// Done 任务结束后关闭
+func (app *TraceApp) Done() <-chan struct{} {
+	return app.done
+}
+
+// Summary 任务的整条路径汇总，Name 由上报方填写
+func (app *TraceApp) Summary() *cds.TraceSummary {
+	s := &cds.TraceSummary{
+		Domain:    app.Domain,
+		DstIP:     app.DstAddr.String(),
+		Session:   app.key,
+		Mode:      app.mode,
+		TimeStamp: app.TaskGeneTs,
+	}
+	s.Termination, s.LastTTL = app.termination, app.lastTTL
+	if app.doubletree && app.mode == ModeSimple {
+		s.StartTTL = app.startTTL
+	}
+	if app.mode == ModePMTU {
+		s.PMTU, s.MTUDrops = app.pmtuSize, app.mtuDrops
+	}
+	if app.mode == ModeSimple && len(app.dscp) > 0 {
+		s.DSCP = app.dscpTraces()
+	}
+	if app.mode != ModeSimple {
+		s.Diamonds = app.diamonds()
+	}
+	app.flowLock.RLock()
+	s.Aliases = app.aliases
+	app.flowLock.RUnlock()
+	return s
+}
+
+// Results 任务的逐跳结果，按 TTL 升序，同一 TTL 内按应答地址排序。
+// 探测过但没有任何应答的跳记为应答地址为 "*" 的一条记录
+func (app *TraceApp) Results() []*ds.ProbeResponse {
+	var res []*ds.ProbeResponse
+	last := int(app.maxTTL)
+	if app.dstTTL != 0 {
+		last = int(app.dstTTL)
+	}
+	for ttl := 1; ttl <= last; ttl++ {
+		m := app.ResMap[ttl]
+		if len(m) == 0 {
+			if app.probedTTL[ttl] {
+				pr := ds.NewProbeResponse(app.key, app.TaskGeneTs, uint8(ttl), app.DstAddr.String(), starAddr, 0, 0)
+				pr.Domain = app.Domain
+				app.fillLoss(pr)
+				res = append(res, pr)
+			}
+			continue
+		}
+		addrs := make([]string, 0, len(m))
+		for k := range m {
+			addrs = append(addrs, k)
+		}
+		sort.Strings(addrs)
+		for _, k := range addrs {
+			app.fillLoss(m[k])
+			if app.mode == ModePMTU {
+				m[k].Lock.Lock()
+				m[k].PMTU = app.hopMTU[ttl]
+				m[k].Lock.Unlock()
+			}
+			if app.mode != ModeSimple {
+				m[k].Lock.Lock()
+				m[k].Confidence = app.hopConf[ttl]
+				m[k].Fallback = app.hopFallback[ttl]
+				if c, ok := app.lb[uint8(ttl)][k]; ok {
+					m[k].LoadBalance = c.Type
+					m[k].LBProbes = c.Probes
+					m[k].LBNextHops = c.NextHops
+				}
+				m[k].Lock.Unlock()
+			}
+			res = append(res, m[k])
+		}
+	}
+	return res
+}
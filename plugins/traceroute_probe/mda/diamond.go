@@ -0,0 +1,127 @@
+package mda
+
+import (
+	cds "mda-traceroute-go/dataStruct"
+	"sort"
+)
+
+// diamonds 根据 MDA 得到的相邻两跳连接关系找出所有菱形。
+// 从有多个下一跳的顶点出发逐跳求可达的接口，可达接口收敛为一个时即为汇合点；
+// 已包含在某个菱形内部的顶点不再作为分叉点，嵌套的菱形归入外层。
+func (app *TraceApp) diamonds() []cds.Diamond {
+	var res []cds.Diamond
+	inner := make(map[uint8]map[string]bool)
+	for ttl := uint8(1); ttl < app.maxTTL; ttl++ {
+		succ, _ := app.links(ttl + 1)
+		for _, v := range app.responders(ttl) {
+			if len(succ[v]) < 2 || inner[ttl][v] {
+				continue
+			}
+			d := app.diamondFrom(ttl, v)
+			for i, hop := range d.Hops {
+				t := ttl + uint8(i) + 1
+				if inner[t] == nil {
+					inner[t] = make(map[string]bool)
+				}
+				for _, a := range hop {
+					inner[t][a] = true
+				}
+			}
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// diamondFrom 以第 ttl 跳的顶点 v 为分叉点求菱形
+func (app *TraceApp) diamondFrom(ttl uint8, v string) cds.Diamond {
+	d := cds.Diamond{Divergence: v, DivergenceTTL: ttl}
+	layers := []map[string]bool{{v: true}}
+	meshed := false
+	for t := ttl + 1; t <= app.maxTTL && t > ttl; t++ {
+		succ, pred := app.links(t)
+		next := make(map[string]bool)
+		for a := range layers[len(layers)-1] {
+			for b := range succ[a] {
+				next[b] = true
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		if multiLinked(layers[len(layers)-1], next, succ, pred) {
+			meshed = true
+		}
+		layers = append(layers, next)
+		if len(next) == 1 {
+			for a := range next {
+				d.Convergence = a
+			}
+			d.ConvergenceTTL = t
+			break
+		}
+	}
+
+	// 菱形内部各跳，未汇合时包含最后一跳
+	end := len(layers)
+	if d.Convergence != "" {
+		end--
+	}
+	for _, l := range layers[1:end] {
+		hop := make([]string, 0, len(l))
+		for a := range l {
+			hop = append(hop, a)
+		}
+		sort.Strings(hop)
+		d.Hops = append(d.Hops, hop)
+		if d.MinWidth == 0 || len(hop) < d.MinWidth {
+			d.MinWidth = len(hop)
+		}
+		if len(hop) > d.MaxWidth {
+			d.MaxWidth = len(hop)
+		}
+	}
+	d.Meshed = meshed
+
+	d.MaxLength = len(layers) - 1
+	d.MinLength = d.MaxLength
+	if d.Convergence != "" {
+		// 汇合点的接口在更早的跳已经出现，说明有更短的路径
+		for i, l := range layers[1:] {
+			if l[d.Convergence] {
+				d.MinLength = i + 1
+				break
+			}
+		}
+	}
+	d.Asymmetric = d.MinLength != d.MaxLength
+	return d
+}
+
+// multiLinked 相邻两跳 cur、next 之间是否同时存在有多个下一跳和有多个上一跳的接口
+func multiLinked(cur, next map[string]bool, succ, pred map[string]map[string]bool) bool {
+	multiSucc, multiPred := false, false
+	for a := range cur {
+		n := 0
+		for b := range succ[a] {
+			if next[b] {
+				n++
+			}
+		}
+		if n > 1 {
+			multiSucc = true
+		}
+	}
+	for b := range next {
+		n := 0
+		for a := range pred[b] {
+			if cur[a] {
+				n++
+			}
+		}
+		if n > 1 {
+			multiPred = true
+		}
+	}
+	return multiSucc && multiPred
+}
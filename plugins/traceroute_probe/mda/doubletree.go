@@ -0,0 +1,102 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	cds "mda-traceroute-go/dataStruct"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultStartTTL Doubletree 开始探测的中间跳的默认值
+const DefaultStartTTL = 8
+
+// StopSet Doubletree 的停止集合。本地停止集合保存探测节点在以往任务中见过的靠近源端的接口，
+// 由各任务共享；全局停止集合由控制节点随任务下发，保存其他探测节点到同一目的地址的路径上的接口
+type StopSet struct {
+	lock  sync.RWMutex
+	addrs map[string]bool
+}
+
+func NewStopSet(addrs ...string) *StopSet {
+	s := &StopSet{addrs: make(map[string]bool, len(addrs))}
+	s.Add(addrs...)
+	return s
+}
+
+// Add 加入接口地址，忽略代表超时的 starAddr
+func (s *StopSet) Add(addrs ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, a := range addrs {
+		if a != starAddr {
+			s.addrs[a] = true
+		}
+	}
+}
+
+func (s *StopSet) Contains(addr string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.addrs[addr]
+}
+
+func (s *StopSet) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.addrs)
+}
+
+// covers 该跳除超时外的应答地址都在集合中，且至少有一个应答，集合为 nil 时返回 false
+func (s *StopSet) covers(vertices []string) bool {
+	if s == nil {
+		return false
+	}
+	found := false
+	for _, v := range vertices {
+		if v == starAddr {
+			continue
+		}
+		if !s.Contains(v) {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// doubletreeHops 从中间跳 startTTL 开始先向目的端探测，遇到全局停止集合中的接口即停止；
+// 再从 startTTL-1 向源端探测，该跳的接口都在本地停止集合中时停止，更靠近源端的跳已在以往任务中探测过。
+// 向源端探测时见到的新接口加入本地停止集合。目的端比 startTTL 更近时，向源端探测的前几跳仍由目的端应答，
+// 目的端只记在其应答的最小 TTL，之后的跳不计入路径
+func (app *TraceApp) doubletreeHops(hop func(ttl uint8) (float64, []string)) {
+	start := app.startTTL
+	if start > app.maxTTL {
+		start = app.maxTTL
+	}
+	app.forwardHops(start, hop)
+
+	dst := app.DstAddr.String()
+	var near []string
+	stop := uint8(0)
+	for ttl := start - 1; ttl >= 1; ttl-- {
+		if atomic.LoadUint32(&app.Exit) == 1 {
+			return
+		}
+		cur := app.probeHop(ttl, hop)
+		if reachedOnly(cur, dst) {
+			app.dstTTL, app.lastTTL = ttl, ttl
+			app.termination = cds.TermReached
+			continue
+		}
+		if app.localStop.covers(cur) {
+			stop = ttl
+			break
+		}
+		near = append(near, cur...)
+	}
+	if app.localStop != nil {
+		app.localStop.Add(near...)
+	}
+	logrus.Infof("doubletree: %s start at ttl %d, backward stop at ttl %d, %d near-source interfaces.",
+		app.Domain, start, stop, len(distinct(near)))
+}
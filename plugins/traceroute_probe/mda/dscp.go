@@ -0,0 +1,154 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	cds "mda-traceroute-go/dataStruct"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"sort"
+)
+
+// dscpHopResult 用某个 DSCP 值在一跳上得到的结果
+type dscpHopResult struct {
+	addrs  []string
+	rttSum float64 // 单位 ms
+	rttCnt int
+	quoted int    // 差错报文引用的 DSCP，没有引用时为 -1
+	quoter string // 返回该引用的路由器
+}
+
+// dscpHop 在第 ttl 跳对每个 DSCP 值用同一条流各发送 FirstSendCnt 个探测，流标识相同，
+// 使各 DSCP 值的路径差异只来自按 DSCP 的路由，返回所有 DSCP 值看到的应答地址
+func (app *TraceApp) dscpHop(ttl uint8) (float64, []string) {
+	cnt := app.firstSendCnt()
+	probes := make([]*ds.SendPacket, 0, cnt*len(app.dscp))
+	for _, d := range app.dscp {
+		for i := 0; i < cnt; i++ {
+			probes = append(probes, &ds.SendPacket{TTL: ttl, TOS: d << 2})
+		}
+	}
+	replies := app.probeReplies(probes)
+
+	set := make(map[string]bool)
+	var addrs []string
+	app.flowLock.Lock()
+	defer app.flowLock.Unlock()
+	for i, d := range app.dscp {
+		res := &dscpHopResult{quoted: -1}
+		seen := make(map[string]bool)
+		for j := i * cnt; j < (i+1)*cnt; j++ {
+			a := starAddr
+			if v := replies[j]; v != nil {
+				a = v.ResAddr
+				res.rttSum += float64(v.TimeStamp-probes[j].TimeStamp) / 1000
+				res.rttCnt++
+				if v.Quoted && res.quoted < 0 {
+					// 只比较 DSCP，ECN 位可能被路由器合法地修改
+					res.quoted, res.quoter = int(v.QuotedTOS>>2), v.ResAddr
+				}
+			}
+			if !seen[a] {
+				seen[a] = true
+				res.addrs = append(res.addrs, a)
+			}
+			if !set[a] {
+				set[a] = true
+				addrs = append(addrs, a)
+			}
+		}
+		sort.Strings(res.addrs)
+		if app.dscpHops[d] == nil {
+			app.dscpHops[d] = make([]*dscpHopResult, 256)
+		}
+		app.dscpHops[d][ttl] = res
+	}
+	sort.Strings(addrs)
+	return 0, addrs
+}
+
+// dscpTraces 汇总各 DSCP 值的路径，与第一个 DSCP 值比较路径是否相同，并找出 TOS 被改写的位置
+func (app *TraceApp) dscpTraces() []cds.DSCPTrace {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	last := uint8(0)
+	for ttl := 1; ttl < len(app.probedTTL); ttl++ {
+		if app.probedTTL[ttl] {
+			last = uint8(ttl)
+		}
+	}
+	traces := make([]cds.DSCPTrace, 0, len(app.dscp))
+	for _, d := range app.dscp {
+		t := cds.DSCPTrace{
+			DSCP:    d,
+			Hops:    make([][]string, last),
+			Latency: make([]float64, last),
+		}
+		cur := d
+		for ttl := uint8(1); ttl <= last; ttl++ {
+			var res *dscpHopResult
+			if app.dscpHops[d] != nil {
+				res = app.dscpHops[d][ttl]
+			}
+			if res == nil {
+				continue
+			}
+			t.Hops[ttl-1] = res.addrs
+			if res.rttCnt > 0 {
+				t.Latency[ttl-1] = res.rttSum / float64(res.rttCnt)
+			}
+			// 引用的头部是探测到达该跳时的样子，与上一次看到的值不同说明在该跳或之前被改写
+			if res.quoted >= 0 && res.quoted != cur {
+				t.Remarks = append(t.Remarks, cds.DSCPRemark{TTL: ttl, Router: res.quoter, From: cur, To: res.quoted})
+				cur = res.quoted
+			}
+		}
+		traces = append(traces, t)
+	}
+	for i := 1; i < len(traces); i++ {
+		traces[i].DivergeTTL = divergeTTL(traces[0].Hops, traces[i].Hops)
+	}
+	return traces
+}
+
+// divergeTTL 两条路径第一个应答地址不同的跳，都超时的跳不参与比较，路径相同时返回 0
+func divergeTTL(base, hops [][]string) uint8 {
+	for i := range base {
+		if i >= len(hops) {
+			break
+		}
+		if isStarHop(base[i]) || isStarHop(hops[i]) {
+			continue
+		}
+		if !sameAddrs(base[i], hops[i]) {
+			return uint8(i + 1)
+		}
+	}
+	return 0
+}
+
+// sameAddrs 两个已排序的地址列表是否相同
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isStarHop 该跳的探测是否全部超时或未探测
+func isStarHop(addrs []string) bool {
+	return len(addrs) == 0 || len(addrs) == 1 && addrs[0] == starAddr
+}
+
+// logDSCP 简单模式以外的模式不做 DSCP 扫描和负载长度扫描，二者同时设置时只做 DSCP 扫描
+func (app *TraceApp) logDSCP() {
+	if len(app.dscp) > 0 && app.mode != ModeSimple {
+		logrus.Infof("%s: dscp sweep only applies to simple mode, ignore %v.", app.mode, app.dscp)
+	}
+	if len(app.payloads) > 0 && (app.mode != ModeSimple || len(app.dscp) > 0) {
+		logrus.Infof("%s: payload sweep only applies to simple mode without dscp sweep, ignore %v.", app.mode, app.payloads)
+	}
+}
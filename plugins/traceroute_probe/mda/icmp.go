@@ -2,18 +2,12 @@ package mda
 
 import (
 	"bytes"
-	"context"
 	"encoding/binary"
-	"github.com/sirupsen/logrus"
-	"golang.org/x/net/ipv4"
-	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"fmt"
+	cds "mda-traceroute-go/dataStruct"
+	"mda-traceroute-go/plugins/traceroute_probe/netio"
 	"mda-traceroute-go/plugins/traceroute_probe/utils"
-	"mda-traceroute-go/util"
 	"net"
-	"strconv"
-	"sync"
-	"sync/atomic"
-	"time"
 )
 
 type ICMPType uint8
@@ -48,6 +42,16 @@ var (
 	ICMPExperimentalMobilityProtocols ICMPType = 41
 )
 
+// ICMPv6 的类型字段种类
+var (
+	ICMPv6DestUnreachable ICMPType = 1
+	ICMPv6PacketTooBig    ICMPType = 2
+	ICMPv6TimeExceeded    ICMPType = 3
+	ICMPv6ParamProblem    ICMPType = 4
+	ICMPv6EchoRequest     ICMPType = 128
+	ICMPv6EchoReply       ICMPType = 129
+)
+
 // ICMPHeader ICMP头部字段
 type ICMPHeader struct {
 	IType    ICMPType
@@ -60,13 +64,24 @@ type ICMPHeader struct {
 // ICMPCode ICMP的code字段
 type ICMPCode uint8
 
-// 终点不可达即 icmpType=3时，code字段有5种情况
+// 终点不可达即 icmpType=3时，code字段有16种情况（RFC 792、RFC 1122、RFC 1812）
 /*
    0 = net unreachable;
    1 = host unreachable;
    2 = protocol unreachable;
    3 = port unreachable;
-   4 = fragmentation needed and DF set.
+   4 = fragmentation needed and DF set;
+   5 = source route failed;
+   6 = destination network unknown;
+   7 = destination host unknown;
+   8 = source host isolated;
+   9 = network administratively prohibited;
+   10 = host administratively prohibited;
+   11 = network unreachable for TOS;
+   12 = host unreachable for TOS;
+   13 = communication administratively prohibited;
+   14 = host precedence violation;
+   15 = precedence cutoff in effect.
 */
 var (
 	NetUnreachable              ICMPCode = 0
@@ -74,340 +89,152 @@ var (
 	ProtocolUnreachable         ICMPCode = 2
 	PortUnreachable             ICMPCode = 3
 	FragmentationNeededAndDFSet ICMPCode = 4
+	SourceRouteFailed           ICMPCode = 5
+	DestNetUnknown              ICMPCode = 6
+	DestHostUnknown             ICMPCode = 7
+	SourceHostIsolated          ICMPCode = 8
+	NetAdminProhibited          ICMPCode = 9
+	HostAdminProhibited         ICMPCode = 10
+	NetUnreachableForTOS        ICMPCode = 11
+	HostUnreachableForTOS       ICMPCode = 12
+	CommAdminProhibited         ICMPCode = 13
+	HostPrecedenceViolation     ICMPCode = 14
+	PrecedenceCutoff            ICMPCode = 15
 )
 
-type ICMPApp struct {
-	key     string
-	srcAddr net.IP
-	DstAddr net.IP
-	maxTTL  uint8
-
-	matchCache    *MatchCache
-	RecvConn      *net.IPConn
-	ResMap        []map[string]*ds.ProbeResponse
-	ResTTL        []uint8           // 排序插入
-	ResFlowIDMap  map[string]uint32 //记录探测到某端口用的流标签
-	ResFlowIDLock sync.RWMutex
-
-	SendChan chan *ds.SendPacket
-	RecvChan chan *ds.RecvPacket
-
-	simple bool
-
-	TaskGeneTs int64
-	TaskEndTs  int64
-
-	Exit      uint32 // 0 means not exit
-	ExcepFlag uint32
-	ctx       context.Context
-	cancel    context.CancelFunc
-}
-
-func NewICMPApp(hash string, dstAddr net.IP, srcAddr net.IP, maxTTL uint8, simple bool, taskGeneTs int64) *ICMPApp {
-
-	cacheConf := utils.ConfigData.MatchCacheConf
-	matchCache := NewMatchCache(hash, cacheConf.Timeout, cacheConf.CheckFreq)
-
-	ctx, cancel := context.WithCancel(context.Background())
-	go matchCache.Cache.RunCheck()
-	return &ICMPApp{
-		key:          hash,
-		srcAddr:      srcAddr,
-		DstAddr:      dstAddr,
-		maxTTL:       maxTTL,
-		matchCache:   matchCache,
-		ResMap:       make([]map[string]*ds.ProbeResponse, 256),
-		ResTTL:       make([]uint8, 256),
-		ResFlowIDMap: make(map[string]uint32, 256),
-		SendChan:     make(chan *ds.SendPacket, 10),
-		RecvChan:     make(chan *ds.RecvPacket, 10),
-		simple:       simple,
-		TaskGeneTs:   taskGeneTs,
-		Exit:         0,
-		ExcepFlag:    0,
-		ctx:          ctx,
-		cancel:       cancel,
-	}
-}
-
-func (app *ICMPApp) Start() {
-	go app.ListenFor()
-	go app.SendPacket()
-	go app.match()
-
-	if app.simple {
-		// 简单地探测，未进行多路径探测
-	} else { // mda
-		time.Sleep(20 * time.Second)
-		app.mda()
-	}
+// ICMPv6 终点不可达的 code 字段
+var (
+	ICMPv6NoRoute            ICMPCode = 0
+	ICMPv6AdminProhibited    ICMPCode = 1
+	ICMPv6BeyondScope        ICMPCode = 2
+	ICMPv6AddressUnreachable ICMPCode = 3
+	ICMPv6PortUnreachable    ICMPCode = 4
+	ICMPv6SourcePolicyFailed ICMPCode = 5
+	ICMPv6RejectRoute        ICMPCode = 6
+)
 
-	// 检查是否在运行
-	for {
-		after := time.After(10 * time.Second)
-		select {
-		case <-after:
-			if app.matchCache.Cache.Len() == 0 {
-				app.GracefulClose(1)
-				return
-			}
+// unreachableMark 目的不可达 code 对应的标记，见 cds.Mark*
+func unreachableMark(ipv6 bool, c ICMPCode) string {
+	if ipv6 {
+		switch c {
+		case ICMPv6NoRoute:
+			return cds.MarkNet
+		case ICMPv6AddressUnreachable:
+			return cds.MarkHost
+		case ICMPv6BeyondScope:
+			return cds.MarkSourceRoute
+		case ICMPv6AdminProhibited, ICMPv6SourcePolicyFailed, ICMPv6RejectRoute:
+			return cds.MarkAdmin
 		}
-	}
+		return fmt.Sprintf("!%d", c)
+	}
+	switch c {
+	case NetUnreachable, DestNetUnknown, NetUnreachableForTOS:
+		return cds.MarkNet
+	case HostUnreachable, DestHostUnknown, SourceHostIsolated, HostUnreachableForTOS:
+		return cds.MarkHost
+	case ProtocolUnreachable:
+		return cds.MarkProto
+	case FragmentationNeededAndDFSet:
+		return cds.MarkFrag
+	case SourceRouteFailed:
+		return cds.MarkSourceRoute
+	case NetAdminProhibited, HostAdminProhibited, CommAdminProhibited:
+		return cds.MarkAdmin
+	case HostPrecedenceViolation:
+		return cds.MarkPrecedence
+	case PrecedenceCutoff:
+		return cds.MarkCutoff
+	}
+	return fmt.Sprintf("!%d", c)
 }
 
-// SendPacket 构建ICMP报文并发送
-func (app *ICMPApp) SendPacket() {
-	logrus.Infof("Start send ICMP Datagram. netSrcAddr: %v", app.srcAddr)
-
-	conn, err := net.ListenPacket("ip4:icmp", app.srcAddr.String())
-	if err != nil {
-		logrus.Fatal(err)
-	}
-	defer conn.Close()
-
-	rSocket, err := ipv4.NewRawConn(conn)
-	if err != nil {
-		logrus.Fatal("Can't create raw socket, ", err)
-	}
-	id := uint16(1)
-	mod := uint16(1 << 15)
-
-	cnt := uint(0)
-	for {
-		for ttl := 1; ttl <= int(app.maxTTL); ttl++ {
-			hdr, payload := app.buildICMP(uint8(ttl), id, id, 0)
-			_ = rSocket.WriteTo(hdr, payload, nil)
-			report := &ds.SendPacket{
-				Key:       app.key,
-				ID:        uint32(hdr.ID),
-				TTL:       uint8(ttl),
-				TimeStamp: time.Now().UnixMicro(),
-			}
-			app.SendChan <- report
-			id = (id + 1) % mod
-		}
-		cnt++
+const (
+	icmpHeaderLen  = 8
+	icmpPayloadLen = 32
+)
 
-		//if cnt >= 6 {
-		if cnt >= utils.ConfigData.FirstSendCnt {
-			break
-		}
-		time.Sleep(time.Microsecond * time.Duration(1000000/utils.ConfigData.PacketRate))
-	}
+type ICMPApp struct {
+	*TraceApp
 }
 
-func (app *ICMPApp) ListenFor() {
-	logrus.Info("Start Listen ICMP Datagram and receive.")
-	localAddr := &net.IPAddr{IP: app.srcAddr}
-	var err error
-	app.RecvConn, err = net.ListenIP("ip4:icmp", localAddr)
+func NewICMPApp(conf *ProberConf) (*ICMPApp, error) {
+	base, err := newTraceApp(conf, ProtocolICMP)
 	if err != nil {
-		logrus.Fatal("ListenIP failure: ", err)
-	}
-	for {
-		if atomic.LoadUint32(&app.Exit) == 1 {
-			return
-		}
-
-		buf := make([]byte, 1500)
-		n, recvAddr, err := app.RecvConn.ReadFrom(buf)
-		if err != nil {
-			logrus.Fatal(err)
-			break
-		}
-
-		icmpType := ICMPType(buf[0])
-		code := ICMPCode(buf[1])
-
-		if (icmpType == ICMPTimeExceeded ||
-			(icmpType == ICMPDestUnreachable && code == PortUnreachable)) && (n >= 36) {
-			id := binary.BigEndian.Uint16(buf[32:34])
-
-			dstIP := net.IP(buf[24:28])
-			srcIP := net.IP(buf[20:24])
-
-			if dstIP.Equal(app.DstAddr) {
-				key := utils.GetHash(srcIP, dstIP, 65535, 65535, 1)
-				m := &ds.RecvPacket{
-					Key:       key,
-					ID:        uint32(id),
-					DstIP:     string(app.DstAddr),
-					ResAddr:   recvAddr.String(),
-					TimeStamp: time.Now().UnixMicro(),
-				}
-				app.RecvChan <- m
-			}
-		} else {
-			logrus.Warningf("receive packet icmpType: %d, icmpCode: %d. \n", icmpType, code)
-		}
+		return nil, err
 	}
+	app := &ICMPApp{TraceApp: base}
+	app.engine = app
+	return app, nil
 }
 
-// 处理发送和接收的包
-func (app *ICMPApp) match() {
-	for {
-		select {
-		case <-app.ctx.Done():
-			logrus.Errorf("exit match goroutine.")
-			return
-		case v := <-app.SendChan:
-			app.matchCache.Cache.Store(v.ID, v, time.UnixMicro(v.TimeStamp))
-
-		case v := <-app.RecvChan:
-			logrus.Infof("Recv traceroute data: %+v", v)
-			s, ok := app.matchCache.Cache.Load(v.ID)
-			if !ok {
-				logrus.Warningf("cache hasn't ID: %d packet.", v.ID)
-				continue
-			}
-			sent := s.(*ds.SendPacket)
-			util.SortInsertUint8(&app.ResTTL, sent.TTL)
-			pr, ok := app.ResMap[sent.TTL][v.ResAddr]
-			if !ok {
-				pr = ds.NewProbeResponse(app.key, app.TaskGeneTs, sent.TTL, v.DstIP, v.ResAddr, v.ID, v.TimeStamp)
-				app.ResMap[sent.TTL][v.ResAddr] = pr
-			}
-			pr.Lock.Lock()
-			pr.Latency.Cnt++
-			latency := float64((v.TimeStamp - sent.TimeStamp) / 1000) // 单位 ms
-			pr.Latency.Append(latency, 4)
-			pr.Lock.Unlock()
-
-			app.ResFlowIDLock.Lock()
-			app.ResFlowIDMap[v.ResAddr] = v.ID
-			app.ResFlowIDLock.Unlock()
-
-			// 为 isPerFlow 服务
-			hash := string(sent.TTL) + ":" + strconv.Itoa(int(v.ID))
-			app.matchCache.FlowIDCache.Store(hash, v.ResAddr, time.Now())
-		}
+func (app *ICMPApp) buildTransport(dst net.IP, flowID uint16, id uint16, size int) []byte {
+	return app.buildICMP(dst, flowID, id, id, size)
+}
 
+func (app *ICMPApp) protocol() int {
+	if app.isIPv6() {
+		return 58
 	}
+	return 1
 }
 
-func (app *ICMPApp) buildICMP(ttl uint8, id, seq uint16, tos int) (*ipv4.Header, []byte) {
-	hdr := &ipv4.Header{
-		Version:  ipv4.Version,
-		TOS:      tos,
-		Len:      ipv4.HeaderLen,
-		TotalLen: 40,
-		ID:       int(id),
-		Flags:    0,
-		FragOff:  0,
-		TTL:      int(ttl),
-		Protocol: 1,
-		Checksum: 0,
-		Src:      app.srcAddr,
-		Dst:      app.DstAddr,
+// acceptDirect 目的端（或本任务探测过的其他地址）的回显应答，序列号即探测标识
+func (app *ICMPApp) acceptDirect(r *netio.Reply) bool {
+	if !app.ownsDst(r.Src) || r.IsError() {
+		return false
 	}
-	h, err := hdr.Marshal()
-	if err != nil {
-		logrus.Fatal(err)
+	if app.isIPv6() {
+		return r.Proto == netio.ProtoICMPv6 && ICMPType(r.ICMPType) == ICMPv6EchoReply
 	}
+	return r.Proto == netio.ProtoICMP && ICMPType(r.ICMPType) == ICMPEchoReply
+}
 
-	hdr.Checksum = int(utils.CheckSum(h))
-
+// buildICMP 构造回显请求。Paris traceroute 要求同一条流的 ICMP 头部前 4 字节不变，
+// 因此校验和固定由流标识决定，标识符和序列号承载探测标识，负载前两个字节用于抵消二者的变化。
+func (app *ICMPApp) buildICMP(dst net.IP, flowID uint16, id, seq uint16, size int) []byte {
+	icmpType := ICMPEchoRequest
+	if app.isIPv6() {
+		icmpType = ICMPv6EchoRequest
+	}
 	icmp := ICMPHeader{
-		IType:    ICMPEchoRequest,
+		IType:    icmpType,
 		ICode:    0,
-		Checksum: util.If(app.simple, 0, id).(uint16),
+		Checksum: 0,
 		ID:       id,
 		Seq:      seq,
 	}
 
-	payload := make([]byte, 32)
-	for i := 0; i < 32; i++ {
+	// 负载前两个字节留作校验和调整位
+	payloadLen := icmpPayloadLen
+	if size > 0 {
+		payloadLen = size - icmpHeaderLen
+		if payloadLen < 2 {
+			payloadLen = 2
+		}
+	}
+	payload := make([]byte, payloadLen)
+	for i := 2; i < payloadLen; i++ {
 		payload[i] = uint8(i + 64)
 	}
 
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, &icmp)
 	binary.Write(&buf, binary.BigEndian, &payload)
-	return hdr, buf.Bytes()
-}
-
-//func (app *ICMPApp) forgeCheckSum(id uint16) uint16 {
-//    checkSum := []byte("\x00\x00")
-//
-//    checkSum[0] = byte((id >> 8) & 0xff)
-//    checkSum[1] = byte(id & 0xff)
-//
-//    val := binary.BigEndian.Uint16(checkSum)
-//    return val
-//}
+	b := buf.Bytes()
 
-func (app *ICMPApp) GracefulClose(d time.Duration) {
-	atomic.StoreUint32(&app.Exit, 1)
-	app.matchCache.Close()
-	app.cancel()
-}
-
-func (app *ICMPApp) mda() {
-	ttl := uint8(1)
-	mapLen := len(app.ResTTL)
-	for ; ttl < app.ResTTL[mapLen-1]; ttl++ {
-		if len(app.ResMap[ttl]) <= 1 {
-			continue
-		} else { // 从ttl-1开始探测
-			for k, _ := range app.ResMap[ttl-1] {
-				app.nextHops(k, ttl)
-				if app.isPerFlow(ttl) { // 说明k接口对应的网络有基于流的负载均衡
-					app.nextHops(k, ttl)
-				} else { // 碰到非基于流的负载均衡，就退出
-					return
-				}
-			}
-		}
+	// ICMPv6 的校验和包含伪首部
+	sum := utils.Sum16(b)
+	if app.isIPv6() {
+		sum = utils.Sum16(append(app.pseudoHeader(dst, 58, len(b)), b...))
 	}
+	want := icmpFlowCheckSum(flowID)
+	binary.BigEndian.PutUint16(b[8:10], utils.ForgeCheckSum(sum, want))
+	binary.BigEndian.PutUint16(b[2:4], want)
+	return b
 }
 
-// 先判断addr接口对应的网络是否有基于流的负载均衡，有的话采用和adder一样的流标签，获取addr对应网络的所有下一条端口
-func (app *ICMPApp) nextHops(addr string, ttl uint8) {
-	app.ResFlowIDLock.RLock()
-	id := app.ResFlowIDMap[addr]
-	app.ResFlowIDLock.RUnlock()
-
-	app.sendICMPWithTTLAndId(ttl, uint16(id))
-}
-
-// 判断 addr 所在路由器的负载均衡是否是基于流的
-func (app *ICMPApp) isPerFlow(ttl uint8) bool {
-	app.sendICMPWithTTLAndId(ttl, 333)
-
-	time.Sleep(time.Duration(float64(utils.ConfigData.Timeout) + 6*utils.ConfigData.PacketRate))
-
-	repeat := app.matchCache.FlowIDCache.Repeat
-	if repeat {
-		app.matchCache.FlowIDCache.Repeat = false
-	}
-	return !repeat
-}
-
-// 指定ttl和id发送ICMP报文
-func (app *ICMPApp) sendICMPWithTTLAndId(ttl uint8, id uint16) {
-	conn, err := net.ListenPacket("ip4:icmp", app.srcAddr.String())
-	if err != nil {
-		logrus.Fatal(err)
-	}
-	defer conn.Close()
-	rSocket, err := ipv4.NewRawConn(conn)
-	if err != nil {
-		logrus.Fatal("Can't create raw socket, ", err)
-	}
-
-	mod := uint16(1 << 15)
-	id = id % mod
-	for {
-		hdr, payload := app.buildICMP(ttl, id, id, 0)
-		_ = rSocket.WriteTo(hdr, payload, nil)
-		report := &ds.SendPacket{
-			Key:       app.key,
-			ID:        uint32(hdr.ID),
-			TTL:       ttl,
-			TimeStamp: time.Now().UnixMicro(),
-		}
-		app.SendChan <- report
-
-		time.Sleep(time.Microsecond * time.Duration(1000000/utils.ConfigData.PacketRate))
-	}
+// icmpFlowCheckSum 流标识到 ICMP 校验和的映射
+func icmpFlowCheckSum(flowID uint16) uint16 {
+	return 0xffff - flowID
 }
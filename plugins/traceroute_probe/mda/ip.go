@@ -0,0 +1,153 @@
+package mda
+
+import (
+	"encoding/binary"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"net"
+	"time"
+)
+
+// isIPv6 目的地址是否为 IPv6
+func (app *TraceApp) isIPv6() bool {
+	return app.DstAddr.To4() == nil
+}
+
+// buildIPv4Header 构造探测包的 IPv4 头部，payloadLen 为传输层头部及负载的总长度
+func (app *TraceApp) buildIPv4Header(dst net.IP, ttl uint8, id uint16, proto int, payloadLen int, tos int, flags ipv4.HeaderFlags) *ipv4.Header {
+	hdr := &ipv4.Header{
+		Version:  ipv4.Version,
+		TOS:      tos,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + payloadLen,
+		ID:       int(id),
+		Flags:    flags,
+		FragOff:  0,
+		TTL:      int(ttl),
+		Protocol: proto,
+		Checksum: 0,
+		Src:      app.srcAddr,
+		Dst:      dst,
+	}
+	h, err := hdr.Marshal()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+
+	hdr.Checksum = int(utils.CheckSum(h))
+	return hdr
+}
+
+// buildIPv6Header 构造探测包的 IPv6 头部。流标签与流标识一一对应，
+// 使按流标签做负载均衡的路由器同样把同一条流放在同一条路径上。
+func (app *TraceApp) buildIPv6Header(dst net.IP, hopLimit uint8, flowID uint16, proto int, payloadLen int, tc int) []byte {
+	h := make([]byte, ipv6.HeaderLen)
+	flowLabel := uint32(flowID) & 0xfffff
+	binary.BigEndian.PutUint32(h[0:4], uint32(ipv6.Version)<<28|uint32(tc&0xff)<<20|flowLabel)
+	binary.BigEndian.PutUint16(h[4:6], uint16(payloadLen))
+	h[6] = uint8(proto)
+	h[7] = hopLimit
+	copy(h[8:24], app.srcAddr.To16())
+	copy(h[24:40], dst.To16())
+	return h
+}
+
+// pseudoHeader 构造计算传输层校验和所需的伪首部
+func (app *TraceApp) pseudoHeader(dst net.IP, proto int, length int) []byte {
+	if app.isIPv6() {
+		pseudo := make([]byte, 40)
+		copy(pseudo[0:16], app.srcAddr.To16())
+		copy(pseudo[16:32], dst.To16())
+		binary.BigEndian.PutUint32(pseudo[32:36], uint32(length))
+		pseudo[39] = uint8(proto)
+		return pseudo
+	}
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:4], app.srcAddr.To4())
+	copy(pseudo[4:8], dst.To4())
+	pseudo[9] = uint8(proto)
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(length))
+	return pseudo
+}
+
+// transportHeaderLen 探测包传输层头部的长度
+func (app *TraceApp) transportHeaderLen() int {
+	switch app.Protocol {
+	case ProtocolTCP:
+		return tcpHeaderLen
+	case ProtocolUDP:
+		return udpHeaderLen
+	default:
+		return icmpHeaderLen
+	}
+}
+
+// sendProbe 用流标识 flowID 向任务目的地址发送 TTL 为 ttl 的探测包，返回探测标识
+func (app *TraceApp) sendProbe(ttl uint8, flowID uint16) uint16 {
+	return app.send(&ds.SendPacket{TTL: ttl, FlowID: flowID})
+}
+
+// send 从本任务的标识区间取一个探测标识，按 p 中的参数构造并通过共享收发服务发送探测包，
+// 发送记录交给 match 协程
+func (app *TraceApp) send(p *ds.SendPacket) uint16 {
+	dst := app.DstAddr
+	if p.Dst != nil {
+		dst = p.Dst
+	}
+	id := app.lease.NextID()
+	// p.Size 为整个 IP 报文的长度，否则按负载长度补上传输层头部
+	size := 0
+	if p.Size > 0 {
+		size = p.Size - ipv4.HeaderLen
+		if app.isIPv6() {
+			size = p.Size - ipv6.HeaderLen
+		}
+	} else {
+		if p.Payload == 0 {
+			p.Payload = app.payload
+		}
+		if p.Payload > 0 {
+			size = app.transportHeaderLen() + p.Payload
+		}
+	}
+	transport := app.engine.buildTransport(dst, p.FlowID, id, size)
+	proto := app.engine.protocol()
+	if p.Track {
+		app.track(id)
+	}
+
+	var pkt []byte
+	if app.isIPv6() {
+		pkt = append(app.buildIPv6Header(dst, p.TTL, p.FlowID, proto, len(transport), p.TOS), transport...)
+	} else {
+		var flags ipv4.HeaderFlags
+		if p.DF {
+			flags = ipv4.DontFragment
+		}
+		hdr := app.buildIPv4Header(dst, p.TTL, id, proto, len(transport), p.TOS, flags)
+		h, err := hdr.Marshal()
+		if err != nil {
+			logrus.Errorf("marshal ipv4 header error: %v", err)
+			return id
+		}
+		pkt = append(h, transport...)
+	}
+	err := app.lease.WritePacket(pkt)
+	if err != nil {
+		logrus.Errorf("send probe ttl %d id %d error: %v", p.TTL, id, err)
+	} else {
+		app.capture(time.Now(), pkt)
+	}
+
+	p.Key = app.key
+	p.ID = uint32(id)
+	p.TimeStamp = time.Now().UnixMicro()
+	select {
+	case app.SendChan <- p:
+	case <-app.ctx.Done():
+	}
+	return id
+}
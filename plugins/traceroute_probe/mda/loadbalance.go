@@ -0,0 +1,227 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 负载均衡类型
+const (
+	LBNone           = "none"            // 改变流标识和目的地址都只有一个下一跳
+	LBPerFlow        = "per-flow"        // 下一跳由流标识决定，固定流标识时只有一个下一跳
+	LBPerPacket      = "per-packet"      // 固定流标识时仍有多个下一跳
+	LBPerDestination = "per-destination" // 改变流标识只有一个下一跳，改变目的地址有多个下一跳
+)
+
+// lbAltDsts 检测按目的地址负载均衡时使用的同网段目的地址个数
+const lbAltDsts = 4
+
+// LBClass 某跳顶点的负载均衡类型及判断依据
+type LBClass struct {
+	Type     string
+	Probes   int // 用于判断的探测数
+	NextHops int // 判断探测中看到的不同下一跳个数
+}
+
+// track 登记需要记录应答的探测，应答到达前为 nil
+func (app *TraceApp) track(id uint16) {
+	app.flowLock.Lock()
+	app.tracked[id] = nil
+	app.flowLock.Unlock()
+}
+
+// trackReply 由 match 协程在收到登记过的探测的应答后调用
+func (app *TraceApp) trackReply(id uint16, v *ds.RecvPacket) {
+	app.flowLock.Lock()
+	if _, ok := app.tracked[id]; ok {
+		app.tracked[id] = v
+	}
+	app.flowLock.Unlock()
+}
+
+// probeBatch 发送一组探测并等待应答或超时，按顺序返回各探测的应答地址，超时为 starAddr
+func (app *TraceApp) probeBatch(probes []*ds.SendPacket) []string {
+	res := make([]string, len(probes))
+	for i, v := range app.probeReplies(probes) {
+		res[i] = starAddr
+		if v != nil {
+			res[i] = v.ResAddr
+		}
+	}
+	return res
+}
+
+// probeReplies 按 PacketRate 发送一组探测并等待应答或超时，按顺序返回各探测的应答，超时为 nil
+func (app *TraceApp) probeReplies(probes []*ds.SendPacket) []*ds.RecvPacket {
+	return app.probeRepliesAt(probes, app.sendInterval())
+}
+
+// sendInterval 按 PacketRate 发送相邻两个探测的间隔
+func (app *TraceApp) sendInterval() time.Duration {
+	return time.Microsecond * time.Duration(1000000/utils.ConfigData.PacketRate)
+}
+
+// probeRepliesAt 以 interval 为间隔发送一组探测并等待应答或超时，按顺序返回各探测的应答，超时为 nil
+func (app *TraceApp) probeRepliesAt(probes []*ds.SendPacket, interval time.Duration) []*ds.RecvPacket {
+	ids := make([]uint16, 0, len(probes))
+	for i, p := range probes {
+		if atomic.LoadUint32(&app.Exit) == 1 {
+			break
+		}
+		p.Track = true
+		ids = append(ids, app.send(p))
+		if i < len(probes)-1 {
+			time.Sleep(interval)
+		}
+	}
+
+	deadline := time.Now().Add(app.replyTimeout())
+	for time.Now().Before(deadline) && !app.allTracked(ids) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	res := make([]*ds.RecvPacket, len(probes))
+	app.flowLock.Lock()
+	for i, id := range ids {
+		res[i] = app.tracked[id]
+		delete(app.tracked, id)
+	}
+	app.flowLock.Unlock()
+	return res
+}
+
+func (app *TraceApp) allTracked(ids []uint16) bool {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	for _, id := range ids {
+		if app.tracked[id] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// ownsDst 差错报文引用的目的地址是否为本任务发出的探测的目的地址
+func (app *TraceApp) ownsDst(dst net.IP) bool {
+	if dst.Equal(app.DstAddr) {
+		return true
+	}
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	return app.altDsts[dst.String()]
+}
+
+// altDst 与任务目的地址同网段的第 i 个地址，只改变最后一个字节，跳过 0 和 255
+func (app *TraceApp) altDst(i int) net.IP {
+	ip := make(net.IP, len(utils.IPBytes(app.DstAddr)))
+	copy(ip, utils.IPBytes(app.DstAddr))
+	last := len(ip) - 1
+	ip[last] = uint8((int(ip[last])+i-1)%254 + 1)
+	if ip.Equal(app.DstAddr) {
+		ip[last] = uint8(int(ip[last])%254 + 1)
+	}
+	app.flowLock.Lock()
+	app.altDsts[ip.String()] = true
+	app.flowLock.Unlock()
+	return ip
+}
+
+// classify 判断各跳顶点的负载均衡类型，在 MDA 枚举完成后调用。
+// 有多个下一跳的顶点用一个固定的流标识重复探测下一跳：出现多个下一跳为按包负载均衡，否则为按流；
+// 只有一个下一跳的顶点在开启 lbDstTest 时用同网段的其他目的地址探测：经过该顶点后出现多个下一跳为按目的地址，
+// 否则为无负载均衡；未开启时不向任务之外的地址发包，直接记为无负载均衡。
+// 简单模式每跳只有一个流标识，没有判断的依据，不做分类。
+func (app *TraceApp) classify() {
+	dst := app.DstAddr.String()
+	for ttl := uint8(1); ttl < app.maxTTL; ttl++ {
+		for _, v := range app.responders(ttl) {
+			if atomic.LoadUint32(&app.Exit) == 1 {
+				return
+			}
+			if v == dst {
+				continue
+			}
+			flows := app.flowsVia(ttl, v)
+			succ, _ := app.successors(ttl+1, v)
+			if len(flows) == 0 || len(succ) == 0 {
+				continue
+			}
+			var c *LBClass
+			switch {
+			case len(succ) > 1:
+				c = app.perPacketTest(ttl+1, flows[0])
+			case succ[0] == dst || !app.lbDstTest:
+				// 下一跳就是目的端，或未开启按目的地址的检测
+				c = &LBClass{Type: LBNone, NextHops: 1}
+			default:
+				c = app.perDestinationTest(ttl, v, flows[0], succ[0])
+			}
+			logrus.Infof("%s: ttl %d %s load balance %+v", app.mode, ttl, v, *c)
+			app.flowLock.Lock()
+			if app.lb[ttl] == nil {
+				app.lb[ttl] = make(map[string]*LBClass)
+			}
+			app.lb[ttl][v] = c
+			app.flowLock.Unlock()
+		}
+	}
+}
+
+// perPacketTest 用固定的流标识在第 ttl 跳探测 n_1 次，统计不同的下一跳
+func (app *TraceApp) perPacketTest(ttl uint8, flow uint16) *LBClass {
+	n := app.stop.N(1)
+	probes := make([]*ds.SendPacket, n)
+	for i := range probes {
+		probes[i] = &ds.SendPacket{TTL: ttl, FlowID: flow}
+	}
+	hops := distinct(app.probeBatch(probes))
+	c := &LBClass{Type: LBPerFlow, Probes: n, NextHops: len(hops)}
+	if len(hops) > 1 {
+		c.Type = LBPerPacket
+	}
+	return c
+}
+
+// perDestinationTest 用固定的流标识向同网段的其他目的地址探测第 ttl 跳和第 ttl+1 跳，
+// 统计经过第 ttl 跳顶点 v 的探测在第 ttl+1 跳的不同下一跳，succ 为任务目的地址经过 v 后的下一跳
+func (app *TraceApp) perDestinationTest(ttl uint8, v string, flow uint16, succ string) *LBClass {
+	probes := make([]*ds.SendPacket, 0, 2*lbAltDsts)
+	for i := 1; i <= lbAltDsts; i++ {
+		d := app.altDst(i)
+		probes = append(probes,
+			&ds.SendPacket{TTL: ttl, FlowID: flow, Dst: d},
+			&ds.SendPacket{TTL: ttl + 1, FlowID: flow, Dst: d})
+	}
+	res := app.probeBatch(probes)
+	hops := []string{succ}
+	for i := 0; i+1 < len(res); i += 2 {
+		// 其他目的端自身的应答不算下一跳
+		if res[i] == v && res[i+1] != probes[i+1].Dst.String() {
+			hops = append(hops, res[i+1])
+		}
+	}
+	hops = distinct(hops)
+	c := &LBClass{Type: LBNone, Probes: len(probes), NextHops: len(hops)}
+	if len(hops) > 1 {
+		c.Type = LBPerDestination
+	}
+	return c
+}
+
+// distinct 去掉超时和重复的地址
+func distinct(addrs []string) []string {
+	set := make(map[string]bool)
+	var res []string
+	for _, a := range addrs {
+		if a == starAddr || set[a] {
+			continue
+		}
+		set[a] = true
+		res = append(res, a)
+	}
+	return res
+}
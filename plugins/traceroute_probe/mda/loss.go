@@ -0,0 +1,73 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"time"
+)
+
+// storeSent 记录已发出的探测，等待应答匹配或超时
+func (app *TraceApp) storeSent(p *ds.SendPacket) {
+	app.matchCache.Cache.Store(p.ID, p, time.UnixMicro(p.TimeStamp))
+	if p.Dst != nil || p.Uncounted {
+		return
+	}
+	app.flowLock.Lock()
+	app.hopSent[p.TTL]++
+	app.flowLock.Unlock()
+}
+
+// drainSent 取出 SendChan 中已发出但尚未记录的探测
+func (app *TraceApp) drainSent() {
+	for {
+		select {
+		case p := <-app.SendChan:
+			app.storeSent(p)
+		default:
+			return
+		}
+	}
+}
+
+// onProbeExpire 匹配缓存中的探测超时仍未应答，计入该跳及该跳上这个流的丢失数
+func (app *TraceApp) onProbeExpire(key, value interface{}) {
+	p, ok := value.(*ds.SendPacket)
+	if !ok || p.Dst != nil || p.Uncounted {
+		return
+	}
+	logrus.Debugf("probe %d lost, ttl %d flow %d.", p.ID, p.TTL, p.FlowID)
+	app.flowLock.Lock()
+	app.hopLost[p.TTL]++
+	if app.flowLost[p.TTL] == nil {
+		app.flowLost[p.TTL] = make(map[uint16]int)
+	}
+	app.flowLost[p.TTL][p.FlowID]++
+	app.flowLock.Unlock()
+}
+
+// branchLoss 经过第 ttl-1 跳顶点 prev 的流在第 ttl 跳丢失的探测数，以及这些流在第 ttl 跳发送的探测数。
+// 只有部分上一跳顶点的分支丢包时是分支上的问题，各分支都丢包时是该跳本身丢包或限速
+func (app *TraceApp) branchLoss(ttl uint8, prev string) (int, int) {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	lost, probed := 0, 0
+	for f, a := range app.hops[ttl-1].replied {
+		if a != prev || !app.hops[ttl].probed[f] {
+			continue
+		}
+		probed++
+		lost += app.flowLost[ttl][f]
+	}
+	return lost, probed
+}
+
+// fillLoss 把该跳的发送数、丢失数和是否限速填入逐跳结果。MDA 各流的应答地址不同，
+// 丢失的探测无法归属到某个应答地址，同一跳的各条记录共享该跳的计数，与 mtr 一致
+func (app *TraceApp) fillLoss(pr *ds.ProbeResponse) {
+	app.flowLock.RLock()
+	sent, lost, limited := app.hopSent[pr.TTL], app.hopLost[pr.TTL], app.rateLimited[pr.TTL]
+	app.flowLock.RUnlock()
+	pr.Lock.Lock()
+	pr.Sent, pr.Lost, pr.RateLimited = sent, lost, limited
+	pr.Lock.Unlock()
+}
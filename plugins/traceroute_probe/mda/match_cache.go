@@ -3,16 +3,14 @@ package mda
 import "time"
 
 type MatchCache struct {
-	Cache       *SyncMap
-	FlowIDCache *SyncMap
+	Cache *SyncMap
 }
 
 func NewMatchCache(hash string, timeout, checkFreq uint8) *MatchCache {
 	to := time.Duration(timeout) * time.Second
 	cf := time.Duration(checkFreq) * time.Second
 	c := &MatchCache{
-		Cache:       NewSyncMap(hash, to, cf),
-		FlowIDCache: NewSyncMap(hash, to, cf),
+		Cache: NewSyncMap(hash, to, cf),
 	}
 	return c
 }
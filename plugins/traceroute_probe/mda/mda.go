@@ -0,0 +1,390 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	cds "mda-traceroute-go/dataStruct"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"mda-traceroute-go/util"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 探测模式
+const (
+	ModeSimple = "simple" // 每跳只用固定的流标识探测
+	ModeMDA    = "mda"    // 多路径探测算法，按停止点表枚举每个顶点的全部下一跳
+	// MDA-Lite 假设负载均衡均匀且菱形无网状连接，按跳而不是按顶点应用停止点，检测到假设不成立的跳再回退为 MDA
+	ModeMDALite = "mda-lite"
+	ModePMTU    = "pmtu" // 用设置了不分片标志、逐步减小的探测逐跳发现路径 MTU
+)
+
+// Modes 支持的探测模式
+var Modes = []string{ModeSimple, ModeMDA, ModeMDALite, ModePMTU}
+
+const (
+	starAddr = cds.StarAddr // 超时未应答的探测在流表中的占位地址
+
+	mdaMaxFlowID   = 4096 // 流标识上限，UDP/TCP 的源端口为基础端口加流标识
+	mdaHopBudget   = 512  // 单跳最多使用的流标识个数
+	mdaRetryRounds = 3    // 节点控制连续多少轮没有新增经过目标顶点的流后放弃
+)
+
+// DefaultGapLimit 连续多少跳全部超时后停止探测的默认值
+const DefaultGapLimit = 3
+
+// hopFlows 某一跳上各流标识的探测情况
+type hopFlows struct {
+	probed  map[uint16]bool   // 已在该跳发送过探测的流
+	replied map[uint16]string // 流 -> 应答地址，超时未应答为 starAddr
+}
+
+func newHopFlows() *hopFlows {
+	return &hopFlows{
+		probed:  make(map[uint16]bool),
+		replied: make(map[uint16]string),
+	}
+}
+
+// recordFlow 由 match 协程在收到应答后调用
+func (app *TraceApp) recordFlow(ttl uint8, flowID uint16, addr string) {
+	app.flowLock.Lock()
+	defer app.flowLock.Unlock()
+	h := app.hops[ttl]
+	if h == nil || !h.probed[flowID] {
+		return
+	}
+	h.replied[flowID] = addr
+}
+
+// flowsVia 第 ttl 跳应答地址为 addr 的流，ttl 为 0 时返回已分配的全部流（源端视为唯一顶点）
+func (app *TraceApp) flowsVia(ttl uint8, addr string) []uint16 {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	var flows []uint16
+	for f, a := range app.hops[ttl].replied {
+		if a == addr {
+			flows = append(flows, f)
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i] < flows[j] })
+	return flows
+}
+
+// vertices 第 ttl 跳已发现的顶点，包括代表超时的 starAddr
+func (app *TraceApp) vertices(ttl uint8) []string {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	set := make(map[string]bool)
+	for _, a := range app.hops[ttl].replied {
+		set[a] = true
+	}
+	res := make([]string, 0, len(set))
+	for a := range set {
+		res = append(res, a)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// successors 经过第 ttl-1 跳顶点 prev 的流在第 ttl 跳的应答地址（不含超时），以及其中已在第 ttl 跳探测过的流数
+func (app *TraceApp) successors(ttl uint8, prev string) ([]string, int) {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	set := make(map[string]bool)
+	probed := 0
+	cur := app.hops[ttl]
+	for f, a := range app.hops[ttl-1].replied {
+		if a != prev || !cur.probed[f] {
+			continue
+		}
+		probed++
+		if r, ok := cur.replied[f]; ok && r != starAddr {
+			set[r] = true
+		}
+	}
+	res := make([]string, 0, len(set))
+	for a := range set {
+		res = append(res, a)
+	}
+	sort.Strings(res)
+	return res, probed
+}
+
+// newFlows 分配 n 个新的流标识，记为经过源端
+func (app *TraceApp) newFlows(n int) []uint16 {
+	app.flowLock.Lock()
+	defer app.flowLock.Unlock()
+	var flows []uint16
+	for ; n > 0 && app.nextFlow < mdaMaxFlowID; n-- {
+		app.nextFlow++
+		app.hops[0].probed[app.nextFlow] = true
+		app.hops[0].replied[app.nextFlow] = ""
+		flows = append(flows, app.nextFlow)
+	}
+	return flows
+}
+
+// probeFlows 在第 ttl 跳用给定的流各发送一个探测，等待应答或超时，超时的流记为 starAddr
+func (app *TraceApp) probeFlows(ttl uint8, flows []uint16) {
+	app.flowLock.Lock()
+	h := app.hops[ttl]
+	var send []uint16
+	for _, f := range flows {
+		if !h.probed[f] {
+			h.probed[f] = true
+			send = append(send, f)
+		}
+	}
+	app.flowLock.Unlock()
+	if len(send) == 0 {
+		return
+	}
+
+	interval := app.sendInterval()
+	for i, f := range send {
+		if atomic.LoadUint32(&app.Exit) == 1 {
+			return
+		}
+		app.sendProbe(ttl, f)
+		if i < len(send)-1 {
+			time.Sleep(interval)
+		}
+	}
+
+	deadline := time.Now().Add(app.replyTimeout())
+	for time.Now().Before(deadline) && !app.allReplied(ttl, send) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	app.flowLock.Lock()
+	for _, f := range send {
+		if _, ok := h.replied[f]; !ok {
+			h.replied[f] = starAddr
+		}
+	}
+	app.flowLock.Unlock()
+}
+
+func (app *TraceApp) allReplied(ttl uint8, flows []uint16) bool {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	for _, f := range flows {
+		if _, ok := app.hops[ttl].replied[f]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// replyTimeout 等待单个探测应答的时间，取匹配缓存的超时时间
+func (app *TraceApp) replyTimeout() time.Duration {
+	t := time.Duration(utils.ConfigData.MatchCacheConf.Timeout) * time.Second
+	if t <= 0 {
+		t = 2 * time.Second
+	}
+	return t
+}
+
+// reachVertex 节点控制：在第 ttl 跳用新的流探测，直到至少有 need 个流经过顶点 addr。
+// 流标识用尽、超出单跳预算或连续几轮没有新增时返回 false。
+func (app *TraceApp) reachVertex(ttl uint8, addr string, need int) bool {
+	idle := 0
+	for {
+		have := len(app.flowsVia(ttl, addr))
+		if have >= need {
+			return true
+		}
+		if ttl == 0 {
+			return len(app.newFlows(need-have)) > 0 && len(app.flowsVia(ttl, addr)) >= need
+		}
+		if atomic.LoadUint32(&app.Exit) == 1 || idle >= mdaRetryRounds {
+			return false
+		}
+
+		// 按该顶点在本跳的流量占比估算还需要多少个新流
+		app.flowLock.RLock()
+		total := len(app.hops[ttl].probed)
+		app.flowLock.RUnlock()
+		if total >= mdaHopBudget {
+			return false
+		}
+		batch := need - have
+		if have > 0 {
+			batch = (need - have) * total / have
+		}
+		if batch > mdaHopBudget-total {
+			batch = mdaHopBudget - total
+		}
+		flows := app.newFlows(batch)
+		if len(flows) == 0 {
+			return false
+		}
+		app.probeFlows(ttl, flows)
+		if len(app.flowsVia(ttl, addr)) == have {
+			idle++
+		} else {
+			idle = 0
+		}
+	}
+}
+
+// enumerate 枚举第 ttl-1 跳顶点 prev 在第 ttl 跳的全部下一跳：已发现 k 个下一跳时，
+// 用 n_k 个经过 prev 的不同流探测第 ttl 跳，发现新的下一跳则提高到 n_{k+1} 继续，
+// 直到探测数达到停止点。返回该顶点达到的置信度。
+func (app *TraceApp) enumerate(ttl uint8, prev string) float64 {
+	for {
+		succ, probed := app.successors(ttl, prev)
+		need := app.stop.N(len(succ))
+		if probed >= need || atomic.LoadUint32(&app.Exit) == 1 {
+			return app.stop.Confidence(len(succ), probed)
+		}
+
+		app.reachVertex(ttl-1, prev, need)
+		via := app.flowsVia(ttl-1, prev)
+		if len(via) > need {
+			via = via[:need]
+		}
+		before := probed
+		app.probeFlows(ttl, via)
+		if _, probed = app.successors(ttl, prev); probed == before {
+			// 没有更多经过 prev 的流可用，按已发送的探测数给出置信度
+			logrus.Warnf("mda: vertex %s at ttl %d got %d/%d flows.", prev, ttl-1, probed, need)
+			return app.stop.Confidence(len(succ), probed)
+		}
+	}
+}
+
+// mda 逐跳枚举所有顶点的下一跳，到达目的端或连续多跳超时后停止
+func (app *TraceApp) mda() {
+	app.traceHops(app.flowHop(app.mdaHop))
+}
+
+// flowHop 把按流探测的 hop 包装为同时返回该跳流表中的顶点
+func (app *TraceApp) flowHop(hop func(ttl uint8) float64) func(ttl uint8) (float64, []string) {
+	return func(ttl uint8) (float64, []string) {
+		return hop(ttl), app.vertices(ttl)
+	}
+}
+
+// mdaHop 用完整的 MDA 枚举第 ttl-1 跳每个顶点的下一跳，返回该跳的置信度
+func (app *TraceApp) mdaHop(ttl uint8) float64 {
+	dst := app.DstAddr.String()
+	prevs := []string{""}
+	if ttl > 1 {
+		prevs = app.vertices(ttl - 1)
+	}
+	confidence := 1.0
+	for _, prev := range prevs {
+		if prev == dst {
+			continue
+		}
+		confidence *= app.enumerate(ttl, prev)
+		if lost, probed := app.branchLoss(ttl, prev); lost > 0 {
+			logrus.Infof("mda: ttl %d lost %d probes on %d flows via %s.", ttl, lost, probed, prev)
+		}
+	}
+	return confidence
+}
+
+// traceHops 逐跳调用 hop 探测，hop 返回该跳的置信度和看到的应答地址（含代表超时的 starAddr）。
+// 简单模式开启 Doubletree 时从中间跳开始向两端探测，否则从第 1 跳开始
+func (app *TraceApp) traceHops(hop func(ttl uint8) (float64, []string)) {
+	if app.doubletree {
+		if app.mode == ModeSimple {
+			app.doubletreeHops(hop)
+			return
+		}
+		// MDA 依赖上一跳的流逐跳枚举，只能从第 1 跳开始，仅用全局停止集合提前结束
+		logrus.Infof("%s: doubletree only applies the global stop set, start from ttl 1.", app.mode)
+	}
+	app.forwardHops(1, hop)
+}
+
+// forwardHops 从第 start 跳开始向目的端逐跳探测，到达目的端、路由器返回目的不可达、
+// 该跳的应答都在全局停止集合中、连续 gapLimit 跳全部超时或到达最大 TTL 后停止，并记录结束原因
+func (app *TraceApp) forwardHops(start uint8, hop func(ttl uint8) (float64, []string)) {
+	dst := app.DstAddr.String()
+	gap := 0
+	for ttl := start; ttl <= app.maxTTL; ttl++ {
+		if atomic.LoadUint32(&app.Exit) == 1 {
+			return
+		}
+		cur := app.probeHop(ttl, hop)
+		app.lastTTL = ttl
+		if len(cur) == 1 && cur[0] == starAddr {
+			gap++
+			if gap >= app.gapLimit {
+				app.termination = cds.TermGapLimit
+				return
+			}
+			continue
+		}
+		gap = 0
+		if reachedOnly(cur, dst) {
+			app.termination = cds.TermReached
+			return
+		}
+		if mark := app.unreachableOnly(cur, dst); mark != "" {
+			app.termination = cds.UnreachableReason(mark)
+			return
+		}
+		if app.globalStop.covers(cur) {
+			app.termination = cds.TermStopSet
+			return
+		}
+		if ttl == app.maxTTL {
+			break
+		}
+	}
+	app.termination = cds.TermMaxTTL
+}
+
+// probeHop 探测第 ttl 跳并记录置信度，部分探测超时时检测限速，返回该跳的应答地址
+func (app *TraceApp) probeHop(ttl uint8, hop func(ttl uint8) (float64, []string)) []string {
+	confidence, cur := hop(ttl)
+	app.hopConf[ttl] = confidence
+	app.probedTTL[ttl] = true
+	if len(cur) > 1 && util.ContainsString(cur, starAddr) {
+		// 部分探测超时，可能是路由器限速而不是丢包
+		cur = app.checkRateLimit(ttl, cur)
+	}
+	logrus.Infof("%s: ttl %d vertices %v, confidence %.4f", app.mode, ttl, cur, confidence)
+	return cur
+}
+
+// unreachableOnly 该跳除超时和目的端外的应答都来自返回过目的不可达的路由器，后续跳已无法到达，
+// 返回第一个路由器的不可达标记，否则返回空
+func (app *TraceApp) unreachableOnly(vertices []string, dst string) string {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	mark := ""
+	for _, v := range vertices {
+		if v == starAddr || v == dst {
+			continue
+		}
+		m, ok := app.unreachable[v]
+		if !ok {
+			return ""
+		}
+		if mark == "" {
+			mark = m
+		}
+	}
+	return mark
+}
+
+// reachedOnly 该跳除超时外只有目的端应答
+func reachedOnly(vertices []string, dst string) bool {
+	reached := false
+	for _, v := range vertices {
+		switch v {
+		case dst:
+			reached = true
+		case starAddr:
+		default:
+			return false
+		}
+	}
+	return reached
+}
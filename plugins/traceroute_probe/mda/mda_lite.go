@@ -0,0 +1,191 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync/atomic"
+)
+
+// MDA-Lite 回退为 MDA 的原因
+const (
+	FallbackMeshing    = "meshing"     // 相邻两跳之间存在网状连接
+	FallbackNonUniform = "non-uniform" // 上一跳顶点的流在各下一跳间的分布明显不均匀
+)
+
+// mdaLite 逐跳探测：每跳按该跳已发现的顶点数应用停止点，不对上一跳的顶点做节点控制。
+// 每跳探测完后做非均匀和网状连接检测，检测不通过的跳用完整的 MDA 重新枚举并记录原因。
+func (app *TraceApp) mdaLite() {
+	app.traceHops(app.flowHop(app.mdaLiteHop))
+}
+
+func (app *TraceApp) mdaLiteHop(ttl uint8) float64 {
+	confidence := app.liteEnumerate(ttl)
+	if ttl == 1 {
+		return confidence
+	}
+	reason := app.liteCheck(ttl)
+	if reason == "" {
+		return confidence
+	}
+	logrus.Infof("mda-lite: ttl %d falls back to mda, reason: %s", ttl, reason)
+	app.hopFallback[ttl] = reason
+	return app.mdaHop(ttl)
+}
+
+// liteEnumerate 已发现 k 个顶点时在本跳共发送 n_k 个探测，发现新顶点则提高到 n_{k+1}，
+// 均匀负载下各上一跳顶点自然分到足够的流，返回该跳的置信度
+func (app *TraceApp) liteEnumerate(ttl uint8) float64 {
+	for {
+		k := len(app.responders(ttl))
+		probed := app.probedCount(ttl)
+		need := app.stop.N(k)
+		if probed >= need || atomic.LoadUint32(&app.Exit) == 1 {
+			return app.stop.Confidence(k, probed)
+		}
+		flows := app.liteFlows(ttl, need-probed)
+		if len(flows) == 0 {
+			return app.stop.Confidence(k, probed)
+		}
+		app.probeFlows(ttl, flows)
+	}
+}
+
+// liteFlows 取 n 个未在第 ttl 跳探测过的流：优先轮流使用上一跳各顶点已知的流，以便得到相邻两跳间的连接关系；
+// 不够时分配新流并先探测上一跳
+func (app *TraceApp) liteFlows(ttl uint8, n int) []uint16 {
+	var flows []uint16
+	app.flowLock.RLock()
+	byPrev := make(map[string][]uint16)
+	var prevs []string
+	for f, a := range app.hops[ttl-1].replied {
+		if app.hops[ttl].probed[f] {
+			continue
+		}
+		if _, ok := byPrev[a]; !ok {
+			prevs = append(prevs, a)
+		}
+		byPrev[a] = append(byPrev[a], f)
+	}
+	app.flowLock.RUnlock()
+	// 按顺序取流，相同的网络总是得到相同的探测
+	sort.Strings(prevs)
+	for _, a := range prevs {
+		fs := byPrev[a]
+		sort.Slice(fs, func(i, j int) bool { return fs[i] < fs[j] })
+	}
+	for len(flows) < n {
+		added := false
+		for _, a := range prevs {
+			if len(byPrev[a]) == 0 || len(flows) >= n {
+				continue
+			}
+			flows = append(flows, byPrev[a][0])
+			byPrev[a] = byPrev[a][1:]
+			added = true
+		}
+		if !added {
+			break
+		}
+	}
+	if len(flows) >= n {
+		return flows
+	}
+
+	fresh := app.newFlows(n - len(flows))
+	if ttl > 1 && len(fresh) > 0 {
+		app.probeFlows(ttl-1, fresh)
+	}
+	return append(flows, fresh...)
+}
+
+// liteCheck 检测第 ttl-1 跳到第 ttl 跳是否满足 MDA-Lite 的假设，不满足时返回回退原因
+func (app *TraceApp) liteCheck(ttl uint8) string {
+	// 非均匀检测：经过同一个上一跳顶点的流由负载均衡按哈希分到各下一跳，某个下一跳分到的流少于均分份额的一半。
+	// 探测端只决定用经过该顶点的哪些流，流落到哪个下一跳由负载均衡决定，因此统计的是负载均衡的分流
+	counts := make(map[string]map[string]int)
+	app.flowLock.RLock()
+	for f, a := range app.hops[ttl-1].replied {
+		b, ok := app.hops[ttl].replied[f]
+		if !ok || a == starAddr || b == starAddr {
+			continue
+		}
+		if counts[a] == nil {
+			counts[a] = make(map[string]int)
+		}
+		counts[a][b]++
+	}
+	app.flowLock.RUnlock()
+	for _, next := range counts {
+		if len(next) < 2 {
+			continue
+		}
+		total := 0
+		for _, c := range next {
+			total += c
+		}
+		for _, c := range next {
+			if c*2*len(next) < total {
+				return FallbackNonUniform
+			}
+		}
+	}
+
+	// 网状连接检测：同时存在有多个下一跳的上一跳顶点和有多个上一跳的本跳顶点
+	succ, pred := app.links(ttl)
+	multiSucc, multiPred := false, false
+	for _, s := range succ {
+		if len(s) > 1 {
+			multiSucc = true
+		}
+	}
+	for _, p := range pred {
+		if len(p) > 1 {
+			multiPred = true
+		}
+	}
+	if multiSucc && multiPred {
+		return FallbackMeshing
+	}
+	return ""
+}
+
+// links 根据在相邻两跳都有应答的流，返回第 ttl-1 跳顶点的下一跳集合和第 ttl 跳顶点的上一跳集合，不含超时
+func (app *TraceApp) links(ttl uint8) (map[string]map[string]bool, map[string]map[string]bool) {
+	succ := make(map[string]map[string]bool)
+	pred := make(map[string]map[string]bool)
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	for f, a := range app.hops[ttl-1].replied {
+		b, ok := app.hops[ttl].replied[f]
+		if !ok || a == starAddr || b == starAddr {
+			continue
+		}
+		if succ[a] == nil {
+			succ[a] = make(map[string]bool)
+		}
+		if pred[b] == nil {
+			pred[b] = make(map[string]bool)
+		}
+		succ[a][b] = true
+		pred[b][a] = true
+	}
+	return succ, pred
+}
+
+// responders 第 ttl 跳有应答的顶点，不含超时
+func (app *TraceApp) responders(ttl uint8) []string {
+	var res []string
+	for _, v := range app.vertices(ttl) {
+		if v != starAddr {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// probedCount 第 ttl 跳已探测的流数
+func (app *TraceApp) probedCount(ttl uint8) int {
+	app.flowLock.RLock()
+	defer app.flowLock.RUnlock()
+	return len(app.hops[ttl].probed)
+}
@@ -0,0 +1,348 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	"math"
+	cds "mda-traceroute-go/dataStruct"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"mda-traceroute-go/plugins/traceroute_probe/netio"
+	"mda-traceroute-go/plugins/traceroute_probe/netsim"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetLevel(logrus.FatalLevel)
+	utils.UseDefaultConfig()
+	utils.ConfigData.PacketRate = 1000
+	utils.ConfigData.Timeout = 1
+	os.Exit(m.Run())
+}
+
+// simTrace 在模拟网络 topo 上用 UDP 探测 10.0.9.1，探测结束后返回，conf 中未填写的字段使用测试拓扑的地址
+func simTrace(t *testing.T, topo string, conf *ProberConf) *TraceApp {
+	t.Helper()
+	sim, err := netsim.Load(filepath.Join("..", "netsim", "testdata", topo))
+	if err != nil {
+		t.Fatalf("load %s: %v", topo, err)
+	}
+	svc := netio.NewService(sim, 0)
+	go svc.Run()
+	t.Cleanup(svc.Close)
+
+	conf.Key = topo
+	conf.SrcAddr = net.ParseIP("10.0.0.1")
+	conf.DstAddr = net.ParseIP("10.0.9.1")
+	conf.MaxTTL = 16
+	conf.IO = svc
+	p, err := NewUDPApp(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := p.TraceApp
+	t.Cleanup(app.Cancel)
+	go app.ListenFor()
+	go app.match()
+	app.run()
+	return app
+}
+
+// waitExpired 等待未应答的探测超时，之后各跳的丢失数才完整
+func waitExpired(t *testing.T, app *TraceApp) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for app.matchCache.Cache.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d probes still pending", app.matchCache.Cache.Len())
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// hopResults 按 TTL 分组的逐跳结果
+func hopResults(app *TraceApp) map[uint8][]*ds.ProbeResponse {
+	res := make(map[uint8][]*ds.ProbeResponse)
+	for _, pr := range app.Results() {
+		res[pr.TTL] = append(res[pr.TTL], pr)
+	}
+	return res
+}
+
+func TestStoppingPoints(t *testing.T) {
+	// Veitch 等给出的 95% 置信度停止点
+	want := []int{6, 11, 16, 21, 27, 33, 38, 44, 51, 57}
+	sp := NewStoppingPoints(0)
+	for k, n := range want {
+		if got := sp.N(k + 1); got != n {
+			t.Errorf("n_%d = %d, want %d", k+1, got, n)
+		}
+		if c := sp.Confidence(k+1, n); c < 1-DefaultAlpha {
+			t.Errorf("confidence at n_%d = %.4f", k+1, c)
+		}
+		if c := sp.Confidence(k+1, n-1); c >= 1-DefaultAlpha {
+			t.Errorf("confidence at n_%d - 1 = %.4f, stopping point is not minimal", k+1, c)
+		}
+	}
+	if sp.N(0) != sp.N(1) {
+		t.Errorf("n_0 = %d, want n_1", sp.N(0))
+	}
+	if strict := NewStoppingPoints(0.01); strict.N(1) <= sp.N(1) {
+		t.Errorf("alpha 0.01 n_1 = %d, not above alpha 0.05", strict.N(1))
+	}
+}
+
+func TestMDADiamond(t *testing.T) {
+	for _, mode := range []string{ModeMDA, ModeMDALite} {
+		app := simTrace(t, "diamond.toml", &ProberConf{Mode: mode})
+
+		if app.termination != cds.TermReached || app.lastTTL != 4 {
+			t.Errorf("%s: termination %s at ttl %d", mode, app.termination, app.lastTTL)
+		}
+		for ttl, want := range map[uint8][]string{
+			1: {"10.0.1.1"},
+			2: {"10.0.2.1", "10.0.2.2"},
+			3: {"10.0.3.1"},
+			4: {"10.0.9.1"},
+		} {
+			if got := app.vertices(ttl); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: ttl %d vertices %v, want %v", mode, ttl, got, want)
+			}
+			// 该跳的置信度是上一跳各顶点置信度之积
+			if floor := math.Pow(1-DefaultAlpha, float64(len(app.vertices(ttl-1)))); app.hopConf[ttl] < floor {
+				t.Errorf("%s: ttl %d confidence %.4f below %.4f", mode, ttl, app.hopConf[ttl], floor)
+			}
+		}
+		// 停止规则：r1 有两个下一跳，至少要用 n_2 个经过 r1 的流探测第 2 跳
+		if _, probed := app.successors(2, "10.0.1.1"); probed < app.stop.N(2) {
+			t.Errorf("%s: r1 probed with %d flows, want at least n_2 = %d", mode, probed, app.stop.N(2))
+		}
+
+		for _, pr := range hopResults(app)[2] {
+			hasLabel := len(pr.MPLS) == 1 && pr.MPLS[0].Label == 16001
+			if hasLabel != (pr.ResAddr == "10.0.2.1") {
+				t.Errorf("%s: %s mpls %+v", mode, pr.ResAddr, pr.MPLS)
+			}
+		}
+		if lb := app.lb[1]["10.0.1.1"]; lb == nil || lb.Type != LBPerFlow {
+			t.Errorf("%s: r1 load balance %+v, want %s", mode, lb, LBPerFlow)
+		}
+	}
+}
+
+func TestMDAWideStoppingRule(t *testing.T) {
+	app := simTrace(t, "wide.toml", &ProberConf{Mode: ModeMDA})
+	want := []string{"10.0.2.1", "10.0.2.2", "10.0.2.3", "10.0.2.4"}
+	if got := app.vertices(2); !reflect.DeepEqual(got, want) {
+		t.Fatalf("ttl 2 vertices %v, want %v", got, want)
+	}
+	// 发现第 4 个下一跳后还要探测到 n_4 个流，才能以 95% 的置信度排除第 5 个
+	if _, probed := app.successors(2, "10.0.1.1"); probed < app.stop.N(4) {
+		t.Errorf("r1 probed with %d flows, want at least n_4 = %d", probed, app.stop.N(4))
+	}
+	if app.hopConf[2] < 1-DefaultAlpha {
+		t.Errorf("ttl 2 confidence %.4f", app.hopConf[2])
+	}
+	// 汇合到 r3 的 4 个顶点各自只需 n_1 个流
+	for _, v := range want {
+		succ, probed := app.successors(3, v)
+		if !reflect.DeepEqual(succ, []string{"10.0.3.1"}) || probed < app.stop.N(1) {
+			t.Errorf("%s: successors %v with %d flows", v, succ, probed)
+		}
+	}
+}
+
+func TestLoadBalanceClassification(t *testing.T) {
+	for topo, want := range map[string]string{
+		"diamond.toml":         LBPerFlow,
+		"per_packet.toml":      LBPerPacket,
+		"per_destination.toml": LBPerDestination,
+	} {
+		app := simTrace(t, topo, &ProberConf{Mode: ModeMDA, LBDstTest: true})
+		if lb := app.lb[1]["10.0.1.1"]; lb == nil || lb.Type != want {
+			t.Errorf("%s: r1 load balance %+v, want %s", topo, lb, want)
+		}
+		// 下一跳是目的端的顶点不做检测，记为无负载均衡
+		if lb := app.lb[3]["10.0.3.1"]; lb == nil || lb.Type != LBNone || lb.Probes != 0 {
+			t.Errorf("%s: r3 before the destination classified as %+v", topo, lb)
+		}
+	}
+
+	// 未开启按目的地址的检测时不向任务之外的地址发包
+	app := simTrace(t, "per_destination.toml", &ProberConf{Mode: ModeMDA})
+	if lb := app.lb[1]["10.0.1.1"]; lb == nil || lb.Type != LBNone || len(app.altDsts) != 0 {
+		t.Errorf("r1 load balance %+v, probed other destinations %v", lb, app.altDsts)
+	}
+}
+
+func TestLossAccounting(t *testing.T) {
+	old := utils.ConfigData.FirstSendCnt
+	utils.ConfigData.FirstSendCnt = 10
+	defer func() { utils.ConfigData.FirstSendCnt = old }()
+
+	app := simTrace(t, "lossy.toml", &ProberConf{Mode: ModeSimple})
+	waitExpired(t, app)
+	hops := hopResults(app)
+	if app.termination != cds.TermReached || len(hops) != 3 {
+		t.Fatalf("termination %s, %d hops", app.termination, len(hops))
+	}
+	for ttl, pr := range map[uint8]*ds.ProbeResponse{1: hops[1][0], 2: hops[2][0]} {
+		wantAddr, wantLost := "10.0.1.1", 0
+		if ttl == 2 {
+			// 不返回 Time Exceeded 的路由器：全部探测记为丢失
+			wantAddr, wantLost = cds.StarAddr, 10
+		}
+		if pr.ResAddr != wantAddr || pr.Sent != 10 || pr.Lost != wantLost {
+			t.Errorf("ttl %d: %s sent %d lost %d", ttl, pr.ResAddr, pr.Sent, pr.Lost)
+		}
+	}
+	// 目的主机丢弃 30% 的探测，限速检测和重传的探测不计入
+	dst := hops[3][0]
+	if dst.ResAddr != "10.0.9.1" || dst.Sent != 10 || dst.Lost == 0 || dst.Lost == dst.Sent {
+		t.Errorf("ttl 3: %s sent %d lost %d", dst.ResAddr, dst.Sent, dst.Lost)
+	}
+}
+
+func TestGapLimit(t *testing.T) {
+	app := simTrace(t, "blackhole.toml", &ProberConf{Mode: ModeSimple, GapLimit: 2})
+	waitExpired(t, app)
+	if app.termination != cds.TermGapLimit || app.lastTTL != 3 {
+		t.Errorf("termination %s at ttl %d, want %s at ttl 3", app.termination, app.lastTTL, cds.TermGapLimit)
+	}
+	hops := hopResults(app)
+	for ttl := uint8(2); ttl <= 3; ttl++ {
+		if len(hops[ttl]) != 1 || hops[ttl][0].ResAddr != cds.StarAddr || hops[ttl][0].Lost != hops[ttl][0].Sent {
+			t.Errorf("ttl %d: %+v", ttl, hops[ttl])
+		}
+	}
+	if _, ok := hops[4]; ok {
+		t.Error("probed beyond the gap limit")
+	}
+}
+
+func TestDoubletreeNearDestination(t *testing.T) {
+	// 目的端在第 4 跳，比开始探测的第 6 跳更近
+	app := simTrace(t, "diamond.toml", &ProberConf{Mode: ModeSimple, Doubletree: true, StartTTL: 6})
+	waitExpired(t, app)
+	if app.termination != cds.TermReached || app.lastTTL != 4 {
+		t.Errorf("termination %s at ttl %d, want %s at ttl 4", app.termination, app.lastTTL, cds.TermReached)
+	}
+	var dstTTLs []uint8
+	for _, pr := range app.Results() {
+		if pr.ResAddr == "10.0.9.1" {
+			dstTTLs = append(dstTTLs, pr.TTL)
+		}
+		if pr.TTL > 4 {
+			t.Errorf("ttl %d beyond the destination reported: %s", pr.TTL, pr.ResAddr)
+		}
+	}
+	if !reflect.DeepEqual(dstTTLs, []uint8{4}) {
+		t.Errorf("destination recorded at ttl %v, want only 4", dstTTLs)
+	}
+	if hops := hopResults(app); len(hops[1]) != 1 || hops[1][0].ResAddr != "10.0.1.1" {
+		t.Errorf("ttl 1: %+v", hops[1])
+	}
+}
+
+func TestInvalidDSCP(t *testing.T) {
+	sim, err := netsim.Load(filepath.Join("..", "netsim", "testdata", "diamond.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := netio.NewService(sim, 0)
+	defer svc.Close()
+	for _, d := range []int{-1, 64} {
+		_, err := NewUDPApp(&ProberConf{
+			SrcAddr: net.ParseIP("10.0.0.1"),
+			DstAddr: net.ParseIP("10.0.9.1"),
+			MaxTTL:  16,
+			DSCP:    []int{0, d},
+			IO:      svc,
+		})
+		if err == nil {
+			t.Errorf("dscp %d accepted", d)
+		}
+	}
+}
+
+func TestMDALiteFallback(t *testing.T) {
+	for _, tc := range []struct {
+		topo   string
+		ttl    uint8
+		reason string
+		want   []string
+	}{
+		// r1 把 4/5 的流分到 r2a，分到 r2b 的流少于均分份额的一半
+		{"uneven.toml", 2, FallbackNonUniform, []string{"10.0.2.1", "10.0.2.2"}},
+		// r2a、r2b 都有两个下一跳，r3a、r3b 都有两个上一跳
+		{"meshed.toml", 3, FallbackMeshing, []string{"10.0.3.1", "10.0.3.2"}},
+		// 均匀的菱形不回退
+		{"diamond.toml", 0, "", nil},
+	} {
+		app := simTrace(t, tc.topo, &ProberConf{Mode: ModeMDALite})
+		if app.termination != cds.TermReached {
+			t.Errorf("%s: termination %s", tc.topo, app.termination)
+		}
+		for ttl, reason := range app.hopFallback {
+			if reason != "" && (uint8(ttl) != tc.ttl || reason != tc.reason) {
+				t.Errorf("%s: ttl %d falls back for %s", tc.topo, ttl, reason)
+			}
+		}
+		if tc.reason == "" {
+			continue
+		}
+		if app.hopFallback[tc.ttl] != tc.reason {
+			t.Errorf("%s: ttl %d fallback %q, want %q", tc.topo, tc.ttl, app.hopFallback[tc.ttl], tc.reason)
+		}
+		if got := app.vertices(tc.ttl); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: ttl %d vertices %v, want %v", tc.topo, tc.ttl, got, tc.want)
+		}
+		// 回退后按 MDA 的节点控制，上一跳的每个顶点都用足够的流探测
+		for _, v := range app.responders(tc.ttl - 1) {
+			succ, probed := app.successors(tc.ttl, v)
+			if probed < app.stop.N(len(succ)) {
+				t.Errorf("%s: %s probed with %d flows for %d successors", tc.topo, v, probed, len(succ))
+			}
+		}
+		for _, pr := range hopResults(app)[tc.ttl] {
+			if pr.Fallback != tc.reason {
+				t.Errorf("%s: %s reported fallback %q", tc.topo, pr.ResAddr, pr.Fallback)
+			}
+		}
+	}
+}
+
+func TestPMTUDiscovery(t *testing.T) {
+	app := simTrace(t, "pmtu.toml", &ProberConf{Mode: ModePMTU})
+	if app.termination != cds.TermReached || app.lastTTL != 4 {
+		t.Errorf("termination %s at ttl %d", app.termination, app.lastTTL)
+	}
+	if app.pmtuSize != 1280 {
+		t.Errorf("pmtu %d, want 1280", app.pmtuSize)
+	}
+	wantDrops := []cds.MTUDrop{
+		{TTL: 3, Router: "10.0.2.1", From: 1500, To: 1400},
+		{TTL: 4, Router: "10.0.3.1", From: 1400, To: 1280},
+	}
+	if !reflect.DeepEqual(app.mtuDrops, wantDrops) {
+		t.Errorf("mtu drops %+v, want %+v", app.mtuDrops, wantDrops)
+	}
+	hops := hopResults(app)
+	for ttl, want := range map[uint8]struct {
+		addr string
+		mtu  int
+	}{
+		1: {"10.0.1.1", 1500},
+		2: {"10.0.2.1", 1500},
+		3: {"10.0.3.1", 1400},
+		4: {"10.0.9.1", 1280},
+	} {
+		if len(hops[ttl]) != 1 || hops[ttl][0].ResAddr != want.addr || hops[ttl][0].PMTU != want.mtu {
+			t.Errorf("ttl %d: %+v, want %s with pmtu %d", ttl, hops[ttl], want.addr, want.mtu)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package mda
+
+import (
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"mda-traceroute-go/plugins/traceroute_probe/linkInfo"
+	"sort"
+)
+
+// payloadHop 在第 ttl 跳对每个负载长度用同一条流各发送 FirstSendCnt 个探测，
+// 各负载长度的延时在 match 中分别统计，返回看到的应答地址
+func (app *TraceApp) payloadHop(ttl uint8) (float64, []string) {
+	cnt := app.firstSendCnt()
+	probes := make([]*ds.SendPacket, 0, cnt*len(app.payloads))
+	for _, size := range app.payloads {
+		for i := 0; i < cnt; i++ {
+			probes = append(probes, &ds.SendPacket{TTL: ttl, Payload: size})
+		}
+	}
+	set := make(map[string]bool)
+	var addrs []string
+	for _, a := range app.probeBatch(probes) {
+		if !set[a] {
+			set[a] = true
+			addrs = append(addrs, a)
+		}
+	}
+	sort.Strings(addrs)
+	return 0, addrs
+}
+
+// appendSizeLatency 把一个负载长度为 size 的探测的往返时间(us)记入 pr 对应负载长度的延时统计。
+// 串行化时延通常远小于 1ms，这里保留小数而不像总延时那样取整
+func (app *TraceApp) appendSizeLatency(pr *ds.ProbeResponse, size int, rtt int64) {
+	if pr.SizeLatency == nil {
+		pr.SizeLatency = make(map[int]*linkInfo.LatencyStat, len(app.payloads))
+	}
+	ls, ok := pr.SizeLatency[size]
+	if !ok {
+		ls = linkInfo.NewLatencyStat()
+		pr.SizeLatency[size] = ls
+	}
+	ls.Append(float64(rtt)/1000, 4)
+}
@@ -0,0 +1,85 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	cds "mda-traceroute-go/dataStruct"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+)
+
+// DefaultPMTUSize PMTU 模式第一个探测的大小
+const DefaultPMTUSize = 1500
+
+// mtuPlateaus 逐步减小探测大小时依次尝试的值：以太网、PPPoE、IPIP、GRE、VXLAN 等隧道常见的 MTU 及 RFC 1191 的平台值
+var mtuPlateaus = []int{1500, 1492, 1480, 1476, 1450, 1400, 1280, 1006, 576}
+
+// pmtu 逐跳用设置了不分片标志的探测发现路径 MTU，到达目的端或连续多跳超时后停止
+func (app *TraceApp) pmtu() {
+	logrus.Infof("Start pmtu discovery for %s from size %d.", app.Domain, app.pmtuSize)
+	app.traceHops(app.pmtuHop)
+	logrus.Infof("pmtu of %s: %d, drops %+v", app.Domain, app.pmtuSize, app.mtuDrops)
+}
+
+// pmtuHop 用当前大小探测第 ttl 跳。收到需要分片时按报告的 MTU 缩小后重试；
+// 超时但默认大小的探测能到达时，认为大包被静默丢弃，按平台值逐档缩小直到能通过
+func (app *TraceApp) pmtuHop(ttl uint8) (float64, []string) {
+	for {
+		v := app.probeSize(ttl, app.pmtuSize)
+		switch {
+		case v == nil:
+			return 0, app.pmtuBlackHole(ttl)
+		case v.FragNeeded:
+			mtu := v.MTU
+			if mtu <= 0 || mtu >= app.pmtuSize {
+				// 旧的路由器不报告下一跳 MTU
+				mtu = app.nextPlateau(app.pmtuSize)
+			}
+			if mtu == 0 {
+				return 0, []string{starAddr}
+			}
+			app.mtuDrops = append(app.mtuDrops, cds.MTUDrop{TTL: ttl, Router: v.ResAddr, From: app.pmtuSize, To: mtu})
+			app.pmtuSize = mtu
+		default:
+			app.hopMTU[ttl] = app.pmtuSize
+			return 0, []string{v.ResAddr}
+		}
+	}
+}
+
+// pmtuBlackHole 当前大小的探测在第 ttl 跳超时，先用默认大小确认该跳能应答，再逐档缩小
+func (app *TraceApp) pmtuBlackHole(ttl uint8) []string {
+	small := app.probeSize(ttl, 0)
+	if small == nil || small.FragNeeded {
+		return []string{starAddr}
+	}
+	for size := app.nextPlateau(app.pmtuSize); size > 0; size = app.nextPlateau(size) {
+		v := app.probeSize(ttl, size)
+		if v == nil || v.FragNeeded {
+			continue
+		}
+		app.mtuDrops = append(app.mtuDrops, cds.MTUDrop{TTL: ttl, Router: v.ResAddr, From: app.pmtuSize, To: size, Silent: true})
+		app.pmtuSize = size
+		app.hopMTU[ttl] = size
+		return []string{v.ResAddr}
+	}
+	logrus.Warnf("pmtu: ttl %d only answers default size probes.", ttl)
+	return []string{small.ResAddr}
+}
+
+// probeSize 在第 ttl 跳发送一个大小为 size、设置不分片标志的探测，返回应答，超时为 nil
+func (app *TraceApp) probeSize(ttl uint8, size int) *ds.RecvPacket {
+	return app.probeReplies([]*ds.SendPacket{{TTL: ttl, Size: size, DF: true}})[0]
+}
+
+// nextPlateau 小于 size 的最大平台值，IPv6 不小于最小 MTU 1280，没有更小的值时返回 0
+func (app *TraceApp) nextPlateau(size int) int {
+	min := 0
+	if app.isIPv6() {
+		min = 1280
+	}
+	for _, p := range mtuPlateaus {
+		if p < size && p >= min {
+			return p
+		}
+	}
+	return 0
+}
@@ -0,0 +1,108 @@
+package mda
+
+import (
+	"fmt"
+	cds "mda-traceroute-go/dataStruct"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"mda-traceroute-go/plugins/traceroute_probe/netio"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Prober 一次探测任务的执行者，探测节点的控制循环只通过该接口调度任务
+type Prober interface {
+	// Start 开始探测，阻塞直到任务结束
+	Start()
+	// Cancel 提前结束任务
+	Cancel()
+	// Results 任务的逐跳结果，按 TTL 升序
+	Results() []*ds.ProbeResponse
+	// Summary 任务的整条路径汇总，如菱形
+	Summary() *cds.TraceSummary
+	// Done 任务结束后关闭
+	Done() <-chan struct{}
+}
+
+// ProberConf 创建 Prober 所需的任务参数
+type ProberConf struct {
+	Key        string
+	Domain     string
+	DstAddr    net.IP
+	SrcAddr    net.IP
+	MaxTTL     uint8
+	Port       uint16  // tcp 探测的目的端口
+	Mode       string  // 探测模式 ModeSimple / ModeMDA / ModeMDALite，为空时使用 ModeSimple
+	Alpha      float64 // MDA 每个顶点的失败概率上界，为 0 时使用 DefaultAlpha
+	Alias      bool    // 探测结束后对发现的接口做别名解析
+	LBDstTest  bool    // 向目的地址同网段的其他地址探测以识别按目的地址的负载均衡，关闭时不向任务之外的地址发包
+	GapLimit   int     // 连续多少跳全部超时后停止，为 0 时使用 DefaultGapLimit
+	TaskGeneTs int64
+
+	Doubletree bool     // 按 Doubletree 从第 StartTTL 跳开始向两端探测
+	StartTTL   uint8    // 为 0 时使用 DefaultStartTTL
+	LocalStop  *StopSet // 探测节点的本地停止集合
+	GlobalStop []string // 控制节点下发的全局停止集合
+
+	DSCP []int // 简单模式下依次用这些 DSCP 值探测并比较路径，为空时不设置 TOS
+
+	Payload  int   // 探测的负载长度，为 0 时使用探测引擎的默认长度
+	Payloads []int // 简单模式下依次用这些负载长度探测，按负载长度分别统计各跳的延时
+
+	Pcap string // 抓包文件路径，任务收发的所有报文按 libpcap 格式写入，为空时不抓包
+
+	IO *netio.Service // 探测节点共享的收发服务
+}
+
+// NewProberFunc 根据任务参数创建 Prober
+type NewProberFunc func(conf *ProberConf) (Prober, error)
+
+var (
+	proberRegistry = make(map[string]NewProberFunc)
+	registryLock   sync.RWMutex
+)
+
+// Register 以协议或探测方法名注册 Prober，新的探测类型在自己的 init 中注册即可
+func Register(name string, f NewProberFunc) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	if _, ok := proberRegistry[name]; ok {
+		panic("mda: Register called twice for prober " + name)
+	}
+	proberRegistry[name] = f
+}
+
+// NewProber 按名称创建 Prober
+func NewProber(name string, conf *ProberConf) (Prober, error) {
+	registryLock.RLock()
+	f, ok := proberRegistry[name]
+	registryLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("prober [%s] is not registered", name)
+	}
+	return f(conf)
+}
+
+// Probers 返回已注册的 Prober 名称
+func Probers() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	names := make([]string, 0, len(proberRegistry))
+	for k := range proberRegistry {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register(ProtocolICMP, func(c *ProberConf) (Prober, error) {
+		return NewICMPApp(c)
+	})
+	Register(ProtocolUDP, func(c *ProberConf) (Prober, error) {
+		return NewUDPApp(c)
+	})
+	Register(ProtocolTCP, func(c *ProberConf) (Prober, error) {
+		return NewTCPApp(c)
+	})
+}
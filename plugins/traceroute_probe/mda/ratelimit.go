@@ -0,0 +1,117 @@
+package mda
+
+import (
+	"github.com/sirupsen/logrus"
+	ds "mda-traceroute-go/plugins/traceroute_probe/dataStruct"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rateTestProbes  = 8    // 限速检测时每种速率发送的探测数
+	rateTestSteps   = 3    // 限速检测的速率档数，每档发送间隔加倍
+	rateLimitGap    = 0.25 // 最慢一档的应答率至少比最快一档高出多少才判为限速
+	rateRetryRounds = 3    // 限速跳上重传超时探测的最多轮数，每轮发送间隔加倍
+)
+
+// checkRateLimit 该跳部分探测超时，在该跳用同一个流按逐档减半的速率各发送一组探测，
+// 应答率随速率降低而明显升高时判为路由器对 ICMP 差错报文限速，并以退避的间隔重传超时的探测。
+// 返回重传后该跳的应答地址
+func (app *TraceApp) checkRateLimit(ttl uint8, cur []string) []string {
+	flow, ok := app.responderFlow(cur)
+	if !ok {
+		return cur
+	}
+	interval := app.sendInterval()
+	ratios := make([]float64, 0, rateTestSteps)
+	for step := 0; step < rateTestSteps; step++ {
+		if atomic.LoadUint32(&app.Exit) == 1 {
+			return cur
+		}
+		probes := make([]*ds.SendPacket, rateTestProbes)
+		for i := range probes {
+			probes[i] = &ds.SendPacket{TTL: ttl, FlowID: flow, Uncounted: true}
+		}
+		answered := 0
+		for _, v := range app.probeRepliesAt(probes, interval<<step) {
+			if v != nil {
+				answered++
+			}
+		}
+		ratios = append(ratios, float64(answered)/rateTestProbes)
+	}
+	logrus.Infof("rate limit test at ttl %d, flow %d, response ratios %v", ttl, flow, ratios)
+	if ratios[len(ratios)-1] == 0 || ratios[len(ratios)-1]-ratios[0] < rateLimitGap {
+		return cur
+	}
+
+	app.flowLock.Lock()
+	app.rateLimited[ttl] = true
+	app.flowLock.Unlock()
+	return app.retryLost(ttl, cur, interval<<rateTestSteps)
+}
+
+// responderFlow 该跳某个应答地址最近一次应答所用的流
+func (app *TraceApp) responderFlow(cur []string) (uint16, bool) {
+	app.ResFlowIDLock.RLock()
+	defer app.ResFlowIDLock.RUnlock()
+	for _, a := range cur {
+		if f, ok := app.ResFlowIDMap[a]; ok && a != starAddr {
+			return uint16(f), true
+		}
+	}
+	return 0, false
+}
+
+// retryLost 从 interval 开始以逐轮加倍的间隔重传该跳超时的探测，直到没有超时或达到轮数上限。
+// MDA 下重传超时的流，应答由 match 记入流表；简单模式下重新发送 FirstSendCnt 个探测
+func (app *TraceApp) retryLost(ttl uint8, cur []string, interval time.Duration) []string {
+	set := make(map[string]bool)
+	for _, a := range cur {
+		if a != starAddr {
+			set[a] = true
+		}
+	}
+	lost := true
+	for round := 0; round < rateRetryRounds && lost; round++ {
+		if atomic.LoadUint32(&app.Exit) == 1 {
+			break
+		}
+		var probes []*ds.SendPacket
+		if app.mode == ModeSimple {
+			for i := 0; i < app.firstSendCnt(); i++ {
+				probes = append(probes, &ds.SendPacket{TTL: ttl, Uncounted: true})
+			}
+		} else {
+			for _, f := range app.flowsVia(ttl, starAddr) {
+				probes = append(probes, &ds.SendPacket{TTL: ttl, FlowID: f, Uncounted: true})
+			}
+		}
+		if len(probes) == 0 {
+			lost = false
+			break
+		}
+		lost = false
+		for _, v := range app.probeRepliesAt(probes, interval<<round) {
+			if v == nil {
+				lost = true
+				continue
+			}
+			set[v.ResAddr] = true
+		}
+	}
+
+	if app.mode != ModeSimple {
+		return app.vertices(ttl)
+	}
+	res := make([]string, 0, len(set)+1)
+	for a := range set {
+		res = append(res, a)
+	}
+	if lost {
+		res = append(res, starAddr)
+	}
+	sort.Strings(res)
+	return res
+}
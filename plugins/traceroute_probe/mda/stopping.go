@@ -0,0 +1,99 @@
+package mda
+
+import "sync"
+
+// DefaultAlpha MDA 默认的失败概率上界，即每个顶点以 95% 的置信度枚举出全部下一跳
+const DefaultAlpha = 0.05
+
+// maxStoppingK 停止点表最多计算到的下一跳个数，超过后沿用最后一个停止点的增量
+const maxStoppingK = 128
+
+// StoppingPoints Veitch/Augustin 的 n_k 停止点表：某顶点已发现 k 个下一跳时，
+// 至少要用 n_k 个不同的流标识经过该顶点探测下一跳，才能以不超过 alpha 的失败概率
+// 排除存在第 k+1 个下一跳的假设。假设负载均衡在下一跳之间是均匀的。
+type StoppingPoints struct {
+	Alpha float64
+	n     []int // n[k] 即 n_k，n[0] 不使用
+	lock  sync.Mutex
+}
+
+var (
+	stoppingTables = make(map[float64]*StoppingPoints)
+	stoppingLock   sync.Mutex
+)
+
+// NewStoppingPoints 返回 alpha 对应的停止点表，相同 alpha 的表只计算一次
+func NewStoppingPoints(alpha float64) *StoppingPoints {
+	if alpha <= 0 || alpha >= 1 {
+		alpha = DefaultAlpha
+	}
+	stoppingLock.Lock()
+	defer stoppingLock.Unlock()
+	sp, ok := stoppingTables[alpha]
+	if !ok {
+		sp = &StoppingPoints{Alpha: alpha, n: []int{0}}
+		stoppingTables[alpha] = sp
+	}
+	return sp
+}
+
+// N 已发现 k 个下一跳时的停止点 n_k，k 小于 1 时按 1 处理
+func (sp *StoppingPoints) N(k int) int {
+	if k < 1 {
+		k = 1
+	}
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	if k > maxStoppingK {
+		last := len(sp.n) - 1
+		for ; last < maxStoppingK; last = len(sp.n) - 1 {
+			sp.n = append(sp.n, sp.compute(last+1))
+		}
+		return sp.n[last] + (k-last)*(sp.n[last]-sp.n[last-1])
+	}
+	for len(sp.n) <= k {
+		sp.n = append(sp.n, sp.compute(len(sp.n)))
+	}
+	return sp.n[k]
+}
+
+// compute 求满足 missProbability(k+1, n) <= alpha 的最小 n，从 n_{k-1} 开始搜索
+func (sp *StoppingPoints) compute(k int) int {
+	n := sp.n[len(sp.n)-1]
+	if n < k+1 {
+		n = k + 1
+	}
+	for missProbability(k+1, n) > sp.Alpha {
+		n++
+	}
+	return n
+}
+
+// Confidence 向 k+1 个均匀负载的下一跳发送 n 个探测后，可以排除第 k+1 个下一跳存在的置信度
+func (sp *StoppingPoints) Confidence(k int, n int) float64 {
+	if k < 1 {
+		k = 1
+	}
+	return 1 - missProbability(k+1, n)
+}
+
+// missProbability 在 hops 个均匀负载的下一跳上发送 n 个探测，至少有一个下一跳未被发现的概率。
+// 按已发现下一跳个数做递推，避免容斥展开在 hops 较大时的数值误差。
+func missProbability(hops int, n int) float64 {
+	if hops <= 1 {
+		return 0
+	}
+	if n < hops {
+		return 1
+	}
+	p := make([]float64, hops+1) // p[j] 已发现 j 个下一跳的概率
+	p[0] = 1
+	h := float64(hops)
+	for i := 0; i < n; i++ {
+		for j := hops; j >= 1; j-- {
+			p[j] = p[j]*float64(j)/h + p[j-1]*float64(hops-j+1)/h
+		}
+		p[0] = 0
+	}
+	return 1 - p[hops]
+}
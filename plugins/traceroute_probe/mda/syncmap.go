@@ -20,6 +20,8 @@ type SyncMap struct {
 	ExpireTime sync.Map
 	exit       uint32
 	keys       []uint32 // 排序插入
+	keysLock   sync.Mutex
+	onExpire   func(key, value interface{})
 
 	Repeat bool // 标记是否有相同key对应同一个val，专门为判断负载均衡类型设定的
 }
@@ -34,7 +36,7 @@ func NewSyncMap(name string, timeout time.Duration, checkfreq time.Duration) *Sy
 		Timeout:   t,
 		CheckFreq: f,
 		exit:      0,
-		keys:      make([]uint32, 256),
+		keys:      make([]uint32, 0, 256),
 		Repeat:    false,
 	}
 }
@@ -99,7 +101,9 @@ func (m *SyncMap) Store(key interface{}, value interface{}, currentTime time.Tim
 	}
 	m.Data.Store(key, value)
 	//m.keys = append(m.keys, key.(uint32))
+	m.keysLock.Lock()
 	util.SortInsertUint32(&m.keys, key.(uint32))
+	m.keysLock.Unlock()
 }
 
 //UpdateTime is used update specific key's expiretime.
@@ -112,6 +116,8 @@ func (m *SyncMap) Delete(key interface{}) {
 	m.Data.Delete(key)
 	m.ExpireTime.Delete(key)
 
+	m.keysLock.Lock()
+	defer m.keysLock.Unlock()
 	for i, _ := range m.keys {
 		if m.keys[i] == key.(uint32) {
 			m.keys = append(m.keys[:i], m.keys[i+1:]...)
@@ -120,6 +126,20 @@ func (m *SyncMap) Delete(key interface{}) {
 	}
 }
 
+// LoadAndDelete 取出并删除 key，多个调用方同时取同一个 key 时只有一个得到 ok 为 true
+func (m *SyncMap) LoadAndDelete(key interface{}) (value interface{}, ok bool) {
+	value, ok = m.Data.LoadAndDelete(key)
+	if ok {
+		m.Delete(key)
+	}
+	return value, ok
+}
+
+// OnExpire 设置数据超时被删除前的回调，在 RunCheck 协程中调用
+func (m *SyncMap) OnExpire(f func(key, value interface{})) {
+	m.onExpire = f
+}
+
 // RunCheck 检查map中数据是否存在超时，检查间隔为 CheckFreq
 func (m *SyncMap) RunCheck() {
 	rand.Seed(time.Now().UnixNano())
@@ -133,7 +153,12 @@ func (m *SyncMap) RunCheck() {
 		m.ExpireTime.Range(func(k, v interface{}) bool {
 			value := v.(time.Time)
 			if value.Sub(currentTime) < 0 {
-				m.Delete(k)
+				// 只有取到数据的一方处理该 key，避免与其他删除方重复处理
+				if data, ok := m.LoadAndDelete(k); !ok {
+					m.Delete(k)
+				} else if m.onExpire != nil {
+					m.onExpire(k, data)
+				}
 			}
 			return true
 		})
@@ -142,6 +167,8 @@ func (m *SyncMap) RunCheck() {
 }
 
 func (m *SyncMap) Len() int {
+	m.keysLock.Lock()
+	defer m.keysLock.Unlock()
 	return len(m.keys)
 }
 
@@ -151,5 +178,5 @@ func (m *SyncMap) Close() {
 }
 
 func (m *SyncMap) String() string {
-	return fmt.Sprintf("{Name: %s, Data: %v, Timeout: %d, CheckFreq: %d, ExpireTime: %v}", m.Name, m.Data, m.Timeout, m.CheckFreq, m.ExpireTime)
+	return fmt.Sprintf("{Name: %s, Len: %d, Timeout: %d, CheckFreq: %d}", m.Name, m.Len(), m.Timeout, m.CheckFreq)
 }
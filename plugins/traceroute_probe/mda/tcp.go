@@ -0,0 +1,78 @@
+package mda
+
+import (
+	"encoding/binary"
+	"mda-traceroute-go/plugins/traceroute_probe/netio"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"net"
+)
+
+// TCP SYN 探测：流标识编码在源端口，目的端口为任务指定的服务端口；
+// 探测标识编码在序列号低 16 位，中间跳的 Time Exceeded 引用 TCP 头部前 8 字节即可取回，
+// 目的端的 SYN-ACK/RST 中确认号减一即为探测标识。
+var (
+	TCPBaseSrcPort uint16 = 20000
+	TCPDefaultPort uint16 = 80
+)
+
+const tcpHeaderLen = 24 // 20 字节基本头部 + 4 字节 MSS 选项
+
+type TCPApp struct {
+	*TraceApp
+	dstPort uint16
+}
+
+func NewTCPApp(conf *ProberConf) (*TCPApp, error) {
+	base, err := newTraceApp(conf, ProtocolTCP)
+	if err != nil {
+		return nil, err
+	}
+	dstPort := conf.Port
+	if dstPort == 0 {
+		dstPort = TCPDefaultPort
+	}
+	app := &TCPApp{
+		TraceApp: base,
+		dstPort:  dstPort,
+	}
+	app.engine = app
+	return app, nil
+}
+
+func (app *TCPApp) buildTransport(dst net.IP, flowID uint16, id uint16, size int) []byte {
+	return app.buildTCP(dst, flowID, id, size)
+}
+
+func (app *TCPApp) protocol() int {
+	return 6
+}
+
+// buildTCP size 大于 TCP 头部长度时 SYN 携带填充的负载
+func (app *TCPApp) buildTCP(dst net.IP, flowID uint16, id uint16, size int) []byte {
+	buf := make([]byte, tcpHeaderLen)
+	if size > tcpHeaderLen {
+		buf = make([]byte, size)
+	}
+	binary.BigEndian.PutUint16(buf[0:2], TCPBaseSrcPort+flowID)
+	binary.BigEndian.PutUint16(buf[2:4], app.dstPort)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(id))
+	buf[12] = (tcpHeaderLen / 4) << 4
+	buf[13] = netio.TCPFlagSYN
+	binary.BigEndian.PutUint16(buf[14:16], 5840)
+	// MSS 选项，不带选项的 SYN 容易被防火墙丢弃
+	buf[20], buf[21] = 2, 4
+	binary.BigEndian.PutUint16(buf[22:24], 1460)
+
+	pseudo := app.pseudoHeader(dst, 6, len(buf))
+	binary.BigEndian.PutUint16(buf[16:18], utils.CheckSum(append(pseudo, buf...)))
+
+	return buf
+}
+
+// acceptDirect 目的端对本任务 SYN 的应答（SYN-ACK 或 RST），收到即认为已到达目的端
+func (app *TCPApp) acceptDirect(r *netio.Reply) bool {
+	if r.Proto != netio.ProtoTCP || !app.ownsDst(r.Src) {
+		return false
+	}
+	return r.SrcPort == app.dstPort && r.DstPort >= TCPBaseSrcPort
+}
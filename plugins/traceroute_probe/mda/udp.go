@@ -0,0 +1,69 @@
+package mda
+
+import (
+	"encoding/binary"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"net"
+)
+
+// Paris traceroute 的 UDP 探测：流标识编码在源端口，目的端口固定，
+// 同一条流的五元组保持不变；探测标识编码在 UDP 校验和中，
+// 通过调整负载前两个字节使校验和恰好等于探测标识。
+var (
+	UDPBaseSrcPort uint16 = 10000
+	UDPDstPort     uint16 = 33434
+)
+
+const (
+	udpHeaderLen  = 8
+	udpPayloadLen = 32
+)
+
+type UDPApp struct {
+	*TraceApp
+}
+
+func NewUDPApp(conf *ProberConf) (*UDPApp, error) {
+	base, err := newTraceApp(conf, ProtocolUDP)
+	if err != nil {
+		return nil, err
+	}
+	app := &UDPApp{TraceApp: base}
+	app.engine = app
+	return app, nil
+}
+
+func (app *UDPApp) buildTransport(dst net.IP, flowID uint16, id uint16, size int) []byte {
+	return app.buildUDP(dst, flowID, id, size)
+}
+
+func (app *UDPApp) protocol() int {
+	return 17
+}
+
+func (app *UDPApp) buildUDP(dst net.IP, flowID uint16, id uint16, size int) []byte {
+	udpLen := udpHeaderLen + udpPayloadLen
+	if size > 0 {
+		// 至少保留两个字节的校验和调整位
+		udpLen = size
+		if udpLen < udpHeaderLen+2 {
+			udpLen = udpHeaderLen + 2
+		}
+	}
+
+	buf := make([]byte, udpLen)
+	binary.BigEndian.PutUint16(buf[0:2], UDPBaseSrcPort+flowID)
+	binary.BigEndian.PutUint16(buf[2:4], UDPDstPort)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(udpLen))
+	// 负载前两个字节留作校验和调整位
+	for i := udpHeaderLen + 2; i < udpLen; i++ {
+		buf[i] = uint8(i - udpHeaderLen + 64)
+	}
+
+	pseudo := app.pseudoHeader(dst, 17, udpLen)
+	sum := utils.Sum16(append(pseudo, buf...))
+	binary.BigEndian.PutUint16(buf[udpHeaderLen:udpHeaderLen+2], utils.ForgeCheckSum(sum, id))
+	binary.BigEndian.PutUint16(buf[6:8], id)
+
+	return buf
+}
@@ -0,0 +1,57 @@
+package mda
+
+import (
+	"encoding/binary"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"net"
+	"testing"
+)
+
+func TestBuildUDPChecksumCarriesProbeID(t *testing.T) {
+	for _, addrs := range [][2]string{
+		{"10.0.0.1", "10.0.9.1"},
+		{"2001:db8::1", "2001:db8:9::1"},
+	} {
+		src, dst := net.ParseIP(addrs[0]), net.ParseIP(addrs[1])
+		app := &UDPApp{TraceApp: &TraceApp{srcAddr: src, DstAddr: dst, Protocol: ProtocolUDP}}
+		for _, id := range []uint16{1, 2, 0x00ff, 0x1234, 0x7fff, 0x8000, 0xfffe, 0xffff} {
+			for _, flow := range []uint16{0, 1, 7, 255} {
+				for _, size := range []int{0, 8, 10, 64, 1472} {
+					buf := app.buildUDP(dst, flow, id, size)
+					if sport := binary.BigEndian.Uint16(buf[0:2]); sport != UDPBaseSrcPort+flow {
+						t.Errorf("%s flow %d: src port %d", dst, flow, sport)
+					}
+					if dport := binary.BigEndian.Uint16(buf[2:4]); dport != UDPDstPort {
+						t.Errorf("%s: dst port %d", dst, dport)
+					}
+					if l := int(binary.BigEndian.Uint16(buf[4:6])); l != len(buf) {
+						t.Errorf("%s size %d: length field %d, packet %d bytes", dst, size, l, len(buf))
+					}
+					sum := binary.BigEndian.Uint16(buf[6:8])
+					if sum != id || sum == 0 {
+						t.Errorf("%s id %#x flow %d size %d: checksum field %#x", dst, id, flow, size, sum)
+					}
+					// 接收方按伪首部校验：包括校验和字段在内的反码和为 0xffff。
+					// 计算结果为 0 时按 RFC 768 发送 0xffff，两者在反码运算中等价
+					pseudo := app.pseudoHeader(dst, 17, len(buf))
+					if got := utils.Sum16(append(pseudo, buf...)); got != 0xffff {
+						t.Errorf("%s id %#x flow %d size %d: checksum does not verify, sum %#x", dst, id, flow, size, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestForgeCheckSum(t *testing.T) {
+	for _, sum := range []uint16{0, 1, 0x1234, 0x8000, 0xfffe, 0xffff} {
+		for _, want := range []uint16{1, 0x00ff, 0x1234, 0xfffe, 0xffff} {
+			// 填入调整值后，want 作为校验和字段能通过校验
+			fill := utils.ForgeCheckSum(sum, want)
+			buf := []byte{byte(sum >> 8), byte(sum), byte(fill >> 8), byte(fill), byte(want >> 8), byte(want)}
+			if got := utils.Sum16(buf); got != 0xffff {
+				t.Errorf("ForgeCheckSum(%#x, %#x) = %#x, checksum sum %#x", sum, want, fill, got)
+			}
+		}
+	}
+}
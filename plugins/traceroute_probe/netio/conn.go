@@ -0,0 +1,198 @@
+package netio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conn 探测节点收发原始 IP 报文的接口。真实网络由 RawConn 实现，
+// 测试时可以替换为模拟网络，上层的探测逻辑不感知二者的区别。
+type Conn interface {
+	// WritePacket 发送一个完整的 IP 报文（含 IPv4/IPv6 头部）
+	WritePacket(pkt []byte) error
+	// ReadPacket 阻塞读取一个收到的完整 IP 报文及其到达时间
+	ReadPacket() ([]byte, time.Time, error)
+	Close() error
+}
+
+type rawPacket struct {
+	pkt []byte
+	ts  time.Time
+}
+
+// RawConn 基于原始套接字的 Conn 实现，整个探测节点只打开一组：
+// IPv4 通过 IP_HDRINCL 发送自行构造的报文，同时接收 ICMP 和 TCP；
+// IPv6 通过 IPPROTO_RAW 发送，ICMPv6 和 TCP 的接收套接字不带 IPv6 头部，
+// 由控制消息中的跳数限制和目的地址补齐，对上层同样呈现为完整报文。
+type RawConn struct {
+	conns []net.PacketConn
+	icmp4 *ipv4.RawConn
+	send6 net.PacketConn
+
+	recvCh chan rawPacket
+	errCh  chan error
+	exit   uint32
+	once   sync.Once
+}
+
+// NewRawConn 打开探测所需的原始套接字，IPv6 不可用时只记录告警
+func NewRawConn() (*RawConn, error) {
+	c := &RawConn{
+		recvCh: make(chan rawPacket, 4096),
+		errCh:  make(chan error, 1),
+	}
+
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	c.icmp4, err = ipv4.NewRawConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.conns = append(c.conns, conn)
+	go c.readIPv4(c.icmp4)
+
+	if conn, err := net.ListenPacket("ip4:tcp", "0.0.0.0"); err != nil {
+		logrus.Warningf("open ipv4 tcp raw socket error: %v", err)
+	} else if rc, err := ipv4.NewRawConn(conn); err != nil {
+		conn.Close()
+		logrus.Warningf("open ipv4 tcp raw socket error: %v", err)
+	} else {
+		c.conns = append(c.conns, conn)
+		go c.readIPv4(rc)
+	}
+
+	if conn, err := net.ListenPacket("ip6:255", "::"); err != nil {
+		logrus.Warningf("ipv6 is not available: %v", err)
+	} else {
+		c.send6 = conn
+		c.conns = append(c.conns, conn)
+		c.listenIPv6("ip6:ipv6-icmp", 58)
+		c.listenIPv6("ip6:tcp", 6)
+	}
+	return c, nil
+}
+
+func (c *RawConn) listenIPv6(network string, proto uint8) {
+	conn, err := net.ListenPacket(network, "::")
+	if err != nil {
+		logrus.Warningf("open %s raw socket error: %v", network, err)
+		return
+	}
+	pc := ipv6.NewPacketConn(conn)
+	if err := pc.SetControlMessage(ipv6.FlagHopLimit|ipv6.FlagDst, true); err != nil {
+		logrus.Warningf("set %s control message error: %v", network, err)
+	}
+	c.conns = append(c.conns, conn)
+	go c.readIPv6(pc, proto)
+}
+
+func (c *RawConn) WritePacket(pkt []byte) error {
+	if len(pkt) == 0 {
+		return fmt.Errorf("empty packet")
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		h, err := ipv4.ParseHeader(pkt)
+		if err != nil {
+			return err
+		}
+		return c.icmp4.WriteTo(h, pkt[h.Len:], nil)
+	case 6:
+		if c.send6 == nil {
+			return fmt.Errorf("ipv6 is not available")
+		}
+		if len(pkt) < ipv6.HeaderLen {
+			return fmt.Errorf("short ipv6 packet")
+		}
+		_, err := c.send6.WriteTo(pkt, &net.IPAddr{IP: net.IP(pkt[24:40])})
+		return err
+	default:
+		return fmt.Errorf("unknown ip version %d", pkt[0]>>4)
+	}
+}
+
+func (c *RawConn) ReadPacket() ([]byte, time.Time, error) {
+	select {
+	case p := <-c.recvCh:
+		return p.pkt, p.ts, nil
+	case err := <-c.errCh:
+		return nil, time.Time{}, err
+	}
+}
+
+func (c *RawConn) Close() error {
+	c.once.Do(func() {
+		atomic.StoreUint32(&c.exit, 1)
+		for _, conn := range c.conns {
+			conn.Close()
+		}
+		c.errCh <- net.ErrClosed
+	})
+	return nil
+}
+
+func (c *RawConn) readIPv4(rc *ipv4.RawConn) {
+	buf := make([]byte, 65535)
+	for {
+		h, p, _, err := rc.ReadFrom(buf)
+		ts := time.Now()
+		if err != nil {
+			if atomic.LoadUint32(&c.exit) == 0 {
+				logrus.Errorf("read ipv4 raw socket error: %v", err)
+			}
+			return
+		}
+		hb, err := h.Marshal()
+		if err != nil {
+			continue
+		}
+		pkt := make([]byte, 0, len(hb)+len(p))
+		pkt = append(append(pkt, hb...), p...)
+		c.push(pkt, ts)
+	}
+}
+
+func (c *RawConn) readIPv6(pc *ipv6.PacketConn, proto uint8) {
+	buf := make([]byte, 65535)
+	for {
+		n, cm, src, err := pc.ReadFrom(buf)
+		ts := time.Now()
+		if err != nil {
+			if atomic.LoadUint32(&c.exit) == 0 {
+				logrus.Errorf("read ipv6 raw socket error: %v", err)
+			}
+			return
+		}
+		pkt := make([]byte, ipv6.HeaderLen+n)
+		pkt[0] = 6 << 4
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(n))
+		pkt[6] = proto
+		if cm != nil {
+			pkt[7] = uint8(cm.HopLimit)
+			copy(pkt[24:40], cm.Dst.To16())
+		}
+		if a, ok := src.(*net.IPAddr); ok {
+			copy(pkt[8:24], a.IP.To16())
+		}
+		copy(pkt[ipv6.HeaderLen:], buf[:n])
+		c.push(pkt, ts)
+	}
+}
+
+func (c *RawConn) push(pkt []byte, ts time.Time) {
+	select {
+	case c.recvCh <- rawPacket{pkt: pkt, ts: ts}:
+	default:
+		logrus.Warningf("raw socket receive queue is full, drop packet.")
+	}
+}
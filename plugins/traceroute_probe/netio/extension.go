@@ -0,0 +1,136 @@
+package netio
+
+import (
+	"encoding/binary"
+	cds "mda-traceroute-go/dataStruct"
+	"net"
+	"strings"
+)
+
+const (
+	extVersion           = 2   // ICMP 扩展结构的版本号（RFC 4884）
+	extCompatOffset      = 128 // 不带长度字段的实现固定引用 128 字节的原始报文
+	extClassMPLS         = 1   // MPLS 标签栈对象
+	extClassInterface    = 2   // 接口信息对象
+	extCTypeMPLSIncoming = 1
+)
+
+// parseExtensions 解析 ICMP 差错报文中原始报文之后的多部分扩展。
+// 原始报文的长度取自 RFC 4884 的长度字段，IPv4 以 4 字节为单位，ICMPv6 以 8 字节为单位；
+// 长度为 0 时按 128 字节兼容旧实现，并通过版本号和校验和排除误判。
+func (r *Reply) parseExtensions(msg []byte) {
+	off := 0
+	if r.Proto == ProtoICMPv6 {
+		off = int(msg[4]) * 8
+	} else {
+		off = int(msg[5]) * 4
+	}
+	if off == 0 {
+		off = extCompatOffset
+	}
+	off += 8
+	if len(msg) < off+4 {
+		return
+	}
+	ext := msg[off:]
+	if ext[0]>>4 != extVersion {
+		return
+	}
+	if binary.BigEndian.Uint16(ext[2:4]) != 0 && checksum(ext) != 0 {
+		return
+	}
+
+	objs := ext[4:]
+	for len(objs) >= 4 {
+		l := int(binary.BigEndian.Uint16(objs[0:2]))
+		if l < 4 || l > len(objs) {
+			return
+		}
+		class, ctype, payload := objs[2], objs[3], objs[4:l]
+		switch {
+		case class == extClassMPLS && ctype == extCTypeMPLSIncoming:
+			r.MPLS = append(r.MPLS, parseMPLS(payload)...)
+		case class == extClassInterface:
+			if info, ok := parseInterfaceInfo(ctype, payload); ok {
+				r.Interfaces = append(r.Interfaces, info)
+			}
+		}
+		objs = objs[l:]
+	}
+}
+
+// parseMPLS 每个标签栈条目 4 字节：标签 20 位、TC 3 位、栈底标志 1 位、TTL 8 位
+func parseMPLS(b []byte) []cds.MPLSLabel {
+	var labels []cds.MPLSLabel
+	for ; len(b) >= 4; b = b[4:] {
+		v := binary.BigEndian.Uint32(b[0:4])
+		labels = append(labels, cds.MPLSLabel{
+			Label: v >> 12,
+			TC:    uint8(v>>9) & 0x07,
+			S:     v&0x100 != 0,
+			TTL:   uint8(v),
+		})
+	}
+	return labels
+}
+
+// parseInterfaceInfo 接口信息对象的 C-Type 高 2 位为接口角色，低 4 位依次表示是否携带
+// ifIndex、IP 地址、接口名和 MTU 子对象，子对象按该顺序排列
+func parseInterfaceInfo(ctype uint8, b []byte) (cds.InterfaceInfo, bool) {
+	info := cds.InterfaceInfo{Role: ctype >> 6}
+	if ctype&0x08 != 0 {
+		if len(b) < 4 {
+			return info, false
+		}
+		info.IfIndex = binary.BigEndian.Uint32(b[0:4])
+		b = b[4:]
+	}
+	if ctype&0x04 != 0 {
+		if len(b) < 4 {
+			return info, false
+		}
+		afi := binary.BigEndian.Uint16(b[0:2])
+		n := 4
+		if afi == 2 {
+			n = 16
+		}
+		if len(b) < 4+n {
+			return info, false
+		}
+		info.Addr = net.IP(b[4 : 4+n]).String()
+		b = b[4+n:]
+	}
+	if ctype&0x02 != 0 {
+		if len(b) < 1 {
+			return info, false
+		}
+		l := int(b[0])
+		if l < 1 || len(b) < l {
+			return info, false
+		}
+		info.Name = strings.TrimRight(string(b[1:l]), "\x00")
+		b = b[l:]
+	}
+	if ctype&0x01 != 0 {
+		if len(b) < 4 {
+			return info, false
+		}
+		info.MTU = binary.BigEndian.Uint32(b[0:4])
+	}
+	return info, true
+}
+
+// checksum 互联网校验和，数据含正确的校验和时结果为 0
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,91 @@
+package netio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// 经典 libpcap 文件格式：纳秒精度时间戳的魔数，链路类型为不带链路层头部的原始 IP 报文
+const (
+	pcapMagicNano    = 0xa1b23c4d
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	pcapSnapLen      = 65535
+	pcapLinkTypeRaw  = 101
+)
+
+// PcapWriter 把收发的完整 IP 报文按 libpcap 格式写入文件，可以被多个协程同时调用
+type PcapWriter struct {
+	lock   sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	closed bool
+}
+
+// NewPcapWriter 创建 path 并写入 pcap 文件头
+func NewPcapWriter(path string) (*PcapWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &PcapWriter{file: f, w: bufio.NewWriter(f)}
+	if err := writePcapHeader(p.w); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func writePcapHeader(w io.Writer) error {
+	h := make([]byte, 24)
+	binary.LittleEndian.PutUint32(h[0:4], pcapMagicNano)
+	binary.LittleEndian.PutUint16(h[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(h[6:8], pcapVersionMinor)
+	// 8:16 为时区偏移和时间戳精度，均为 0
+	binary.LittleEndian.PutUint32(h[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(h[20:24], pcapLinkTypeRaw)
+	_, err := w.Write(h)
+	return err
+}
+
+// WritePacket 记录一个在 ts 时刻发送或收到的 IP 报文，关闭后的写入被忽略
+func (p *PcapWriter) WritePacket(ts time.Time, pkt []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil
+	}
+	capLen := len(pkt)
+	if capLen > pcapSnapLen {
+		capLen = pcapSnapLen
+	}
+	h := make([]byte, 16)
+	binary.LittleEndian.PutUint32(h[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(h[4:8], uint32(ts.Nanosecond()))
+	binary.LittleEndian.PutUint32(h[8:12], uint32(capLen))
+	binary.LittleEndian.PutUint32(h[12:16], uint32(len(pkt)))
+	if _, err := p.w.Write(h); err != nil {
+		return err
+	}
+	_, err := p.w.Write(pkt[:capLen])
+	return err
+}
+
+// Close 把缓冲的报文写入文件并关闭文件
+func (p *PcapWriter) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	err := p.w.Flush()
+	if cerr := p.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
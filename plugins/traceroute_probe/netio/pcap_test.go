@@ -0,0 +1,84 @@
+package netio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPcapWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "task.pcap")
+	p, err := NewPcapWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := []byte{0x45, 0, 0, 28, 1, 2, 3, 4}
+	big := bytes.Repeat([]byte{0xab}, pcapSnapLen+100)
+	ts1 := time.Unix(1700000000, 123456789)
+	ts2 := time.Unix(1700000001, 999999999)
+	if err := p.WritePacket(ts1, small); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.WritePacket(ts2, big); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 关闭后的写入被忽略
+	if err := p.WritePacket(ts2, small); err != nil {
+		t.Errorf("write after close: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 24+16+len(small)+16+pcapSnapLen {
+		t.Fatalf("file is %d bytes", len(data))
+	}
+	le := binary.LittleEndian
+	hdr := data[:24]
+	if m := le.Uint32(hdr[0:4]); m != 0xa1b23c4d {
+		t.Errorf("magic %#x, want nanosecond magic 0xa1b23c4d", m)
+	}
+	if major, minor := le.Uint16(hdr[4:6]), le.Uint16(hdr[6:8]); major != 2 || minor != 4 {
+		t.Errorf("version %d.%d", major, minor)
+	}
+	if !bytes.Equal(hdr[8:16], make([]byte, 8)) {
+		t.Errorf("thiszone/sigfigs % x", hdr[8:16])
+	}
+	if s := le.Uint32(hdr[16:20]); s != 65535 {
+		t.Errorf("snaplen %d", s)
+	}
+	if l := le.Uint32(hdr[20:24]); l != 101 {
+		t.Errorf("linktype %d, want LINKTYPE_RAW 101", l)
+	}
+
+	rest := data[24:]
+	for _, want := range []struct {
+		ts           time.Time
+		capLen, orig int
+		pkt          []byte
+	}{
+		{ts1, len(small), len(small), small},
+		{ts2, pcapSnapLen, len(big), big[:pcapSnapLen]},
+	} {
+		rec := rest[:16]
+		sec, nsec := le.Uint32(rec[0:4]), le.Uint32(rec[4:8])
+		capLen, orig := int(le.Uint32(rec[8:12])), int(le.Uint32(rec[12:16]))
+		if int64(sec) != want.ts.Unix() || int(nsec) != want.ts.Nanosecond() {
+			t.Errorf("timestamp %d.%09d, want %d.%09d", sec, nsec, want.ts.Unix(), want.ts.Nanosecond())
+		}
+		if capLen != want.capLen || orig != want.orig {
+			t.Errorf("caplen %d len %d, want %d %d", capLen, orig, want.capLen, want.orig)
+		}
+		if !bytes.Equal(rest[16:16+capLen], want.pkt) {
+			t.Errorf("packet data differs")
+		}
+		rest = rest[16+capLen:]
+	}
+}
@@ -0,0 +1,241 @@
+package netio
+
+import (
+	"encoding/binary"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	cds "mda-traceroute-go/dataStruct"
+	"net"
+	"time"
+)
+
+// 应答报文涉及的协议号
+const (
+	ProtoICMP   = 1
+	ProtoTCP    = 6
+	ProtoUDP    = 17
+	ProtoICMPv6 = 58
+)
+
+// ICMP/ICMPv6 中与探测相关的类型
+const (
+	icmpEchoReply      = 0
+	icmpDestUnreach    = 3
+	icmpSourceQuench   = 4
+	icmpTimeExceeded   = 11
+	icmpParamProblem   = 12
+	icmpv6DestUnreach  = 1
+	icmpv6PacketTooBig = 2
+	icmpv6TimeExceeded = 3
+	icmpv6ParamProblem = 4
+	icmpv6EchoReply    = 129
+
+	icmpFragNeeded = 4 // Destination Unreachable 中的 Fragmentation Needed and DF Set
+)
+
+// TCP 标志位
+const (
+	TCPFlagSYN = 0x02
+	TCPFlagRST = 0x04
+	TCPFlagACK = 0x10
+)
+
+// Quoted ICMP 差错报文中引用的原始探测包
+type Quoted struct {
+	Proto     int
+	Src       net.IP
+	Dst       net.IP
+	TTL       uint8 // 引用的 TTL/跳数限制，即差错报文生成时探测包剩余的 TTL
+	TOS       uint8 // 引用的 TOS/流量类别
+	IPID      uint16
+	TotalLen  int
+	Transport []byte // 引用的传输层头部，至少 8 字节
+}
+
+// Reply 解析后的应答报文
+type Reply struct {
+	Packet    []byte // 完整的 IP 报文
+	Src       net.IP
+	Dst       net.IP
+	TTL       uint8  // 应答报文自身的 TTL/跳数限制
+	IPID      uint16 // 应答报文的 IP ID，IPv6 为 0
+	Proto     int    // 应答报文的协议：ICMP / ICMPv6 / TCP
+	ICMPType  uint8
+	ICMPCode  uint8
+	ICMP      []byte  // 完整的 ICMP 消息，TCP 应答为 nil
+	Quoted    *Quoted // 差错报文引用的原始探测包，回显应答和 TCP 应答为 nil
+	SrcPort   uint16  // TCP 应答的端口
+	DstPort   uint16
+	TCPFlags  uint8
+	ProbeID   uint16
+	TimeStamp time.Time
+
+	MPLS       []cds.MPLSLabel     // 差错报文多部分扩展中的 MPLS 标签栈
+	Interfaces []cds.InterfaceInfo // 差错报文多部分扩展中的接口信息
+	// Fragmentation Needed（RFC 1191）和 Packet Too Big 报告的下一跳 MTU，旧的路由器可能填 0
+	MTU int
+}
+
+// IsError 应答是否为 ICMP 差错报文
+func (r *Reply) IsError() bool {
+	return r.Quoted != nil
+}
+
+// ProbeID 从探测包的传输层头部取出探测标识。所有探测引擎都把探测标识放在传输层头部
+// 第 6~7 字节：ICMP 回显请求的序列号、UDP 的校验和、TCP 序列号的低 16 位。
+// 这 8 个字节一定会被 ICMP 差错报文引用。
+func ProbeID(transport []byte) (uint16, bool) {
+	if len(transport) < 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(transport[6:8]), true
+}
+
+// ParseReply 解析收到的完整 IP 报文，只保留 ICMP 差错、回显应答和 TCP 报文
+func ParseReply(pkt []byte, ts time.Time) (*Reply, bool) {
+	if len(pkt) < 1 {
+		return nil, false
+	}
+	r := &Reply{Packet: pkt, TimeStamp: ts}
+	var payload []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		if len(pkt) < ipv4.HeaderLen {
+			return nil, false
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < ipv4.HeaderLen || len(pkt) < ihl {
+			return nil, false
+		}
+		r.TTL = pkt[8]
+		r.IPID = binary.BigEndian.Uint16(pkt[4:6])
+		r.Proto = int(pkt[9])
+		r.Src = net.IP(pkt[12:16])
+		r.Dst = net.IP(pkt[16:20])
+		payload = pkt[ihl:]
+	case 6:
+		if len(pkt) < ipv6.HeaderLen {
+			return nil, false
+		}
+		r.TTL = pkt[7]
+		r.Proto = int(pkt[6])
+		r.Src = net.IP(pkt[8:24])
+		r.Dst = net.IP(pkt[24:40])
+		payload = pkt[ipv6.HeaderLen:]
+	default:
+		return nil, false
+	}
+
+	switch r.Proto {
+	case ProtoICMP, ProtoICMPv6:
+		return r, r.parseICMP(payload)
+	case ProtoTCP:
+		return r, r.parseTCP(payload)
+	}
+	return nil, false
+}
+
+func (r *Reply) parseICMP(msg []byte) bool {
+	if len(msg) < 8 {
+		return false
+	}
+	r.ICMP = msg
+	r.ICMPType = msg[0]
+	r.ICMPCode = msg[1]
+
+	if r.Proto == ProtoICMPv6 {
+		switch r.ICMPType {
+		case icmpv6EchoReply:
+			r.ProbeID = binary.BigEndian.Uint16(msg[6:8])
+			return true
+		case icmpv6DestUnreach, icmpv6TimeExceeded:
+			if !r.parseQuoted6(msg[8:]) {
+				return false
+			}
+			r.parseExtensions(msg)
+			return true
+		case icmpv6PacketTooBig:
+			r.MTU = int(binary.BigEndian.Uint32(msg[4:8]))
+			return r.parseQuoted6(msg[8:])
+		case icmpv6ParamProblem:
+			return r.parseQuoted6(msg[8:])
+		}
+		return false
+	}
+
+	switch r.ICMPType {
+	case icmpEchoReply:
+		r.ProbeID = binary.BigEndian.Uint16(msg[6:8])
+		return true
+	case icmpDestUnreach, icmpTimeExceeded, icmpParamProblem:
+		if !r.parseQuoted4(msg[8:]) {
+			return false
+		}
+		if r.ICMPType == icmpDestUnreach && r.ICMPCode == icmpFragNeeded {
+			r.MTU = int(binary.BigEndian.Uint16(msg[6:8]))
+		}
+		r.parseExtensions(msg)
+		return true
+	case icmpSourceQuench:
+		return r.parseQuoted4(msg[8:])
+	}
+	return false
+}
+
+func (r *Reply) parseQuoted4(inner []byte) bool {
+	if len(inner) < ipv4.HeaderLen {
+		return false
+	}
+	ihl := int(inner[0]&0x0f) * 4
+	if ihl < ipv4.HeaderLen || len(inner) < ihl+8 {
+		return false
+	}
+	q := &Quoted{
+		Proto:     int(inner[9]),
+		Src:       net.IP(inner[12:16]),
+		Dst:       net.IP(inner[16:20]),
+		TTL:       inner[8],
+		TOS:       inner[1],
+		IPID:      binary.BigEndian.Uint16(inner[4:6]),
+		TotalLen:  int(binary.BigEndian.Uint16(inner[2:4])),
+		Transport: inner[ihl:],
+	}
+	r.Quoted = q
+	r.ProbeID, _ = ProbeID(q.Transport)
+	return true
+}
+
+func (r *Reply) parseQuoted6(inner []byte) bool {
+	if len(inner) < ipv6.HeaderLen+8 {
+		return false
+	}
+	q := &Quoted{
+		Proto:     int(inner[6]),
+		Src:       net.IP(inner[8:24]),
+		Dst:       net.IP(inner[24:40]),
+		TTL:       inner[7],
+		TOS:       uint8(binary.BigEndian.Uint16(inner[0:2]) >> 4),
+		TotalLen:  ipv6.HeaderLen + int(binary.BigEndian.Uint16(inner[4:6])),
+		Transport: inner[ipv6.HeaderLen:],
+	}
+	r.Quoted = q
+	r.ProbeID, _ = ProbeID(q.Transport)
+	return true
+}
+
+// parseTCP 只关心目的端对 SYN 的应答：SYN-ACK 或 RST-ACK，确认号减一即探测时的序列号。
+// 不带 ACK 的 RST 中确认号没有意义，无法对应到探测
+func (r *Reply) parseTCP(seg []byte) bool {
+	if len(seg) < 20 {
+		return false
+	}
+	r.SrcPort = binary.BigEndian.Uint16(seg[0:2])
+	r.DstPort = binary.BigEndian.Uint16(seg[2:4])
+	r.TCPFlags = seg[13]
+	if r.TCPFlags&TCPFlagACK == 0 || r.TCPFlags&(TCPFlagSYN|TCPFlagRST) == 0 {
+		return false
+	}
+	ack := binary.BigEndian.Uint32(seg[8:12])
+	r.ProbeID = uint16(ack - 1)
+	return true
+}
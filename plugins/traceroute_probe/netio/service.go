@@ -0,0 +1,165 @@
+package netio
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBlockSize 每个任务独占的探测标识个数，16 位标识空间共可同时容纳 16 个任务
+const DefaultBlockSize = 4096
+
+// Service 探测节点共享的收发服务：持有唯一的 Conn，为每个任务分配互不重叠的探测标识区间，
+// 并按应答报文中的探测标识把应答转交给对应的任务。
+type Service struct {
+	conn      Conn
+	blockSize int
+	leases    []*Lease
+	lock      sync.RWMutex
+	exit      uint32
+}
+
+// NewService blockSize 不是 2 的幂时向下取整，使各区间恰好铺满 16 位标识空间
+func NewService(conn Conn, blockSize int) *Service {
+	if blockSize <= 0 || blockSize > 1<<16 {
+		blockSize = DefaultBlockSize
+	}
+	if blockSize&(blockSize-1) != 0 {
+		size := 1
+		for size*2 <= blockSize {
+			size *= 2
+		}
+		logrus.Warningf("probe id block size %d does not divide 65536, use %d.", blockSize, size)
+		blockSize = size
+	}
+	return &Service{
+		conn:      conn,
+		blockSize: blockSize,
+		leases:    make([]*Lease, (1<<16)/blockSize),
+	}
+}
+
+// Capacity 可同时持有标识区间的任务数
+func (s *Service) Capacity() int {
+	return len(s.leases)
+}
+
+// Run 读取应答并分发，直到 Close
+func (s *Service) Run() {
+	for {
+		pkt, ts, err := s.conn.ReadPacket()
+		if err != nil {
+			if atomic.LoadUint32(&s.exit) == 0 {
+				logrus.Errorf("netio read packet error: %v", err)
+			}
+			return
+		}
+		r, ok := ParseReply(pkt, ts)
+		if !ok {
+			continue
+		}
+		s.dispatch(r)
+	}
+}
+
+func (s *Service) dispatch(r *Reply) {
+	i := int(r.ProbeID) / s.blockSize
+	if i >= len(s.leases) {
+		return
+	}
+	s.lock.RLock()
+	l := s.leases[i]
+	s.lock.RUnlock()
+	if l == nil {
+		return
+	}
+	select {
+	case l.replies <- r:
+	default:
+		logrus.Warningf("lease [%d, %d) reply queue is full, drop probe %d reply.", l.Start, int(l.Start)+l.Size, r.ProbeID)
+	}
+}
+
+// WritePacket 发送完整的 IP 报文
+func (s *Service) WritePacket(pkt []byte) error {
+	return s.conn.WritePacket(pkt)
+}
+
+// Acquire 为任务分配一段空闲的探测标识区间
+func (s *Service) Acquire() (*Lease, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, l := range s.leases {
+		if l != nil {
+			continue
+		}
+		l = &Lease{
+			svc:     s,
+			block:   i,
+			Start:   uint16(i * s.blockSize),
+			Size:    s.blockSize,
+			replies: make(chan *Reply, 1024),
+		}
+		s.leases[i] = l
+		return l, nil
+	}
+	return nil, fmt.Errorf("no free probe id block, %d tasks are running", len(s.leases))
+}
+
+func (s *Service) release(l *Lease) {
+	s.lock.Lock()
+	if s.leases[l.block] == l {
+		s.leases[l.block] = nil
+	}
+	s.lock.Unlock()
+}
+
+func (s *Service) Close() {
+	atomic.StoreUint32(&s.exit, 1)
+	s.conn.Close()
+}
+
+// Lease 任务持有的探测标识区间 [Start, Start+Size)
+type Lease struct {
+	svc     *Service
+	block   int
+	Start   uint16
+	Size    int
+	next    uint32
+	replies chan *Reply
+	once    sync.Once
+}
+
+// NextID 在区间内循环分配下一个探测标识，跳过 0 以免 UDP 校验和被当作未计算
+func (l *Lease) NextID() uint16 {
+	for {
+		n := atomic.AddUint32(&l.next, 1) - 1
+		id := l.Start + uint16(int(n)%l.Size)
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+// Owns 探测标识是否属于该区间
+func (l *Lease) Owns(id uint16) bool {
+	return int(id) >= int(l.Start) && int(id) < int(l.Start)+l.Size
+}
+
+// Replies 分发给该任务的应答
+func (l *Lease) Replies() <-chan *Reply {
+	return l.replies
+}
+
+// WritePacket 通过共享服务发送报文
+func (l *Lease) WritePacket(pkt []byte) error {
+	return l.svc.WritePacket(pkt)
+}
+
+// Release 归还区间，之后到达的应答不再分发给该任务
+func (l *Lease) Release() {
+	l.once.Do(func() {
+		l.svc.release(l)
+	})
+}
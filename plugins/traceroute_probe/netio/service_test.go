@@ -0,0 +1,14 @@
+package netio
+
+import "testing"
+
+func TestNextIDSkipsZero(t *testing.T) {
+	// 第一个区间从 0 开始，0 作为 UDP 校验和表示未计算，不能作为探测标识
+	l := &Lease{Start: 0, Size: 4}
+	for i := 0; i < 12; i++ {
+		id := l.NextID()
+		if id == 0 || !l.Owns(id) {
+			t.Fatalf("NextID returned %d", id)
+		}
+	}
+}
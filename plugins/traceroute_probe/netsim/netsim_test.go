@@ -0,0 +1,295 @@
+package netsim
+
+import (
+	"encoding/binary"
+	"mda-traceroute-go/plugins/traceroute_probe/netio"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	srcAddr = net.ParseIP("10.0.0.1")
+	dstAddr = net.ParseIP("10.0.9.1")
+)
+
+func load(t *testing.T, name string) *Network {
+	t.Helper()
+	n, err := Load(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("load %s: %v", name, err)
+	}
+	return n
+}
+
+// udpProbe 构造 UDP 探测，探测标识放在校验和字段，与 mda 的 UDP 引擎一致
+func udpProbe(dst net.IP, ttl uint8, sport, id uint16, size int, df bool) []byte {
+	pkt := make([]byte, 20+8+size)
+	pkt[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	if df {
+		pkt[6] = 0x40
+	}
+	pkt[8], pkt[9] = ttl, protoUDP
+	copy(pkt[12:16], srcAddr.To4())
+	copy(pkt[16:20], dst.To4())
+	binary.BigEndian.PutUint16(pkt[20:22], sport)
+	binary.BigEndian.PutUint16(pkt[22:24], 33434)
+	binary.BigEndian.PutUint16(pkt[24:26], uint16(8+size))
+	binary.BigEndian.PutUint16(pkt[26:28], id)
+	return pkt
+}
+
+// send 发送探测并取回同步产生的应答，没有应答时返回 nil
+func send(t *testing.T, n *Network, pkt []byte) *netio.Reply {
+	t.Helper()
+	if err := n.WritePacket(pkt); err != nil {
+		t.Fatalf("write packet: %v", err)
+	}
+	select {
+	case p := <-n.recvCh:
+		r, ok := netio.ParseReply(p.pkt, p.ts)
+		if !ok {
+			t.Fatalf("unparsable reply % x", p.pkt)
+		}
+		return r
+	default:
+		return nil
+	}
+}
+
+func TestTimeExceededAndPortUnreachable(t *testing.T) {
+	n := load(t, "diamond.toml")
+	now := time.Now()
+	n.now = func() time.Time { return now }
+
+	for ttl := uint8(1); ttl <= 5; ttl++ {
+		r := send(t, n, udpProbe(dstAddr, ttl, 10001, uint16(ttl), 32, false))
+		if r == nil {
+			t.Fatalf("ttl %d: no reply", ttl)
+		}
+		if r.ProbeID != uint16(ttl) {
+			t.Errorf("ttl %d: probe id %d", ttl, r.ProbeID)
+		}
+		// 路由器引用到期时的 TTL 1，主机引用到达时剩余的 TTL
+		quoted := uint8(1)
+		if ttl >= 4 {
+			quoted = ttl - 3
+		}
+		if r.Quoted == nil || r.Quoted.TTL != quoted || !r.Quoted.Dst.Equal(dstAddr) {
+			t.Errorf("ttl %d: quoted %+v", ttl, r.Quoted)
+		}
+		want := "10.0.9.1"
+		switch ttl {
+		case 1:
+			want = "10.0.1.1"
+		case 2:
+			want = "10.0.2."
+		case 3:
+			want = "10.0.3.1"
+		}
+		if got := r.Src.String(); len(got) < len(want) || got[:len(want)] != want {
+			t.Errorf("ttl %d: reply from %s, want %s", ttl, got, want)
+		}
+		if ttl < 4 && (r.ICMPType != icmpTimeExceeded || r.TTL != uint8(routerInitTTL-(ttl-1))) {
+			t.Errorf("ttl %d: type %d reply ttl %d", ttl, r.ICMPType, r.TTL)
+		}
+		if ttl >= 4 && (r.ICMPType != icmpDestUnreach || r.ICMPCode != icmpPortUnreach || r.TTL != hostInitTTL-3) {
+			t.Errorf("ttl %d: type %d code %d reply ttl %d", ttl, r.ICMPType, r.ICMPCode, r.TTL)
+		}
+	}
+
+	// 往返时延为沿途单向时延之和的两倍
+	r := send(t, n, udpProbe(dstAddr, 1, 10001, 1, 32, false))
+	if d := r.TimeStamp.Sub(now); d != 2*time.Millisecond {
+		t.Errorf("ttl 1 rtt %v, want 2ms", d)
+	}
+}
+
+func TestLoadBalancing(t *testing.T) {
+	for _, tc := range []struct {
+		topo string
+		// 固定流标识时是否看到多个下一跳，改变流标识时是否看到多个下一跳
+		fixed, flows bool
+	}{
+		{"diamond.toml", false, true},
+		{"per_packet.toml", true, true},
+		{"per_destination.toml", false, false},
+	} {
+		n := load(t, tc.topo)
+		fixed, flows := make(map[string]bool), make(map[string]bool)
+		for i := uint16(0); i < 16; i++ {
+			fixed[send(t, n, udpProbe(dstAddr, 2, 10001, i+1, 32, false)).Src.String()] = true
+		}
+		for i := uint16(0); i < 16; i++ {
+			flows[send(t, n, udpProbe(dstAddr, 2, 10001+i, i+1, 32, false)).Src.String()] = true
+		}
+		if (len(fixed) > 1) != tc.fixed || (len(flows) > 1) != tc.flows {
+			t.Errorf("%s: fixed flow next hops %v, changing flow next hops %v", tc.topo, fixed, flows)
+		}
+	}
+
+	// 按目的地址负载均衡时，同网段的其他目的地址会经过另一个下一跳
+	n := load(t, "per_destination.toml")
+	hops := make(map[string]bool)
+	for i := 1; i <= 8; i++ {
+		dst := net.IPv4(10, 0, 9, byte(i))
+		hops[send(t, n, udpProbe(dst, 2, 10001, uint16(i), 32, false)).Src.String()] = true
+	}
+	if len(hops) != 2 {
+		t.Errorf("per-destination next hops %v", hops)
+	}
+}
+
+func TestMPLSExtension(t *testing.T) {
+	n := load(t, "diamond.toml")
+	seen := false
+	for i := uint16(0); i < 16; i++ {
+		r := send(t, n, udpProbe(dstAddr, 2, 10001+i, i+1, 32, false))
+		switch r.Src.String() {
+		case "10.0.2.1":
+			if len(r.MPLS) != 1 || r.MPLS[0].Label != 16001 || !r.MPLS[0].S {
+				t.Fatalf("r2a mpls %+v", r.MPLS)
+			}
+			seen = true
+		case "10.0.2.2":
+			if len(r.MPLS) != 0 {
+				t.Fatalf("r2b mpls %+v", r.MPLS)
+			}
+		}
+	}
+	if !seen {
+		t.Fatal("no probe went through r2a")
+	}
+}
+
+func TestLossIsDeterministic(t *testing.T) {
+	pattern := func() []bool {
+		n := load(t, "lossy.toml")
+		var res []bool
+		for i := uint16(0); i < 64; i++ {
+			res = append(res, send(t, n, udpProbe(dstAddr, 3, 10001, i+1, 32, false)) != nil)
+		}
+		return res
+	}
+	a, b := pattern(), pattern()
+	lost := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("probe %d: replied %v then %v with the same seed", i, a[i], b[i])
+		}
+		if !a[i] {
+			lost++
+		}
+	}
+	if lost == 0 || lost == len(a) {
+		t.Errorf("lost %d/%d probes with 30%% loss", lost, len(a))
+	}
+
+	// 不返回 Time Exceeded 的路由器
+	if r := send(t, load(t, "lossy.toml"), udpProbe(dstAddr, 2, 10001, 1, 32, false)); r != nil {
+		t.Errorf("silent router replied from %s", r.Src)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	n, err := NewNetwork(&Topology{
+		First:   "r1",
+		Routers: []*Router{{Name: "r1", Addr: "10.0.1.1", Next: []string{"dst"}, RateLimit: 2}},
+		Hosts:   []*Host{{Name: "dst", Prefix: "10.0.9.0/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	n.now = func() time.Time { return now }
+	replied := func(cnt int) int {
+		res := 0
+		for i := 0; i < cnt; i++ {
+			if send(t, n, udpProbe(dstAddr, 1, 10001, uint16(i+1), 32, false)) != nil {
+				res++
+			}
+		}
+		return res
+	}
+	if got := replied(5); got != 2 {
+		t.Errorf("burst replied %d, want 2", got)
+	}
+	now = now.Add(500 * time.Millisecond)
+	if got := replied(5); got != 1 {
+		t.Errorf("after 500ms replied %d, want 1", got)
+	}
+	// 目的主机的应答不受路由器限速影响
+	if r := send(t, n, udpProbe(dstAddr, 2, 10001, 1, 32, false)); r == nil || !r.Src.Equal(dstAddr) {
+		t.Errorf("destination reply %+v", r)
+	}
+}
+
+func TestUnreachableAndFragNeeded(t *testing.T) {
+	n, err := NewNetwork(&Topology{
+		First: "r1",
+		Routers: []*Router{
+			{Name: "r1", Addr: "10.0.1.1", Next: []string{"r2"}, MTU: 1400},
+			{Name: "r2", Addr: "10.0.2.1", Next: []string{"dst"}},
+		},
+		Hosts: []*Host{{Name: "dst", Prefix: "10.0.9.0/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := send(t, n, udpProbe(net.ParseIP("10.0.8.1"), 8, 10001, 1, 32, false))
+	if r == nil || r.Src.String() != "10.0.2.1" || r.ICMPType != icmpDestUnreach || r.ICMPCode != icmpHostUnreach {
+		t.Errorf("unknown destination reply %+v", r)
+	}
+
+	r = send(t, n, udpProbe(dstAddr, 8, 10001, 2, 1500-28, true))
+	if r == nil || r.Src.String() != "10.0.1.1" || r.ICMPCode != icmpFragNeeded || r.MTU != 1400 {
+		t.Errorf("frag needed reply %+v", r)
+	}
+	// 未设置不分片标志的大包照常转发
+	if r = send(t, n, udpProbe(dstAddr, 8, 10001, 3, 1500-28, false)); r == nil || !r.Src.Equal(dstAddr) {
+		t.Errorf("fragmentable probe reply %+v", r)
+	}
+}
+
+func TestICMPv6Echo(t *testing.T) {
+	n := load(t, "diamond.toml")
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8:9::1")
+	probe := func(hopLimit uint8, seq uint16) []byte {
+		pkt := make([]byte, 40+16)
+		pkt[0] = 6 << 4
+		binary.BigEndian.PutUint16(pkt[4:6], 16)
+		pkt[6], pkt[7] = protoICMPv6, hopLimit
+		copy(pkt[8:24], src)
+		copy(pkt[24:40], dst)
+		pkt[40] = icmpv6EchoRequest
+		binary.BigEndian.PutUint16(pkt[46:48], seq)
+		return pkt
+	}
+
+	r := send(t, n, probe(1, 1))
+	if r == nil || r.Src.String() != "2001:db8:1::1" || r.ICMPType != icmpv6TimeExceeded || r.ProbeID != 1 {
+		t.Fatalf("hop limit 1 reply %+v", r)
+	}
+	r = send(t, n, probe(5, 2))
+	if r == nil || !r.Src.Equal(dst) || r.ICMPType != icmpv6EchoReply || r.ProbeID != 2 {
+		t.Fatalf("echo reply %+v", r)
+	}
+}
+
+func TestTopologyCheck(t *testing.T) {
+	for _, topo := range []*Topology{
+		{First: "r1"},
+		{First: "r1", Routers: []*Router{{Name: "r1", Addr: "10.0.1.1", Next: []string{"a", "b"}}}},
+		{First: "r1", Routers: []*Router{{Name: "r1", Addr: "10.0.1.1", LB: "ecmp", Next: []string{"r1"}}}},
+		{First: "r1", Routers: []*Router{{Name: "r1", Addr: "2001:db8::1", Next: []string{"r1"}}}},
+		{First: "r1", Routers: []*Router{{Name: "r1", Addr: "10.0.1.1", Next: []string{"dst"}}}},
+		{First: "dst", Hosts: []*Host{{Name: "dst"}}},
+	} {
+		if _, err := NewNetwork(topo); err == nil {
+			t.Errorf("topology %+v accepted", topo)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package netsim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// 应答报文的初始 TTL：路由器 255，主机 64
+const (
+	routerInitTTL = 255
+	hostInitTTL   = 64
+)
+
+type packet struct {
+	pkt []byte
+	ts  time.Time
+}
+
+// node 拓扑中的路由器或主机
+type node struct {
+	name    string
+	router  *Router
+	host    *Host
+	addr    net.IP
+	addr6   net.IP
+	prefix  *net.IPNet
+	prefix6 *net.IPNet
+	next    []*node
+
+	ipID   uint16    // 应答报文的 IP ID，每个节点一个递增的计数器
+	rr     int       // 按包负载均衡的轮询位置
+	tokens float64   // ICMP 限速的令牌桶
+	last   time.Time // 上次补充令牌的时间
+}
+
+// Network 基于拓扑描述的模拟网络，实现 netio.Conn。WritePacket 同步地沿拓扑转发探测包，
+// 把探测到期或到达目的端后产生的应答放入接收队列，应答的到达时间为发送时间加上往返时延。
+// 相同的拓扑、随机数种子和发送顺序总是得到相同的应答，探测逻辑因此可以不依赖原始套接字测试
+type Network struct {
+	nodes map[string]*node
+	first *node
+	rnd   *rand.Rand
+	lock  sync.Mutex
+
+	recvCh  chan packet
+	closeCh chan struct{}
+	once    sync.Once
+
+	now func() time.Time // ICMP 限速和应答到达时间使用的时钟
+}
+
+// NewNetwork 按拓扑描述创建模拟网络
+func NewNetwork(t *Topology) (*Network, error) {
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	n := &Network{
+		nodes:   make(map[string]*node, len(t.Routers)+len(t.Hosts)),
+		rnd:     rand.New(rand.NewSource(t.Seed)),
+		recvCh:  make(chan packet, 4096),
+		closeCh: make(chan struct{}),
+		now:     time.Now,
+	}
+	for _, r := range t.Routers {
+		n.nodes[r.Name] = &node{name: r.Name, router: r, addr: parseIP(r.Addr), addr6: parseIP(r.Addr6)}
+	}
+	for _, h := range t.Hosts {
+		nd := &node{name: h.Name, host: h}
+		if h.Prefix != "" {
+			_, nd.prefix, _ = net.ParseCIDR(h.Prefix)
+		}
+		if h.Prefix6 != "" {
+			_, nd.prefix6, _ = net.ParseCIDR(h.Prefix6)
+		}
+		n.nodes[h.Name] = nd
+	}
+	for _, r := range t.Routers {
+		nd := n.nodes[r.Name]
+		for _, name := range r.Next {
+			nd.next = append(nd.next, n.nodes[name])
+		}
+	}
+	n.first = n.nodes[t.First]
+	return n, nil
+}
+
+// Load 读取拓扑描述文件并创建模拟网络
+func Load(path string) (*Network, error) {
+	t, err := LoadTopology(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewNetwork(t)
+}
+
+func parseIP(s string) net.IP {
+	if s == "" {
+		return nil
+	}
+	return net.ParseIP(s)
+}
+
+// WritePacket 发送一个完整的 IP 探测包
+func (n *Network) WritePacket(pkt []byte) error {
+	p, err := parseProbe(pkt)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-n.closeCh:
+		return net.ErrClosed
+	default:
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.forward(p)
+	return nil
+}
+
+// ReadPacket 读取一个应答报文及其到达时间
+func (n *Network) ReadPacket() ([]byte, time.Time, error) {
+	select {
+	case p := <-n.recvCh:
+		return p.pkt, p.ts, nil
+	case <-n.closeCh:
+		return nil, time.Time{}, net.ErrClosed
+	}
+}
+
+func (n *Network) Close() error {
+	n.once.Do(func() {
+		close(n.closeCh)
+	})
+	return nil
+}
+
+// forward 从第一个路由器开始逐跳转发探测包：路由器收到 TTL 不大于 1 的探测时返回 Time Exceeded，
+// 否则减一后按负载均衡类型选择下一跳；主机应答发往自己网段的探测，其他地址由上一跳返回主机不可达
+func (n *Network) forward(p *probe) {
+	var prev *node
+	cur := n.first
+	ttl := p.ttl
+	delay := 0.0
+	for hop := 1; ; hop++ {
+		if h := cur.host; h != nil {
+			if n.lost(h.Loss) {
+				return
+			}
+			if !cur.owns(p.dst) {
+				if prev != nil {
+					n.unreachable(prev, p, ttl, hop-1, delay)
+				}
+				return
+			}
+			n.hostReply(cur, p, ttl, hop, delay+h.Delay)
+			return
+		}
+
+		r := cur.router
+		delay += r.Delay
+		if n.lost(r.Loss) {
+			return
+		}
+		if ttl <= 1 {
+			if !r.Silent {
+				n.timeExceeded(cur, p, ttl, hop, delay)
+			}
+			return
+		}
+		if r.MTU > 0 && len(p.pkt) > r.MTU && (p.df || p.ipv6()) {
+			n.fragNeeded(cur, p, ttl, hop, delay)
+			return
+		}
+		ttl--
+		prev, cur = cur, n.choose(cur, p)
+	}
+}
+
+// choose 按路由器的负载均衡类型选择下一跳
+func (n *Network) choose(nd *node, p *probe) *node {
+	if len(nd.next) == 1 {
+		return nd.next[0]
+	}
+	var i int
+	switch nd.router.LB {
+	case LBPerPacket:
+		i = nd.rr % len(nd.next)
+		nd.rr++
+	case LBPerDestination:
+		i = int(flowHash(nd.name, p.src, p.dst) % uint32(len(nd.next)))
+	default:
+		i = int(flowHash(nd.name, p.src, p.dst, []byte{p.proto}, p.flowFields()) % uint32(len(nd.next)))
+	}
+	return nd.next[i]
+}
+
+// flowHash 路由器对流字段的哈希，加入路由器名称使各路由器的分流互不相关
+func flowHash(name string, fields ...[]byte) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	for _, f := range fields {
+		h.Write(f)
+	}
+	// fnv 的低位分布不够均匀，再做一次 murmur3 的最终混合
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// lost 按丢包率决定探测是否被丢弃
+func (n *Network) lost(rate float64) bool {
+	return rate > 0 && n.rnd.Float64() < rate
+}
+
+// allow ICMP 限速的令牌桶，桶的容量为每秒的速率
+func (n *Network) allow(nd *node) bool {
+	limit := nd.router.RateLimit
+	if limit <= 0 {
+		return true
+	}
+	now := n.now()
+	if nd.last.IsZero() {
+		nd.tokens = limit
+	} else {
+		nd.tokens += now.Sub(nd.last).Seconds() * limit
+		if nd.tokens > limit {
+			nd.tokens = limit
+		}
+	}
+	nd.last = now
+	if nd.tokens < 1 {
+		return false
+	}
+	nd.tokens--
+	return true
+}
+
+// owns 主机是否应答发往 dst 的探测
+func (nd *node) owns(dst net.IP) bool {
+	if dst.To4() != nil {
+		return nd.prefix != nil && nd.prefix.Contains(dst)
+	}
+	return nd.prefix6 != nil && nd.prefix6.Contains(dst)
+}
+
+// source 节点应答 p 时使用的源地址，没有对应地址族的地址时返回 nil
+func (nd *node) source(p *probe) net.IP {
+	if nd.host != nil {
+		return p.dst
+	}
+	if p.ipv6() {
+		return nd.addr6
+	}
+	return nd.addr
+}
+
+func (nd *node) nextID() uint16 {
+	nd.ipID++
+	return nd.ipID
+}
+
+// deliver 应答在发送时间加上往返时延后到达，rtt 为单向时延之和的两倍
+func (n *Network) deliver(pkt []byte, oneWay float64) {
+	ts := n.now().Add(time.Duration(2 * oneWay * float64(time.Millisecond)))
+	select {
+	case n.recvCh <- packet{pkt: pkt, ts: ts}:
+	default:
+		// 与原始套接字一样，接收队列满时丢弃
+	}
+}
+
+// probe 解析后的探测包
+type probe struct {
+	pkt       []byte
+	version   int
+	src       net.IP
+	dst       net.IP
+	ttl       uint8
+	proto     uint8
+	df        bool
+	flowLabel uint32
+	transport []byte
+}
+
+func (p *probe) ipv6() bool {
+	return p.version == 6
+}
+
+// flowFields 按流负载均衡使用的传输层字段：UDP/TCP 的端口，ICMP 的类型、代码和校验和；IPv6 另加流标签
+func (p *probe) flowFields() []byte {
+	f := make([]byte, 0, 8)
+	if len(p.transport) >= 4 {
+		f = append(f, p.transport[:4]...)
+	}
+	if p.ipv6() {
+		var label [4]byte
+		binary.BigEndian.PutUint32(label[:], p.flowLabel)
+		f = append(f, label[:]...)
+	}
+	return f
+}
+
+func parseProbe(pkt []byte) (*probe, error) {
+	if len(pkt) == 0 {
+		return nil, fmt.Errorf("empty packet")
+	}
+	p := &probe{pkt: pkt, version: int(pkt[0] >> 4)}
+	switch p.version {
+	case 4:
+		if len(pkt) < 20 {
+			return nil, fmt.Errorf("short ipv4 packet")
+		}
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || len(pkt) < ihl {
+			return nil, fmt.Errorf("bad ipv4 header length %d", ihl)
+		}
+		p.df = pkt[6]&0x40 != 0
+		p.ttl, p.proto = pkt[8], pkt[9]
+		p.src, p.dst = net.IP(pkt[12:16]), net.IP(pkt[16:20])
+		p.transport = pkt[ihl:]
+	case 6:
+		if len(pkt) < 40 {
+			return nil, fmt.Errorf("short ipv6 packet")
+		}
+		p.flowLabel = binary.BigEndian.Uint32(pkt[0:4]) & 0xfffff
+		p.proto, p.ttl = pkt[6], pkt[7]
+		p.src, p.dst = net.IP(pkt[8:24]), net.IP(pkt[24:40])
+		p.transport = pkt[40:]
+	default:
+		return nil, fmt.Errorf("unknown ip version %d", p.version)
+	}
+	return p, nil
+}
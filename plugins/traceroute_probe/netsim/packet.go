@@ -0,0 +1,222 @@
+package netsim
+
+import (
+	"encoding/binary"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"net"
+)
+
+// ICMP/ICMPv6 的类型和代码
+const (
+	icmpEchoReply        = 0
+	icmpDestUnreach      = 3
+	icmpEchoRequest      = 8
+	icmpTimeExceeded     = 11
+	icmpHostUnreach      = 1
+	icmpPortUnreach      = 3
+	icmpFragNeeded       = 4
+	icmpv6DestUnreach    = 1
+	icmpv6PacketTooBig   = 2
+	icmpv6TimeExceeded   = 3
+	icmpv6EchoRequest    = 128
+	icmpv6EchoReply      = 129
+	icmpv6AddrUnreach    = 3
+	icmpv6PortUnreach    = 4
+	protoICMP            = 1
+	protoTCP             = 6
+	protoUDP             = 17
+	protoICMPv6          = 58
+	tcpFlagSYN           = 0x02
+	tcpFlagRST           = 0x04
+	tcpFlagACK           = 0x10
+	quotedLen            = 128 // 差错报文引用原始报文的长度，带扩展时按 RFC 4884 补齐到该长度
+	extVersion           = 2
+	extClassMPLS         = 1
+	extCTypeMPLSIncoming = 1
+)
+
+// timeExceeded 路由器对到期的探测返回 Time Exceeded，限速或没有对应地址族的地址时不应答
+func (n *Network) timeExceeded(nd *node, p *probe, ttl uint8, hop int, delay float64) {
+	typ := uint8(icmpTimeExceeded)
+	if p.ipv6() {
+		typ = icmpv6TimeExceeded
+	}
+	n.icmpError(nd, p, typ, 0, 0, ttl, hop, delay, nd.router.MPLS)
+}
+
+// unreachable 路由器对下一跳主机不应答的目的地址返回主机不可达
+func (n *Network) unreachable(nd *node, p *probe, ttl uint8, hop int, delay float64) {
+	if p.ipv6() {
+		n.icmpError(nd, p, icmpv6DestUnreach, icmpv6AddrUnreach, 0, ttl, hop, delay, nil)
+		return
+	}
+	n.icmpError(nd, p, icmpDestUnreach, icmpHostUnreach, 0, ttl, hop, delay, nil)
+}
+
+// fragNeeded 探测超过下一跳链路的 MTU，返回 Fragmentation Needed 或 Packet Too Big
+func (n *Network) fragNeeded(nd *node, p *probe, ttl uint8, hop int, delay float64) {
+	mtu := uint32(nd.router.MTU)
+	if p.ipv6() {
+		n.icmpError(nd, p, icmpv6PacketTooBig, 0, mtu, ttl, hop, delay, nil)
+		return
+	}
+	n.icmpError(nd, p, icmpDestUnreach, icmpFragNeeded, mtu&0xffff, ttl, hop, delay, nil)
+}
+
+// hostReply 目的主机的应答：ICMP 回显应答、UDP 端口不可达、TCP 对 SYN 的 RST
+func (n *Network) hostReply(nd *node, p *probe, ttl uint8, hop int, delay float64) {
+	switch p.proto {
+	case protoICMP, protoICMPv6:
+		req, rep := uint8(icmpEchoRequest), uint8(icmpEchoReply)
+		if p.ipv6() {
+			req, rep = icmpv6EchoRequest, icmpv6EchoReply
+		}
+		if len(p.transport) < 8 || p.transport[0] != req {
+			return
+		}
+		msg := append([]byte(nil), p.transport...)
+		msg[0] = rep
+		n.reply(nd, p, p.proto, icmpChecksum(p.dst, p.src, msg), hop, delay)
+	case protoUDP:
+		if p.ipv6() {
+			n.icmpError(nd, p, icmpv6DestUnreach, icmpv6PortUnreach, 0, ttl, hop, delay, nil)
+			return
+		}
+		n.icmpError(nd, p, icmpDestUnreach, icmpPortUnreach, 0, ttl, hop, delay, nil)
+	case protoTCP:
+		if len(p.transport) < 20 || p.transport[13]&tcpFlagSYN == 0 {
+			return
+		}
+		seg := make([]byte, 20)
+		copy(seg[0:2], p.transport[2:4])
+		copy(seg[2:4], p.transport[0:2])
+		binary.BigEndian.PutUint32(seg[8:12], binary.BigEndian.Uint32(p.transport[4:8])+1)
+		seg[12] = 5 << 4
+		seg[13] = tcpFlagRST | tcpFlagACK
+		sum := utils.CheckSum(append(pseudoHeader(p.dst, p.src, protoTCP, len(seg)), seg...))
+		binary.BigEndian.PutUint16(seg[16:18], sum)
+		n.reply(nd, p, protoTCP, seg, hop, delay)
+	}
+}
+
+// icmpError 构造引用原始探测的 ICMP 差错报文，info 填入 ICMP 头部的第 4~7 字节，
+// quotedTTL 为引用的原始报文中的 TTL，labels 非空时按 RFC 4950 附加 MPLS 标签栈扩展
+func (n *Network) icmpError(nd *node, p *probe, typ, code uint8, info uint32, quotedTTL uint8, hop int, delay float64, labels []uint32) {
+	src := nd.source(p)
+	if src == nil || (nd.router != nil && !n.allow(nd)) {
+		return
+	}
+	quoted := append([]byte(nil), p.pkt...)
+	if p.ipv6() {
+		quoted[7] = quotedTTL
+	} else {
+		quoted[8] = quotedTTL
+		quoted[10], quoted[11] = 0, 0
+		ihl := int(quoted[0]&0x0f) * 4
+		binary.BigEndian.PutUint16(quoted[10:12], utils.CheckSum(quoted[:ihl]))
+	}
+	if len(quoted) > quotedLen {
+		quoted = quoted[:quotedLen]
+	}
+
+	msg := make([]byte, 8, 8+quotedLen+32)
+	msg[0], msg[1] = typ, code
+	binary.BigEndian.PutUint32(msg[4:8], info)
+	if len(labels) > 0 {
+		quoted = append(quoted, make([]byte, quotedLen-len(quoted))...)
+		if p.ipv6() {
+			msg[4] = quotedLen / 8
+		} else {
+			msg[5] = quotedLen / 4
+		}
+	}
+	msg = append(msg, quoted...)
+	if len(labels) > 0 {
+		msg = append(msg, mplsExtension(labels)...)
+	}
+
+	proto := uint8(protoICMP)
+	if p.ipv6() {
+		proto = protoICMPv6
+	}
+	n.reply(nd, p, proto, icmpChecksum(src, p.src, msg), hop, delay)
+}
+
+// mplsExtension RFC 4884 的扩展头部加上一个 MPLS 标签栈对象，栈中最后一个标签置栈底标志，TTL 均为 1
+func mplsExtension(labels []uint32) []byte {
+	obj := make([]byte, 4, 4+4*len(labels))
+	binary.BigEndian.PutUint16(obj[0:2], uint16(4+4*len(labels)))
+	obj[2], obj[3] = extClassMPLS, extCTypeMPLSIncoming
+	for i, l := range labels {
+		v := l<<12 | 1
+		if i == len(labels)-1 {
+			v |= 0x100
+		}
+		var e [4]byte
+		binary.BigEndian.PutUint32(e[:], v)
+		obj = append(obj, e[:]...)
+	}
+	ext := append([]byte{extVersion << 4, 0, 0, 0}, obj...)
+	binary.BigEndian.PutUint16(ext[2:4], utils.CheckSum(ext))
+	return ext
+}
+
+// icmpChecksum 填入从 src 发往 dst 的 ICMP 消息的校验和，ICMPv6 包含伪首部
+func icmpChecksum(src, dst net.IP, msg []byte) []byte {
+	msg[2], msg[3] = 0, 0
+	if src.To4() == nil {
+		binary.BigEndian.PutUint16(msg[2:4], utils.CheckSum(append(pseudoHeader(src, dst, protoICMPv6, len(msg)), msg...)))
+	} else {
+		binary.BigEndian.PutUint16(msg[2:4], utils.CheckSum(msg))
+	}
+	return msg
+}
+
+// reply 由节点 nd 向探测的源地址发送应答，应答的 TTL 为初始值减去返回途中经过的路由器数
+func (n *Network) reply(nd *node, p *probe, proto uint8, payload []byte, hop int, delay float64) {
+	src := nd.source(p)
+	if src == nil {
+		return
+	}
+	ttl := uint8(routerInitTTL - (hop - 1))
+	if nd.host != nil {
+		ttl = uint8(hostInitTTL - (hop - 1))
+	}
+	var h []byte
+	if p.ipv6() {
+		h = make([]byte, 40)
+		h[0] = 6 << 4
+		binary.BigEndian.PutUint16(h[4:6], uint16(len(payload)))
+		h[6], h[7] = proto, ttl
+		copy(h[8:24], src.To16())
+		copy(h[24:40], p.src.To16())
+	} else {
+		h = make([]byte, 20)
+		h[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(h[2:4], uint16(20+len(payload)))
+		binary.BigEndian.PutUint16(h[4:6], nd.nextID())
+		h[8], h[9] = ttl, proto
+		copy(h[12:16], src.To4())
+		copy(h[16:20], p.src.To4())
+		binary.BigEndian.PutUint16(h[10:12], utils.CheckSum(h))
+	}
+	n.deliver(append(h, payload...), delay)
+}
+
+// pseudoHeader 计算传输层校验和的伪首部
+func pseudoHeader(src, dst net.IP, proto uint8, length int) []byte {
+	if src.To4() != nil {
+		b := make([]byte, 12)
+		copy(b[0:4], src.To4())
+		copy(b[4:8], dst.To4())
+		b[9] = proto
+		binary.BigEndian.PutUint16(b[10:12], uint16(length))
+		return b
+	}
+	b := make([]byte, 40)
+	copy(b[0:16], src.To16())
+	copy(b[16:32], dst.To16())
+	binary.BigEndian.PutUint32(b[32:36], uint32(length))
+	b[39] = proto
+	return b
+}
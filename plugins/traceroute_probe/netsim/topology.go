@@ -0,0 +1,134 @@
+package netsim
+
+import (
+	"fmt"
+	"mda-traceroute-go/util"
+	"net"
+)
+
+// 路由器的负载均衡类型，与 mda 包判断出的类型同名
+const (
+	LBNone           = "none"            // 只有一个下一跳
+	LBPerFlow        = "per-flow"        // 按五元组（IPv6 加上流标签）的哈希选择下一跳
+	LBPerPacket      = "per-packet"      // 按包轮询下一跳
+	LBPerDestination = "per-destination" // 按源、目的地址的哈希选择下一跳
+)
+
+// Topology 模拟网络的拓扑描述，由 toml 文件给出：源端之后依次经过的路由器构成一个有向图，
+// 图的末端是目的主机。例如
+//
+//	source = "10.0.0.1"
+//	first  = "r1"
+//	seed   = 1
+//
+//	[[router]]
+//	name = "r1"
+//	addr = "10.0.1.1"
+//	lb   = "per-flow"
+//	next = ["r2", "r3"]
+//
+//	[[host]]
+//	name   = "dst"
+//	prefix = "10.0.9.0/24"
+type Topology struct {
+	Source  string    `toml:"source"`  // 探测节点的地址，模拟网络本身不检查
+	Source6 string    `toml:"source6"` // 探测节点的 IPv6 地址
+	First   string    `toml:"first"`   // 源端的第一个路由器
+	Seed    int64     `toml:"seed"`    // 丢包使用的随机数种子，相同的种子和发送顺序得到相同的结果
+	Routers []*Router `toml:"router"`
+	Hosts   []*Host   `toml:"host"`
+}
+
+// Router 模拟的路由器
+type Router struct {
+	Name  string   `toml:"name"`
+	Addr  string   `toml:"addr"`  // 返回 ICMP 差错报文使用的 IPv4 地址，为空时不应答 IPv4 探测
+	Addr6 string   `toml:"addr6"` // 返回 ICMPv6 差错报文使用的 IPv6 地址，为空时不应答 IPv6 探测
+	LB    string   `toml:"lb"`    // 负载均衡类型，为空时使用 none
+	Next  []string `toml:"next"`  // 下一跳的路由器或主机，按负载均衡类型选择
+	// 从上一跳到该路由器的单向时延，单位 ms
+	Delay float64 `toml:"delay"`
+	// 经过或到期于该路由器的探测被丢弃的概率
+	Loss float64 `toml:"loss"`
+	// 每秒最多返回多少个 ICMP 差错报文，为 0 时不限速
+	RateLimit float64 `toml:"rateLimit"`
+	// 不返回 Time Exceeded，即 traceroute 中的 "*" 跳
+	Silent bool `toml:"silent"`
+	// 该路由器的 Time Exceeded 在 RFC 4950 扩展中携带的 MPLS 标签栈，从栈顶开始
+	MPLS []uint32 `toml:"mpls"`
+	// 转发到下一跳的链路 MTU，为 0 时不限制；超过时对设置了不分片标志的探测（IPv6 为全部探测）返回需要分片
+	MTU int `toml:"mtu"`
+}
+
+// Host 模拟的目的主机，应答发往 Prefix 内任意地址的探测：ICMP 回显应答、UDP 端口不可达、TCP RST。
+// 发往 Prefix 之外的探测由上一跳路由器返回主机不可达
+type Host struct {
+	Name    string  `toml:"name"`
+	Prefix  string  `toml:"prefix"`  // IPv4 网段，为空时不应答 IPv4 探测
+	Prefix6 string  `toml:"prefix6"` // IPv6 网段，为空时不应答 IPv6 探测
+	Delay   float64 `toml:"delay"`   // 从上一跳到主机的单向时延，单位 ms
+	Loss    float64 `toml:"loss"`    // 探测被丢弃的概率
+}
+
+// LoadTopology 读取 toml 格式的拓扑描述文件
+func LoadTopology(path string) (*Topology, error) {
+	var t Topology
+	if err := util.ParseConfigToml(path, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// check 检查地址格式、负载均衡类型和节点名称。路由环路是允许的，环路中的探测最终因 TTL 耗尽而到期
+func (t *Topology) check() error {
+	names := make(map[string]bool, len(t.Routers)+len(t.Hosts))
+	for _, r := range t.Routers {
+		if names[r.Name] {
+			return fmt.Errorf("duplicate node %s", r.Name)
+		}
+		names[r.Name] = true
+		if r.Addr != "" && net.ParseIP(r.Addr).To4() == nil {
+			return fmt.Errorf("router %s: invalid ipv4 address %s", r.Name, r.Addr)
+		}
+		if r.Addr6 != "" && (net.ParseIP(r.Addr6) == nil || net.ParseIP(r.Addr6).To4() != nil) {
+			return fmt.Errorf("router %s: invalid ipv6 address %s", r.Name, r.Addr6)
+		}
+		switch r.LB {
+		case "", LBNone:
+			if len(r.Next) > 1 {
+				return fmt.Errorf("router %s: %d next hops without load balancing", r.Name, len(r.Next))
+			}
+		case LBPerFlow, LBPerPacket, LBPerDestination:
+		default:
+			return fmt.Errorf("router %s: unknown load balancing %s", r.Name, r.LB)
+		}
+		if len(r.Next) == 0 {
+			return fmt.Errorf("router %s has no next hop", r.Name)
+		}
+	}
+	for _, h := range t.Hosts {
+		if names[h.Name] {
+			return fmt.Errorf("duplicate node %s", h.Name)
+		}
+		names[h.Name] = true
+		if h.Prefix == "" && h.Prefix6 == "" {
+			return fmt.Errorf("host %s has no prefix", h.Name)
+		}
+		for _, prefix := range []string{h.Prefix, h.Prefix6} {
+			if _, _, err := net.ParseCIDR(prefix); prefix != "" && err != nil {
+				return fmt.Errorf("host %s: %v", h.Name, err)
+			}
+		}
+	}
+	if !names[t.First] {
+		return fmt.Errorf("unknown first hop %s", t.First)
+	}
+	for _, r := range t.Routers {
+		for _, n := range r.Next {
+			if !names[n] {
+				return fmt.Errorf("router %s: unknown next hop %s", r.Name, n)
+			}
+		}
+	}
+	return nil
+}
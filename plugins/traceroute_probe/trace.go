@@ -0,0 +1,167 @@
+package traceroute_probe
+
+import (
+	"fmt"
+	"io"
+	cds "mda-traceroute-go/dataStruct"
+	"mda-traceroute-go/db/atlas"
+	"mda-traceroute-go/plugins/traceroute_probe/mda"
+	"mda-traceroute-go/plugins/traceroute_probe/utils"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// TraceOptions 命令行单次探测的参数，零值使用配置文件或 NewTracerouteProbe 给出的默认值
+type TraceOptions struct {
+	Protocol  string
+	Port      uint16
+	IPVersion uint8
+	Mode      string
+	Alpha     float64
+	Alias     bool
+	LBDstTest bool
+	GapLimit  int
+	// 简单模式下依次比较的 DSCP 值和负载长度，为空时使用配置文件中的值
+	DSCP         []int
+	PayloadSize  int
+	PayloadSweep []int
+	Pcap         string // 抓包文件路径，为空时不抓包
+}
+
+// TraceResult 单次探测的结果
+type TraceResult struct {
+	Protocol string            `json:"protocol"`
+	SrcAddr  string            `json:"src-addr"`
+	Summary  *cds.TraceSummary `json:"summary"`
+	Hops     []cds.RouteInfo   `json:"hops"`
+}
+
+// Trace 不连接控制节点，在本地用同一个 mda 引擎探测 dst 一次，阻塞直到探测结束
+func (tp *TracerouteProbe) Trace(dst string, opt *TraceOptions) (*TraceResult, error) {
+	if err := tp.initIO(); err != nil {
+		return nil, fmt.Errorf("init packet io failed: %v", err)
+	}
+	defer tp.IO.Close()
+
+	dstAddr, srcAddr, err := tp.verifyConf(dst, opt.IPVersion, tp.MaxTTL)
+	if err != nil {
+		return nil, err
+	}
+	protocol, port := tp.Protocol, utils.ConfigData.TCPPort
+	if opt.Protocol != "" {
+		protocol = opt.Protocol
+	}
+	if opt.Port != 0 {
+		port = opt.Port
+	}
+	mode := utils.ConfigData.Mode
+	if opt.Mode != "" {
+		mode = opt.Mode
+	}
+	dscp := utils.ConfigData.DSCP
+	if len(opt.DSCP) > 0 {
+		dscp = opt.DSCP
+	}
+	payload, payloads := utils.ConfigData.PayloadSize, utils.ConfigData.PayloadSweep
+	if opt.PayloadSize != 0 {
+		payload = opt.PayloadSize
+	}
+	if len(opt.PayloadSweep) > 0 {
+		payloads = opt.PayloadSweep
+	}
+	now := time.Now()
+	hash := utils.GetHash(utils.IPBytes(srcAddr), utils.IPBytes(dstAddr), 65535, port, mda.ProtocolNumber(protocol))
+	prober, err := mda.NewProber(protocol, &mda.ProberConf{
+		Key:        hash,
+		Domain:     dst,
+		DstAddr:    dstAddr,
+		SrcAddr:    srcAddr,
+		MaxTTL:     tp.MaxTTL,
+		Port:       port,
+		Mode:       mode,
+		Alpha:      opt.Alpha,
+		Alias:      opt.Alias,
+		LBDstTest:  opt.LBDstTest,
+		GapLimit:   opt.GapLimit,
+		DSCP:       dscp,
+		Payload:    payload,
+		Payloads:   payloads,
+		Pcap:       opt.Pcap,
+		TaskGeneTs: now.UnixMicro(),
+		IO:         tp.IO,
+	})
+	if err != nil {
+		return nil, err
+	}
+	prober.Start()
+	<-prober.Done()
+
+	res := &TraceResult{Protocol: protocol, SrcAddr: srcAddr.String(), Summary: prober.Summary()}
+	res.Summary.Name = utils.ConfigData.Group
+	for _, v := range prober.Results() {
+		res.Hops = append(res.Hops, v.RouteInfo(utils.ConfigData.Group))
+	}
+	return res, nil
+}
+
+// WriteText 按 mtr 的样式输出逐跳结果，同一跳的多个应答地址依次列出，只在第一行标出跳数。
+// LOSS% 和 SNT 是整跳的统计，RCV 是应答地址为该行地址的探测数
+func (r *TraceResult) WriteText(w io.Writer) error {
+	s := r.Summary
+	fmt.Fprintf(w, "traceroute to %s (%s), %s, mode %s\n", s.Domain, s.DstIP, r.Protocol, s.Mode)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOP\tHOST\tLOSS%\tSNT\tRCV\tAVG\tBEST\tWRST\tSTDEV\t")
+	last := uint8(0)
+	for _, h := range r.Hops {
+		hop := ""
+		if h.TTL != last {
+			hop = fmt.Sprintf("%d.", h.TTL)
+			last = h.TTL
+		}
+		if h.ResAddr == cds.StarAddr {
+			fmt.Fprintf(tw, "%s\t%s\t%.1f%%\t%d\t%d\t\t\t\t\t\n", hop, h.ResAddr, h.LossRatio*100, h.Sent, h.RecvCnt)
+			continue
+		}
+		l := h.LatencyStat
+		fmt.Fprintf(tw, "%s\t%s\t%.1f%%\t%d\t%d\t%.1f\t%.1f\t%.1f\t%.1f\t%s\n",
+			hop, h.ResAddr, h.LossRatio*100, h.Sent, h.RecvCnt, l.Mean, l.Min, l.Max, l.Std, hopNotes(h))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if s.PMTU > 0 {
+		fmt.Fprintf(w, "path mtu %d\n", s.PMTU)
+	}
+	if len(s.Diamonds) > 0 {
+		fmt.Fprintf(w, "%d load balancing diamond(s)\n", len(s.Diamonds))
+	}
+	_, err := fmt.Fprintf(w, "termination: %s, last ttl %d\n", s.Termination, s.LastTTL)
+	return err
+}
+
+// hopNotes 跟在延时之后的附加信息：不可达标记、限速、负载均衡和 MPLS 标签
+func hopNotes(h cds.RouteInfo) string {
+	var notes []string
+	if h.Unreachable != "" {
+		notes = append(notes, h.Unreachable)
+	}
+	if h.RateLimited {
+		notes = append(notes, "rate-limited")
+	}
+	if h.LoadBalance != "" {
+		notes = append(notes, "lb="+h.LoadBalance)
+	}
+	if h.PMTU > 0 {
+		notes = append(notes, fmt.Sprintf("mtu=%d", h.PMTU))
+	}
+	if len(h.MPLS) > 0 {
+		notes = append(notes, "mpls="+cds.FormatMPLS(h.MPLS))
+	}
+	return strings.Join(notes, " ")
+}
+
+// Atlas 转换为 RIPE Atlas traceroute 结果格式
+func (r *TraceResult) Atlas() *atlas.Result {
+	return atlas.Encode(atlas.Meta{Protocol: r.Protocol, SrcAddr: r.SrcAddr, Endtime: time.Now()}, r.Hops)
+}
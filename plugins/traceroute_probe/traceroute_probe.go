@@ -1,15 +1,20 @@
 package traceroute_probe
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 	cds "mda-traceroute-go/dataStruct"
 	"mda-traceroute-go/plugins/traceroute_probe/mda"
+	"mda-traceroute-go/plugins/traceroute_probe/netio"
 	"mda-traceroute-go/plugins/traceroute_probe/utils"
 	"mda-traceroute-go/plugins/traceroute_probe/ws"
 	"mda-traceroute-go/util"
 	"net"
+	"os"
+	"path/filepath"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -23,11 +28,18 @@ type TracerouteProbe struct {
 	CommandChan chan []byte
 	ResultChan  chan []byte
 
-	SrcAddr net.IP
+	SrcAddr  net.IP
+	SrcAddr6 net.IP // 探测 IPv6 目的地址时使用的本地源地址
+
+	IO *netio.Service // 所有任务共享的原始套接字收发服务
+
+	StopSet *mda.StopSet // Doubletree 的本地停止集合，由所有任务共享
 
 	CurrentProbeNum uint16 // 当前执行的任务数
 	MaxProbeNum     uint16 // 探测节点最多同时执行几个任务
-	taskMap         map[string]*mda.ICMPApp
+	// 键为任务的唯一标识：五元组哈希加任务序号，同一目的地址的多个任务互不覆盖
+	taskMap map[string]*probeTask
+	taskSeq uint64
 
 	taskEndCh chan string // 任务消亡或结束时主动注销
 
@@ -45,10 +57,21 @@ type TracerouteProbe struct {
 	Lock sync.RWMutex
 }
 
+// probeTask 正在执行的探测任务
+type probeTask struct {
+	prober mda.Prober
+	dst    string
+	pcap   string // 抓包文件路径，未抓包时为空
+}
+
 func NewTracerouteProbe(maxProbeNum uint16, maxTTL uint8, protocol string, packetRate float64) *TracerouteProbe {
 	return &TracerouteProbe{
+		CommandChan:     make(chan []byte, 1024),
+		ResultChan:      make(chan []byte, 1024),
 		CurrentProbeNum: 0,
 		MaxProbeNum:     maxProbeNum,
+		taskMap:         make(map[string]*probeTask),
+		StopSet:         mda.NewStopSet(),
 		MaxTTL:          maxTTL,
 		Protocol:        protocol,
 		PacketRate:      packetRate,
@@ -59,6 +82,11 @@ func NewTracerouteProbe(maxProbeNum uint16, maxTTL uint8, protocol string, packe
 func (tp *TracerouteProbe) Start() {
 	var err error
 
+	// 所有任务共享一组原始套接字，按探测标识区间分发应答
+	if err = tp.initIO(); err != nil {
+		logrus.Fatalf("init packet io failed: %v", err)
+	}
+
 	// 连接到控制节点
 	tp.initWsConn()
 
@@ -92,9 +120,12 @@ func (tp *TracerouteProbe) Start() {
 
 			} else if msg.MsgType == "dst" {
 				logrus.Infof("Start the tracert mission. Message[%v]", msg)
-				if tp.CurrentProbeNum >= tp.MaxProbeNum {
+				tp.Lock.RLock()
+				num := tp.CurrentProbeNum
+				tp.Lock.RUnlock()
+				if num >= tp.MaxProbeNum {
 					logrus.Warningf("task come up to MaxProbeNum. CurrentProbeNum:%d, MaxProbeNum:%d.\n",
-						tp.CurrentProbeNum, tp.MaxProbeNum)
+						num, tp.MaxProbeNum)
 					send := &cds.Message{
 						MsgType:  "overflow",
 						Msg:      "",
@@ -107,22 +138,106 @@ func (tp *TracerouteProbe) Start() {
 					tp.ResultChan <- sendBytes
 
 				} else {
-					dstAddr, err := tp.verifyConf(msg.Msg, tp.MaxTTL)
+					ipVersion := uint8(0)
+					if msg.Task != nil {
+						ipVersion = msg.Task.IPVersion
+					}
+					dstAddr, srcAddr, err := tp.verifyConf(msg.Msg, ipVersion, tp.MaxTTL)
 					if err != nil {
 						logrus.Errorf("%v", err)
+						// 任务无法执行，直接结束，避免控制节点一直等待
+						tp.sendEnd(msg.Msg)
+						continue
 					}
 					datetime, err := time.Parse("2006-01-02 15:04:05", msg.Datetime)
 					if err != nil {
 						logrus.Errorf("%v", err)
 					}
-					hash := utils.GetHash(tp.SrcAddr.To4(), dstAddr.To4(), 65535, 65535, 1)
-					app := mda.NewICMPApp(hash, dstAddr, tp.SrcAddr, tp.MaxTTL, true, datetime.UnixMicro())
-					go app.Start()
-					go tp.Report(hash, time.Duration(utils.ConfigData.ReportFreq))
+					protocol, port := tp.Protocol, utils.ConfigData.TCPPort
+					mode, alpha := utils.ConfigData.Mode, utils.ConfigData.Alpha
+					alias, gapLimit := utils.ConfigData.Alias, utils.ConfigData.GapLimit
+					lbDstTest := false
+					doubletree, startTTL := utils.ConfigData.Doubletree, utils.ConfigData.StartTTL
+					dscp := utils.ConfigData.DSCP
+					payload, payloads := utils.ConfigData.PayloadSize, utils.ConfigData.PayloadSweep
+					var stopSet []string
+					capture := false
+					if msg.Task != nil {
+						if msg.Task.Protocol != "" {
+							protocol = msg.Task.Protocol
+						}
+						if msg.Task.Port != 0 {
+							port = msg.Task.Port
+						}
+						if msg.Task.Mode != "" {
+							mode = msg.Task.Mode
+						}
+						if msg.Task.Alpha != 0 {
+							alpha = msg.Task.Alpha
+						}
+						alias = alias || msg.Task.Alias
+						lbDstTest = msg.Task.LBDstTest
+						if msg.Task.GapLimit != 0 {
+							gapLimit = msg.Task.GapLimit
+						}
+						doubletree = doubletree || msg.Task.Doubletree
+						if msg.Task.StartTTL != 0 {
+							startTTL = msg.Task.StartTTL
+						}
+						stopSet = msg.Task.StopSet
+						if len(msg.Task.DSCP) > 0 {
+							dscp = msg.Task.DSCP
+						}
+						if msg.Task.PayloadSize != 0 {
+							payload = msg.Task.PayloadSize
+						}
+						if len(msg.Task.PayloadSweep) > 0 {
+							payloads = msg.Task.PayloadSweep
+						}
+						capture = msg.Task.Pcap
+					}
+					hash := utils.GetHash(utils.IPBytes(srcAddr), utils.IPBytes(dstAddr), 65535, port, mda.ProtocolNumber(protocol))
+					tp.taskSeq++
+					key := fmt.Sprintf("%s-%d", hash, tp.taskSeq)
+					pcap := ""
+					if capture {
+						pcap = tp.pcapPath(key, datetime)
+					}
+					// 按任务指定的协议/探测方法从注册表中选择探测引擎
+					prober, err := mda.NewProber(protocol, &mda.ProberConf{
+						Key:        key,
+						Domain:     msg.Msg,
+						DstAddr:    dstAddr,
+						SrcAddr:    srcAddr,
+						MaxTTL:     tp.MaxTTL,
+						Port:       port,
+						Mode:       mode,
+						Alpha:      alpha,
+						Alias:      alias,
+						LBDstTest:  lbDstTest,
+						GapLimit:   gapLimit,
+						Doubletree: doubletree,
+						StartTTL:   startTTL,
+						LocalStop:  tp.StopSet,
+						GlobalStop: stopSet,
+						DSCP:       dscp,
+						Payload:    payload,
+						Payloads:   payloads,
+						Pcap:       pcap,
+						TaskGeneTs: datetime.UnixMicro(),
+						IO:         tp.IO,
+					})
+					if err != nil {
+						logrus.Errorf("%v", err)
+						tp.sendEnd(msg.Msg)
+						continue
+					}
 					tp.Lock.Lock()
 					tp.CurrentProbeNum++
-					tp.taskMap[hash] = app
+					tp.taskMap[key] = &probeTask{prober: prober, dst: msg.Msg, pcap: pcap}
 					tp.Lock.Unlock()
+					go prober.Start()
+					go tp.Report(key)
 
 					send := &cds.Message{
 						MsgType:  "success",
@@ -153,6 +268,22 @@ func (tp *TracerouteProbe) Stop() {
 	atomic.StoreInt32(&tp.StopSign, 1)
 }
 
+// initIO 打开原始套接字并启动收发服务，同时执行的任务数不能超过可分配的探测标识区间数
+func (tp *TracerouteProbe) initIO() error {
+	conn, err := netio.NewRawConn()
+	if err != nil {
+		return err
+	}
+	tp.IO = netio.NewService(conn, netio.DefaultBlockSize)
+	go tp.IO.Run()
+
+	if int(tp.MaxProbeNum) > tp.IO.Capacity() {
+		logrus.Warnf("MaxProbeNum %d exceeds probe id blocks, limit to %d.", tp.MaxProbeNum, tp.IO.Capacity())
+		tp.MaxProbeNum = uint16(tp.IO.Capacity())
+	}
+	return nil
+}
+
 func (tp *TracerouteProbe) initWsConn() {
 	// 根据配置文件合成ws请求地址
 	tp.WsConn = ws.ConnWsServer(utils.ConfigData.WebSocketConf.Server, utils.ConfigData.WebSocketConf.Port,
@@ -163,89 +294,210 @@ func (tp *TracerouteProbe) initWsConn() {
 	}
 }
 
-// 验证配置信息
-func (tp *TracerouteProbe) verifyConf(dst string, maxTTL uint8) (net.IP, error) {
+// 验证配置信息，返回目的地址及与之同一地址族的本地源地址。
+// ipVersion 为 4 或 6 时只解析 A 或 AAAA 记录，为 0 时优先使用 IPv4 地址。
+func (tp *TracerouteProbe) verifyConf(dst string, ipVersion uint8, maxTTL uint8) (net.IP, net.IP, error) {
 	var dstAddr net.IP
 	var err error
+	network := "ip"
+	switch ipVersion {
+	case 4:
+		network = "ip4"
+	case 6:
+		network = "ip6"
+	}
+
 	if util.MatchDst(dst) == 0 {
 		// 取得目的域名的 IP
-		addr, err := net.LookupIP(dst)
+		addr, err := net.DefaultResolver.LookupIP(context.Background(), network, dst)
 		logrus.Infof("Dst domain IPs: %v", addr)
-		if err != nil {
-			logrus.Fatal("verifyConf() Dst domain lookup error:", err)
+		if err != nil || len(addr) == 0 {
+			return nil, nil, fmt.Errorf("verifyConf() Dst domain lookup error: %v", err)
 		}
 		dstAddr = addr[0]
+		for _, a := range addr {
+			if a.To4() != nil {
+				dstAddr = a
+				break
+			}
+		}
 	} else {
 		// 字符串的IP转为 net.IP类型 这样写是错误的
 		//t.netDstAddr = net.IP(t.Dst)
-		dst, err := net.ResolveIPAddr("ip4", dst)
+		dst, err := net.ResolveIPAddr(network, dst)
 		if err != nil {
-			logrus.Errorf("dst ip resolve error. %v", err)
+			return nil, nil, fmt.Errorf("dst ip resolve error. %v", err)
 		}
 		dstAddr = dst.IP
 	}
 
 	// 验证源IP是否有问题
-	err = tp.verifySrcAddr(false)
+	v6 := dstAddr.To4() == nil
+	err = tp.verifySrcAddr(false, v6)
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, nil, err
 	}
 
 	if maxTTL > 64 {
 		logrus.Warn("Large TTL may cause low performance")
 	}
-	return dstAddr, err
+	if v6 {
+		return dstAddr, tp.SrcAddr6, nil
+	}
+	return dstAddr, tp.SrcAddr, nil
 }
 
-// force参数表示是否强制更新本地源地址
-func (tp *TracerouteProbe) verifySrcAddr(force bool) error {
+// force参数表示是否强制更新本地源地址，v6 表示更新 IPv6 源地址
+func (tp *TracerouteProbe) verifySrcAddr(force bool, v6 bool) error {
+	if v6 {
+		if !force && len(tp.SrcAddr6) != 0 {
+			return nil
+		}
+		// 不会真正发包，只借助路由表选出本地 IPv6 地址
+		probe := utils.ConfigData.RouteProbe6
+		if probe == "" {
+			probe = utils.DefaultRouteProbe6
+		}
+		conn, err := net.Dial("udp6", probe)
+		if err != nil {
+			return fmt.Errorf("no ipv6 route: %v", err)
+		}
+		local := conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+		tp.SrcAddr6 = local.IP
+		return nil
+	}
+
 	if !force && string(tp.SrcAddr) != "" {
 		return nil
 	}
 
 	// 设置本地IP为源地址
-	conn, err := net.Dial("udp", "114.114.114.114:53")
+	probe := utils.ConfigData.RouteProbe
+	if probe == "" {
+		probe = utils.DefaultRouteProbe
+	}
+	conn, err := net.Dial("udp4", probe)
 	if err != nil {
-		logrus.Fatal(err)
+		return fmt.Errorf("no ipv4 route: %v", err)
 	}
 	local := conn.LocalAddr().(*net.UDPAddr)
 	conn.Close()
-	tp.SrcAddr = local.IP
+	tp.SrcAddr = local.IP.To4()
 	return nil
 }
 
-func (tp *TracerouteProbe) Report(hash string, freq time.Duration) {
-	app := tp.taskMap[hash]
-	for {
-		if atomic.LoadUint32(&app.Exit) == 1 {
-			app.GracefulClose(1)
-			for ttl := 1; ttl <= int(tp.MaxTTL); ttl++ {
-				m := app.ResMap[ttl]
-				for _, v := range m {
-					sr, err := json.Marshal(v)
-					if err != nil {
-						logrus.Fatal(err)
-					}
-					tp.ResultChan <- sr
-					logrus.Infof("Report data: %v", string(sr))
-				}
-			}
-			end := cds.Message{
-				MsgType:  "end",
-				Msg:      string(tp.taskMap[hash].DstAddr),
-				Datetime: time.Now().Format("2006-01-02 15:04:05"),
-			}
-			endFlag, err := json.Marshal(end)
-			if err != nil {
-				logrus.Errorf("json end flag error: %v", err)
-			}
-			tp.ResultChan <- endFlag
-			tp.Lock.Lock()
-			delete(tp.taskMap, hash)
-			tp.CurrentProbeNum--
-			tp.Lock.Unlock()
-			break
+// sendEnd 通知控制节点该任务的数据已全部上报
+func (tp *TracerouteProbe) sendEnd(dst string) {
+	end := cds.Message{
+		MsgType:  "end",
+		Msg:      dst,
+		Datetime: time.Now().Format("2006-01-02 15:04:05"),
+	}
+	endFlag, err := json.Marshal(end)
+	if err != nil {
+		logrus.Errorf("json end flag error: %v", err)
+	}
+	tp.ResultChan <- endFlag
+}
+
+// sendSummary 上报整条路径的汇总信息，控制节点在收到结束标志前处理
+func (tp *TracerouteProbe) sendSummary(s *cds.TraceSummary) {
+	s.Name = utils.ConfigData.Group
+	data, err := json.Marshal(s)
+	if err != nil {
+		logrus.Errorf("json summary error: %v", err)
+		return
+	}
+	summary, err := json.Marshal(cds.NewMessage("summary", string(data)))
+	if err != nil {
+		logrus.Errorf("json summary error: %v", err)
+		return
+	}
+	tp.ResultChan <- summary
+}
+
+// Report 等待任务结束后上报逐跳结果及结束标志，key 为任务的唯一标识
+func (tp *TracerouteProbe) Report(key string) {
+	tp.Lock.RLock()
+	task, ok := tp.taskMap[key]
+	tp.Lock.RUnlock()
+	if !ok {
+		logrus.Errorf("task %s is not found.", key)
+		return
+	}
+
+	<-task.prober.Done()
+	for _, v := range task.prober.Results() {
+		sr, err := json.Marshal(v.RouteInfo(utils.ConfigData.Group))
+		if err != nil {
+			logrus.Errorf("%v", err)
+			continue
 		}
-		time.Sleep(freq * time.Second)
+		tp.ResultChan <- sr
+		logrus.Infof("Report data: %v", string(sr))
+	}
+	tp.sendSummary(task.prober.Summary())
+	if task.pcap != "" {
+		tp.sendPcap(key, task.pcap)
+	}
+	tp.sendEnd(task.dst)
+	tp.Lock.Lock()
+	delete(tp.taskMap, key)
+	tp.CurrentProbeNum--
+	tp.Lock.Unlock()
+}
+
+// pcapPath 任务抓包文件的路径，目录不存在时创建，创建失败时不抓包
+func (tp *TracerouteProbe) pcapPath(key string, datetime time.Time) string {
+	dir := utils.ConfigData.PcapDir
+	if dir == "" {
+		dir = utils.DefaultPcapDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logrus.Errorf("create pcap dir %s error: %v", dir, err)
+		return ""
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s-%d.pcap", key, datetime.Unix()))
+}
+
+// sendPcap 通过控制通道上报任务的抓包文件，过大的文件只保留在本地
+func (tp *TracerouteProbe) sendPcap(key string, path string) {
+	maxSize := utils.ConfigData.PcapMaxSize
+	if maxSize <= 0 {
+		maxSize = utils.DefaultPcapMaxSize
+	}
+	if maxSize > utils.MaxPcapMaxSize {
+		maxSize = utils.MaxPcapMaxSize
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		logrus.Errorf("stat pcap %s error: %v", path, err)
+		return
+	}
+	if info.Size() > int64(maxSize)<<20 {
+		logrus.Warnf("pcap %s is %d bytes, larger than %d MB, keep it local.", path, info.Size(), maxSize)
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logrus.Errorf("read pcap %s error: %v", path, err)
+		return
+	}
+	file, err := json.Marshal(&cds.PcapFile{
+		Name:    utils.ConfigData.Group,
+		Session: key,
+		File:    filepath.Base(path),
+		Data:    data,
+	})
+	if err != nil {
+		logrus.Errorf("json pcap error: %v", err)
+		return
+	}
+	msg, err := json.Marshal(cds.NewMessage("pcap", string(file)))
+	if err != nil {
+		logrus.Errorf("json pcap error: %v", err)
+		return
 	}
+	tp.ResultChan <- msg
 }
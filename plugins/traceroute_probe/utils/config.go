@@ -19,6 +19,26 @@ type RunArgs struct {
 	PacketRate         float64 `toml:"packetRate"`
 	ReloadConfDuration uint    `toml:"reloadConfDuration"`
 	ReportFreq         uint8   `toml:"reportFreq"`
+	TCPPort            uint16  `toml:"tcpPort"`  // tcp 探测默认目的端口，为 0 时使用 80
+	Mode               string  `toml:"mode"`     // 默认探测模式 simple / mda / mda-lite，为空时使用 simple
+	Alpha              float64 `toml:"alpha"`    // MDA 每个顶点的失败概率上界，为 0 时使用 0.05
+	Alias              bool    `toml:"alias"`    // 默认是否在探测结束后做别名解析
+	GapLimit           int     `toml:"gapLimit"` // 连续多少跳全部超时后停止，为 0 时使用 3
+	// 默认是否按 Doubletree 从中间跳开始探测，以及开始的 TTL，为 0 时使用 8
+	Doubletree bool  `toml:"doubletree"`
+	StartTTL   uint8 `toml:"startTTL"`
+	PMTUSize   int   `toml:"pmtuSize"` // PMTU 模式第一个探测的大小，为 0 时使用 1500
+	// 简单模式下默认比较的 DSCP 值，为空时不做 DSCP 扫描
+	DSCP []int `toml:"dscp"`
+	// 默认的探测负载长度，为 0 时使用 32（TCP 为 0），以及简单模式下默认比较的负载长度
+	PayloadSize  int   `toml:"payloadSize"`
+	PayloadSweep []int `toml:"payloadSweep"`
+	// 抓包文件的目录，为空时使用 ./pcap；超过 PcapMaxSize(MB，为 0 时使用 32，最大 32) 的文件只保留在本地，不上报
+	PcapDir     string `toml:"pcapDir"`
+	PcapMaxSize int    `toml:"pcapMaxSize"`
+	// 选择本地源地址时借助路由表查询的远端地址(host:port)，不会真正发包，为空时使用 DefaultRouteProbe(6)
+	RouteProbe  string `toml:"routeProbe"`
+	RouteProbe6 string `toml:"routeProbe6"`
 }
 
 type WebSocketConf struct {
@@ -32,6 +52,17 @@ type MatchCacheConf struct {
 	CheckFreq uint8 `toml:"checkFreq"`
 }
 
+// 未在配置文件中给出时使用的默认值
+var (
+	DefaultPcapDir     = "./pcap"
+	DefaultPcapMaxSize = 32
+	DefaultRouteProbe  = "114.114.114.114:53"
+	DefaultRouteProbe6 = "[2400:3200::1]:53"
+)
+
+// MaxPcapMaxSize 上报的抓包文件大小的上限(MB)，编码后需小于控制节点 websocket 单条消息的上限
+const MaxPcapMaxSize = 32
+
 var (
 	ConfigFile string
 	ConfigData *Config
@@ -59,6 +90,23 @@ func ParseConfig(cfg string) error {
 	return nil
 }
 
+// UseDefaultConfig 没有配置文件时（如命令行单次探测）使用的配置
+func UseDefaultConfig() {
+	c := &Config{
+		RunArgs: RunArgs{
+			FirstSendCnt: 3,
+			PacketRate:   10,
+		},
+		MatchCacheConf: MatchCacheConf{
+			Timeout:   2,
+			CheckFreq: 1,
+		},
+	}
+	ConfigLock.Lock()
+	ConfigData = c
+	ConfigLock.Unlock()
+}
+
 func ReloadConfig() {
 	if !isModify() {
 		return
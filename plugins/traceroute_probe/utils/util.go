@@ -21,6 +21,14 @@ func GetHash(src net.IP, dst net.IP, srcPort uint16, dstPort uint16, proto uint1
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
+// IPBytes IPv4 地址返回 4 字节形式，IPv6 地址返回 16 字节形式，便于按地址族计算哈希
+func IPBytes(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
 // CheckSum 计算校验和
 func CheckSum(buf []byte) uint16 {
 	sum := uint32(0)
@@ -47,3 +55,29 @@ func CheckSum(buf []byte) uint16 {
 	}
 	return csum
 }
+
+// Sum16 计算 buf 按 16 位的反码和（未取反），用于在构造报文时预先求部分校验和
+func Sum16(buf []byte) uint16 {
+	sum := uint32(0)
+
+	for ; len(buf) >= 2; buf = buf[2:] {
+		sum += uint32(buf[0])<<8 | uint32(buf[1])
+	}
+	if len(buf) > 0 {
+		sum += uint32(buf[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// ForgeCheckSum 已知除某 16 位空位外其余数据的反码和 sum，返回应填入空位的值，
+// 使最终的校验和恰好等于 want。Paris traceroute 借此把探测标识编码进校验和字段。
+func ForgeCheckSum(sum uint16, want uint16) uint16 {
+	x := uint32(^want) + uint32(^sum)
+	for x > 0xffff {
+		x = (x >> 16) + (x & 0xffff)
+	}
+	return uint16(x)
+}
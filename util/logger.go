@@ -41,6 +41,11 @@ func (m *MyFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 }
 
 func InitLog(appName string) {
+	InitLogWithConf(appName, "./logs", "")
+}
+
+// InitLogWithConf 按指定的日志目录和日志级别初始化 logrus，level 为空时使用默认级别 info
+func InitLogWithConf(appName string, logDir string, level string) {
 	// 输出文件名，行号和函数名
 	logrus.SetReportCaller(true)
 
@@ -49,11 +54,11 @@ func InitLog(appName string) {
 	logrus.SetOutput(os.Stdout)
 
 	//设置 output,默认为 stderr,可以为任何 io.Writer，比如文件 *os.File
-	isExists := FileOrPathIsExists("./logs")
+	isExists := FileOrPathIsExists(logDir)
 	if !isExists {
-		os.Mkdir("./logs", os.ModePerm)
+		os.MkdirAll(logDir, os.ModePerm)
 	}
-	logFile, err := os.OpenFile("./logs/"+appName+"_"+GetToday()+".log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	logFile, err := os.OpenFile(filepath.Join(logDir, appName+"_"+GetToday()+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	writers := []io.Writer{
 		logFile,
 		os.Stdout}
@@ -64,5 +69,12 @@ func InitLog(appName string) {
 		logrus.Info("failed to logs to file.")
 	}
 	// 设置最低 loglevel，默认 info
-	//logrus.SetLevel(logrus.InfoLevel)
+	if level != "" {
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil {
+			logrus.Errorf("invalid log level [%s]: %v", level, err)
+			return
+		}
+		logrus.SetLevel(lvl)
+	}
 }
@@ -2,6 +2,7 @@ package util
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"regexp"
 	"sort"
@@ -48,6 +49,16 @@ func SortInsertUint32(s *[]uint32, e uint32) {
 	*s = ss
 }
 
+// ContainsString 判断 s 中是否包含 e
+func ContainsString(s []string, e string) bool {
+	for _, v := range s {
+		if v == e {
+			return true
+		}
+	}
+	return false
+}
+
 func FileOrPathIsExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil || os.IsExist(err)
@@ -77,6 +88,10 @@ func ParseConfigToml(conf string, c interface{}) error {
 
 // MatchDst 目的地址为域名则返回0，为IP则返回1，都不是则返回-1
 func MatchDst(dst string) int8 {
+	// IPv6 地址也会被域名的正则匹配上，先按 IP 解析
+	if net.ParseIP(dst) != nil {
+		return 1
+	}
 	domain := regexp.MustCompile(`^((http://)|(https://))?[a-zA-Z0-9][-a-zA-Z0-9]{0,62}(.[a-zA-Z0-9][-a-zA-Z0-9]{0,62})+.?`)
 	ip := regexp.MustCompile(`((?:(?:25[0-5]|2[0-4]d|[01]?d?d).){3}(?:25[0-5]|2[0-4]d|[01]?d?d))`)
 	if domain.MatchString(dst) {